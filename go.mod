@@ -3,7 +3,6 @@ module github.com/geph-official/geph2
 go 1.12
 
 require (
-	github.com/abh/geoip v0.0.0-20160510155516-07cea4480daa
 	github.com/bunsim/goproxy v0.0.0-20170228195103-3c809b25484a
 	github.com/cryptoballot/fdh v0.0.0-20170924224734-5eb31ce2010c // indirect
 	github.com/cryptoballot/rsablind v0.0.0-20170925165423-14f9913880b7
@@ -0,0 +1,120 @@
+// Package bdtest provides an in-process fake binder, so that code talking to the binder can be tested offline.
+package bdtest
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+// Binder is a fake binder. It implements the bridge and exit endpoints of the real one, keeping everything in memory and not testing bridges before accepting them.
+type Binder struct {
+	// Secret is the bridge key that new bridge identities must present.
+	Secret string
+	// CertValidity is how long bridge certificates last.
+	CertValidity time.Duration
+
+	msk ed25519.PrivateKey
+
+	lock       sync.Mutex
+	exits      []bridgeauth.ExitInfo
+	identities map[string]bool
+	bridges    map[string]bridgeauth.BridgeDescriptor
+}
+
+// New creates a fake binder with a fresh master key.
+func New(secret string) *Binder {
+	_, msk, _ := ed25519.GenerateKey(nil)
+	return &Binder{
+		Secret:       secret,
+		CertValidity: time.Hour,
+		msk:          msk,
+		identities:   make(map[string]bool),
+		bridges:      make(map[string]bridgeauth.BridgeDescriptor),
+	}
+}
+
+// MPK returns the master public key.
+func (b *Binder) MPK() ed25519.PublicKey {
+	return b.msk.Public().(ed25519.PublicKey)
+}
+
+// MSK returns the master secret key, for tests that need to forge binder statements.
+func (b *Binder) MSK() ed25519.PrivateKey {
+	return b.msk
+}
+
+// AddExit adds an exit to the list served to bridges.
+func (b *Binder) AddExit(exit bridgeauth.ExitInfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.exits = append(b.exits, exit)
+}
+
+// Bridges returns the latest descriptor of every registered bridge.
+func (b *Binder) Bridges() []bridgeauth.BridgeDescriptor {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var toret []bridgeauth.BridgeDescriptor
+	for _, desc := range b.bridges {
+		toret = append(toret, desc)
+	}
+	return toret
+}
+
+// ServeHTTP implements http.Handler.
+func (b *Binder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/add-bridge":
+		b.handleAddBridge(w, r)
+	case "/get-exits":
+		b.handleGetExits(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (b *Binder) handleAddBridge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var desc bridgeauth.BridgeDescriptor
+	if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&desc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := desc.Verify(time.Minute * 5); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := hex.EncodeToString(desc.Key)
+	if !b.identities[id] {
+		_, pwd, _ := r.BasicAuth()
+		if pwd != b.Secret {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		b.identities[id] = true
+	}
+	b.bridges[id] = desc
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(bridgeauth.NewBridgeCert(b.msk, desc.Key, b.CertValidity))
+}
+
+func (b *Binder) handleGetExits(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	el := bridgeauth.ExitList{Exits: append([]bridgeauth.ExitInfo(nil), b.exits...)}
+	b.lock.Unlock()
+	el.Sign(b.msk)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(el)
+}
@@ -0,0 +1,71 @@
+package bdtest
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+func TestAddBridge(t *testing.T) {
+	fb := New("secret")
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+	bclient := bdclient.NewClient(srv.URL, "binder.test")
+	_, bsk, _ := ed25519.GenerateKey(nil)
+	desc := bridgeauth.BridgeDescriptor{Cookie: make([]byte, 32), Hosts: []string{"1.2.3.4:5678"}, AllocGroup: "test"}
+	desc.Sign(bsk)
+	// new identities need the secret
+	if _, err := bclient.AddBridge("wrong", desc); err == nil {
+		t.Fatal("new identity enrolled without the secret")
+	}
+	cert, err := bclient.AddBridge("secret", desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(fb.MPK()); err != nil {
+		t.Fatal(err)
+	}
+	// known identities don't
+	desc.Hosts = []string{"1.2.3.4:9999", "[2001:db8::1]:53"}
+	desc.Sign(bsk)
+	if _, err := bclient.AddBridge("", desc); err != nil {
+		t.Fatal("known identity refused:", err)
+	}
+	if got := fb.Bridges(); len(got) != 1 || len(got[0].Hosts) != 2 {
+		t.Fatalf("wrong bridges %+v", got)
+	}
+	// tampering is caught
+	desc.Hosts = []string{"6.6.6.6:6666"}
+	if _, err := bclient.AddBridge("secret", desc); err == nil {
+		t.Fatal("tampered descriptor accepted")
+	}
+}
+
+func TestGetExits(t *testing.T) {
+	fb := New("secret")
+	fb.AddExit(bridgeauth.ExitInfo{Name: "test.exits.geph.io", Addr: "127.0.0.1:2389"})
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+	bclient := bdclient.NewClient(srv.URL, "binder.test")
+	if _, err := bclient.GetExits(time.Minute); err != bdclient.ErrNoMasterKey {
+		t.Fatal("got exits without a pinned master key:", err)
+	}
+	// a list signed by someone else is refused
+	other := New("secret")
+	bclient.PinMasterKey(other.MPK())
+	if _, err := bclient.GetExits(time.Minute); err == nil {
+		t.Fatal("accepted a list signed by the wrong key")
+	}
+	bclient.PinMasterKey(fb.MPK())
+	el, err := bclient.GetExits(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := el.Find("test.exits.geph.io"); !ok {
+		t.Fatal("exit missing")
+	}
+}
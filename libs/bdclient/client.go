@@ -2,18 +2,23 @@ package bdclient
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
-	"github.com/cryptoballot/rsablind"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/pow"
+	"github.com/geph-official/geph2/libs/tiresias"
 )
 
 // Client represents a binder client.
@@ -21,11 +26,29 @@ type Client struct {
 	hclient     *http.Client
 	frontDomain string
 	realDomain  string
+	mpk         ed25519.PublicKey
 }
 
-// NewClient creates a new domain-fronting binder client with the given frontDomain and realDomain. frontDomain should start with `https://`.
+// ErrNoMasterKey means that something signed by the binder was asked for, but there is no master key to check it against.
+var ErrNoMasterKey = errors.New("no binder master key pinned")
+
+// DefaultMPK is the hex-encoded master public key of the production binder, which every client pins unless told otherwise. The key belongs to whoever runs the binder, so release builds set it at link time:
+//
+//	go build -ldflags "-X github.com/geph-official/geph2/libs/bdclient.DefaultMPK=<key>"
+var DefaultMPK string
+
+// ParseMasterKey decodes a hex-encoded master public key, such as DefaultMPK.
+func ParseMasterKey(mpkHex string) (ed25519.PublicKey, error) {
+	mpk, err := hex.DecodeString(mpkHex)
+	if err != nil || len(mpk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad binder master public key %q", mpkHex)
+	}
+	return mpk, nil
+}
+
+// NewClient creates a new domain-fronting binder client with the given frontDomain and realDomain. frontDomain should start with `https://`. The client pins DefaultMPK, if the build has one.
 func NewClient(frontDomain, realDomain string) *Client {
-	return &Client{
+	cl := &Client{
 		hclient: &http.Client{
 			Transport: &http.Transport{
 				Proxy: nil,
@@ -34,16 +57,32 @@ func NewClient(frontDomain, realDomain string) *Client {
 		frontDomain: frontDomain,
 		realDomain:  realDomain,
 	}
+	if DefaultMPK != "" {
+		mpk, err := ParseMasterKey(DefaultMPK)
+		if err != nil {
+			panic(err)
+		}
+		cl.mpk = mpk
+	}
+	return cl
+}
+
+// PinMasterKey makes the client check everything the binder signs against the given master public key, which the binder prints at startup. It overrides DefaultMPK.
+func (cl *Client) PinMasterKey(mpk ed25519.PublicKey) {
+	cl.mpk = mpk
 }
 
 func badStatusCode(s int) error {
 	return fmt.Errorf("unexpected status code %v", s)
 }
 
-// ClientInfo describes user IP and country.
+// ClientInfo describes user IP and where it is.
 type ClientInfo struct {
 	Address string
 	Country string
+	City    string
+	ASN     uint
+	ASOrg   string
 }
 
 // GetClientInfo checks user info
@@ -62,10 +101,15 @@ func (cl *Client) GetClientInfo() (ui ClientInfo, err error) {
 	return
 }
 
-// AddBridge uploads some bridge info.
-func (cl *Client) AddBridge(secret string, cookie []byte, host string) (err error) {
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/add-bridge?cookie=%x&host=%v", cl.frontDomain, cookie, host), bytes.NewReader(nil))
+// AddBridge registers a signed bridge descriptor, returning the binder's certificate for the bridge's key. The secret is only needed the first time a bridge identity registers.
+func (cl *Client) AddBridge(secret string, desc bridgeauth.BridgeDescriptor) (cert bridgeauth.BridgeCert, err error) {
+	body, err := json.Marshal(desc)
+	if err != nil {
+		return
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%v/add-bridge", cl.frontDomain), bytes.NewReader(body))
 	req.Host = cl.realDomain
+	req.Header.Set("content-type", "application/json")
 	req.SetBasicAuth("user", secret)
 	resp, err := cl.hclient.Do(req)
 	if err != nil {
@@ -74,12 +118,30 @@ func (cl *Client) AddBridge(secret string, cookie []byte, host string) (err erro
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err = badStatusCode(resp.StatusCode)
+		return
 	}
+	err = json.NewDecoder(resp.Body).Decode(&cert)
 	return
 }
 
-// GetTicketKey obtains the remote ticketing key.
-// TODO caching, gossip?
+// GetCensoredCountries obtains the codes of the countries where the binder wants clients to use bridges.
+func (cl *Client) GetCensoredCountries() (countries []string, err error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/censored-countries", cl.frontDomain), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&countries)
+	return
+}
+
+// GetTicketKey obtains the remote ticketing key of the current epoch. It's only for old verifiers; use GetTicketKeys instead, since the key changes every epoch.
 func (cl *Client) GetTicketKey(tier string) (tkey *rsa.PublicKey, err error) {
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket-key?tier=%v", cl.frontDomain, tier), bytes.NewReader(nil))
 	req.Host = cl.realDomain
@@ -104,6 +166,44 @@ func (cl *Client) GetTicketKey(tier string) (tkey *rsa.PublicKey, err error) {
 	return
 }
 
+// GetTicketKeys obtains the published ticketing keys of a tier, with the epochs they belong to and when they are valid.
+// TODO caching, gossip?
+func (cl *Client) GetTicketKeys(tier string) (keys []tiresias.KeyInfo, err error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket-key?tier=%v&format=json", cl.frontDomain, tier), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	return
+}
+
+// GetTicketKeysFor obtains the published ticketing keys of a particular set of attributes, which is what verifiers need to check tickets that claim them.
+func (cl *Client) GetTicketKeysFor(attrs tiresias.Attrs) (keys []tiresias.KeyInfo, err error) {
+	v := url.Values{}
+	v.Set("attrs", attrs.Name())
+	v.Set("format", "json")
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket-key?%v", cl.frontDomain, v.Encode()), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	return
+}
+
 // GetTier gets the tier of a user.
 func (cl *Client) GetTier(username, password string) (tier string, err error) {
 	v := url.Values{}
@@ -138,40 +238,188 @@ type PaymentTx struct {
 	Amount int
 }
 
-// GetTicket obtains an authentication ticket.
-func (cl *Client) GetTicket(username, password string) (ubmsg, ubsig []byte, details TicketResp, err error) {
-	// First get ticket key
-	fkey, err := cl.GetTicketKey("free")
+// Invoice is a bill for a subscription plan.
+type Invoice struct {
+	ID   string
+	Plan string
+	// Amount is the price in USD cents.
+	Amount int
+	// Days is how long paying extends the subscription by.
+	Days    int
+	Created time.Time
+	// PayURL is where to pay, if the binder knows.
+	PayURL string
+}
+
+// CreateInvoice creates an invoice for a subscription plan, such as "month". Once paid, the new expiry shows up in TicketResp.
+func (cl *Client) CreateInvoice(username, password, plan string) (inv Invoice, err error) {
+	v := url.Values{}
+	v.Set("user", username)
+	v.Set("pwd", password)
+	v.Set("plan", plan)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%v/create-invoice", cl.frontDomain), bytes.NewReader([]byte(v.Encode())))
+	req.Host = cl.realDomain
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp, err := cl.hclient.Do(req)
 	if err != nil {
 		return
 	}
-	pkey, err := cl.GetTicketKey("paid")
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&inv)
+	return
+}
+
+// PowChallenge is a proof of work to do instead of solving a captcha when registering.
+type PowChallenge struct {
+	Challenge  []byte
+	Difficulty int
+}
+
+// Reasons the binder gives for refusing to register a user.
+const (
+	RegBadUsername   = "bad-username"
+	RegBadPassword   = "bad-password"
+	RegUsernameTaken = "username-taken"
+	RegBadCaptcha    = "bad-captcha"
+	RegBadPow        = "bad-pow"
+)
+
+// RegisterError is returned when the binder refuses to register a user. Message explains the Reason to people.
+type RegisterError struct {
+	Reason  string
+	Message string
+}
+
+func (e RegisterError) Error() string {
+	return "registration refused: " + e.Message
+}
+
+// MaxPowDifficulty is the most proof of work Register does. The binder never asks for more, so a harder challenge means someone is trying to make us spin forever.
+const MaxPowDifficulty = 28
+
+// ErrPowTooHard is returned by Register when the binder asks for more than MaxPowDifficulty.
+var ErrPowTooHard = errors.New("binder asked for too much proof of work")
+
+// Register creates an account, doing the binder's proof of work instead of a captcha. This may take a while when many people are registering, but never longer than timeout, after which pow.ErrDeadline is returned.
+func (cl *Client) Register(username, password string, timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/pow-challenge", cl.frontDomain), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return badStatusCode(resp.StatusCode)
+	}
+	var pc PowChallenge
+	if err = json.NewDecoder(resp.Body).Decode(&pc); err != nil {
+		return
+	}
+	if pc.Difficulty > MaxPowDifficulty {
+		return ErrPowTooHard
+	}
+	nonce, err := pow.Solve(pc.Challenge, pc.Difficulty, deadline)
+	if err != nil {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"Username":     username,
+		"Password":     password,
+		"PowChallenge": pc.Challenge,
+		"PowNonce":     nonce,
+	})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("%v/register", cl.frontDomain), bytes.NewReader(body))
+	req.Host = cl.realDomain
+	req.Header.Set("content-type", "application/json")
+	resp, err = cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var re RegisterError
+		if json.NewDecoder(resp.Body).Decode(&re) == nil && re.Reason != "" {
+			return re
+		}
+		return badStatusCode(resp.StatusCode)
+	}
+	return
+}
+
+// VoucherResp is what redeeming a voucher got us.
+type VoucherResp struct {
+	Days       int
+	PaidExpiry time.Time
+}
+
+// Errors returned by RedeemVoucher.
+var (
+	ErrNoVoucher       = errors.New("no such voucher")
+	ErrVoucherRedeemed = errors.New("voucher already redeemed, or another from its batch was")
+)
+
+// RedeemVoucher redeems a voucher code for days of paid tier.
+func (cl *Client) RedeemVoucher(username, password, code string) (vr VoucherResp, err error) {
+	v := url.Values{}
+	v.Set("user", username)
+	v.Set("pwd", password)
+	v.Set("code", code)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%v/redeem-voucher", cl.frontDomain), bytes.NewReader([]byte(v.Encode())))
+	req.Host = cl.realDomain
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp, err := cl.hclient.Do(req)
 	if err != nil {
 		return
 	}
-	// Pick
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		err = ErrNoVoucher
+		return
+	case 409:
+		err = ErrVoucherRedeemed
+		return
+	default:
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&vr)
+	return
+}
+
+// GetTicket obtains an authentication ticket.
+func (cl *Client) GetTicket(username, password string) (ubmsg, ubsig []byte, details TicketResp, err error) {
+	// Pick the tier, then the key currently signing tickets for it
 	tier, err := cl.GetTier(username, password)
 	if err != nil {
 		return
 	}
-	var tkey *rsa.PublicKey
-	if tier == "free" {
-		tkey = fkey
-	} else {
-		tkey = pkey
+	keys, err := cl.GetTicketKeys(tier)
+	if err != nil {
+		return
+	}
+	ki, err := tiresias.CurrentKey(keys, time.Now())
+	if err != nil {
+		return
 	}
 	// Create our ticketing request
-	unblinded := make([]byte, 1536/8)
-	rand.Read(unblinded)
-	blinded, unblinder, err := rsablind.Blind(tkey, unblinded)
+	treq, err := tiresias.NewRequest(ki)
 	if err != nil {
-		panic(err)
+		return
 	}
 	// Obtain the ticket
 	v := url.Values{}
 	v.Set("user", username)
 	v.Set("pwd", password)
-	v.Set("blinded", base64.RawStdEncoding.EncodeToString(blinded))
+	v.Set("blinded", base64.RawStdEncoding.EncodeToString(treq.Blinded))
+	v.Set("epoch", strconv.FormatUint(ki.Epoch, 10))
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket?%v", cl.frontDomain, v.Encode()), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	resp, err := cl.hclient.Do(req)
@@ -185,19 +433,36 @@ func (cl *Client) GetTicket(username, password string) (ubmsg, ubsig []byte, det
 		return
 	}
 	// unblind the ticket
-	ubsig = rsablind.Unblind(tkey, respDec.Ticket, unblinder)
-	ubmsg = unblinded
+	ticket, err := treq.Unblind(respDec.Ticket)
+	if err != nil {
+		return
+	}
+	ubmsg, ubsig = ticket.Msg, ticket.Sig
 	details = respDec
 	return
 }
 
 // BridgeInfo describes a bridge
 type BridgeInfo struct {
-	Cookie   []byte
-	Host     string
+	Cookie []byte
+	Host   string
+	// Endpoints are all the addresses the bridge can be reached at, including Host.
+	Endpoints []string
+	// Identity is the bridge's identity key.
+	Identity []byte
+	// Cert is the binder's certificate for Identity, which the first bridge of a chain checks.
+	Cert     bridgeauth.BridgeCert
 	LastSeen time.Time
 }
 
+// AllEndpoints returns the bridge's endpoints, falling back to Host for binders that don't list them.
+func (bi BridgeInfo) AllEndpoints() []string {
+	if len(bi.Endpoints) == 0 {
+		return []string{bi.Host}
+	}
+	return bi.Endpoints
+}
+
 // GetBridges obtains a set of bridges.
 func (cl *Client) GetBridges(ubmsg, ubsig []byte) (bridges []BridgeInfo, err error) {
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-bridges", cl.frontDomain), bytes.NewReader(nil))
@@ -215,6 +480,31 @@ func (cl *Client) GetBridges(ubmsg, ubsig []byte) (bridges []BridgeInfo, err err
 	return
 }
 
+// GetChain obtains two bridges to chain, the first relaying to the second.
+func (cl *Client) GetChain(ubmsg, ubsig []byte) (first, second BridgeInfo, err error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-chain", cl.frontDomain), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	var chain []BridgeInfo
+	if err = json.NewDecoder(resp.Body).Decode(&chain); err != nil {
+		return
+	}
+	if len(chain) != 2 {
+		err = fmt.Errorf("chain of %v bridges", len(chain))
+		return
+	}
+	first, second = chain[0], chain[1]
+	return
+}
+
 // RedeemTicket redeems a ticket.
 func (cl *Client) RedeemTicket(tier string, ubmsg, ubsig []byte) (err error) {
 	// Obtain the ticket
@@ -235,3 +525,72 @@ func (cl *Client) RedeemTicket(tier string, ubmsg, ubsig []byte) (err error) {
 	}
 	return
 }
+
+// AddExit registers a signed exit descriptor. The secret is only needed the first time an exit registers its key or name.
+func (cl *Client) AddExit(secret string, desc bridgeauth.ExitDescriptor) (err error) {
+	body, err := json.Marshal(desc)
+	if err != nil {
+		return
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%v/add-exit", cl.frontDomain), bytes.NewReader(body))
+	req.Host = cl.realDomain
+	req.Header.Set("content-type", "application/json")
+	req.SetBasicAuth("exit", secret)
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+	}
+	return
+}
+
+// GetExitDirectory obtains the directory of exits that clients choose from, checking that it was signed with the pinned master key no longer than maxAge ago.
+func (cl *Client) GetExitDirectory(maxAge time.Duration) (dir bridgeauth.ExitDirectory, err error) {
+	if cl.mpk == nil {
+		err = ErrNoMasterKey
+		return
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-exit-directory", cl.frontDomain), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return
+	}
+	err = dir.Verify(cl.mpk, maxAge)
+	return
+}
+
+// GetExits obtains the list of exits that bridges forward to, checking that it was signed with the pinned master key no longer than maxAge ago.
+func (cl *Client) GetExits(maxAge time.Duration) (exits bridgeauth.ExitList, err error) {
+	if cl.mpk == nil {
+		err = ErrNoMasterKey
+		return
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-exits", cl.frontDomain), bytes.NewReader(nil))
+	req.Host = cl.realDomain
+	resp, err := cl.hclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&exits); err != nil {
+		return
+	}
+	err = exits.Verify(cl.mpk, maxAge)
+	return
+}
@@ -0,0 +1,320 @@
+package binder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/patrickmn/go-cache"
+)
+
+// cache of all bridge info, keyed by identity, which unlike the cookie survives rotation. string => bridgeInfo
+var bridgeCache = cache.New(time.Hour, time.Hour)
+
+type bridgeInfo struct {
+	Cookie []byte
+	// Host is the first endpoint, for clients that don't know about Endpoints
+	Host      string
+	Endpoints []string
+	// Identity is the bridge's identity key, which clients check when sealing connections through chained bridges
+	Identity []byte
+	// Cert is the binder's certificate for Identity, which bridges check before chaining to the bridge
+	Cert     bridgeauth.BridgeCert
+	LastSeen time.Time
+	// the full descriptor is for us, not for clients
+	Desc bridgeauth.BridgeDescriptor `json:"-"`
+	// when Endpoints were last tested
+	Tested time.Time `json:"-"`
+}
+
+func addBridge(nfo bridgeInfo) {
+	bridgeCache.SetDefault(string(nfo.Desc.Key), nfo)
+}
+
+// cache of bridge *mappings*. string => []string
+var bridgeMapCache = cache.New(time.Hour*6, time.Hour)
+
+// a client's bridges are remapped once any of them is busier than this, so that load spreads out before bridges saturate
+const remapUtilization = 0.8
+
+func getBridges(id string) []string {
+	if mapping, ok := bridgeMapCache.Get(id); ok && mappingFresh(mapping.([]string)) {
+		return mapping.([]string)
+	}
+	// weigh every bridge by its spare capacity, so that underused bridges get more clients
+	itms := bridgeCache.Items()
+	weights := make(map[string]float64)
+	var totalWeight float64
+	for k, itm := range itms {
+		desc := itm.Object.(bridgeInfo).Desc
+		if desc.Saturated() {
+			continue
+		}
+		weights[k] = 1 - desc.Utilization()
+		totalWeight += weights[k]
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+	seed := fmt.Sprintf("%v-%v", id, time.Now())
+	var toret []string
+	for k, weight := range weights {
+		probability := 10.0 * weight / totalWeight
+		h := sha256.Sum256([]byte(k + seed))
+		num := binary.BigEndian.Uint32(h[:4])
+		if float64(num) < probability*float64(4294967295) {
+			toret = append(toret, k)
+		}
+	}
+	bridgeMapCache.SetDefault(id, toret)
+	return toret
+}
+
+// mappingFresh returns whether a mapping still has usable bridges, none of them busier than remapUtilization.
+func mappingFresh(bridges []string) bool {
+	usable := usableBridges(bridges)
+	for _, bi := range usable {
+		if bi.Desc.Utilization() > remapUtilization {
+			return false
+		}
+	}
+	return len(usable) > 0
+}
+
+// usableBridges filters out bridges that have disappeared or are saturated.
+func usableBridges(bridges []string) []bridgeInfo {
+	var toret []bridgeInfo
+	for _, str := range bridges {
+		if val, ok := bridgeCache.Get(str); ok && !val.(bridgeInfo).Desc.Saturated() {
+			toret = append(toret, val.(bridgeInfo))
+		}
+	}
+	return toret
+}
+
+func handleGetBridges(w http.ResponseWriter, r *http.Request) {
+	// TODO validate the ticket
+	bridges := getBridges(r.RemoteAddr)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(usableBridges(bridges))
+}
+
+// getChain picks two bridges for a client that doesn't want any one bridge to see both its address and its exit. The first is one of the client's usual bridges. The second comes from another allocation group when possible, so that the same operator is unlikely to run both.
+func getChain(id string) (chain []bridgeInfo, ok bool) {
+	chainID := "chain-" + id
+	if mapping, ok := bridgeMapCache.Get(chainID); ok {
+		if chain := usableBridges(mapping.([]string)); len(chain) == 2 {
+			return chain, true
+		}
+	}
+	firsts := usableBridges(getBridges(id))
+	if len(firsts) == 0 {
+		return
+	}
+	first := firsts[rand.Intn(len(firsts))]
+	var candidates, otherGroup []bridgeInfo
+	for _, itm := range bridgeCache.Items() {
+		bi := itm.Object.(bridgeInfo)
+		if bi.Desc.Saturated() || bytes.Equal(bi.Identity, first.Identity) {
+			continue
+		}
+		candidates = append(candidates, bi)
+		if bi.Desc.AllocGroup != first.Desc.AllocGroup {
+			otherGroup = append(otherGroup, bi)
+		}
+	}
+	if len(otherGroup) > 0 {
+		candidates = otherGroup
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	// weigh the second hop by spare capacity, just like ordinary allocation
+	var totalWeight float64
+	for _, bi := range candidates {
+		totalWeight += 1 - bi.Desc.Utilization()
+	}
+	second := candidates[len(candidates)-1]
+	pick := rand.Float64() * totalWeight
+	for _, bi := range candidates {
+		pick -= 1 - bi.Desc.Utilization()
+		if pick < 0 {
+			second = bi
+			break
+		}
+	}
+	bridgeMapCache.SetDefault(chainID, []string{string(first.Identity), string(second.Identity)})
+	return []bridgeInfo{first, second}, true
+}
+
+func handleGetChain(w http.ResponseWriter, r *http.Request) {
+	// TODO validate the ticket
+	chain, ok := getChain(r.RemoteAddr)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(chain)
+}
+
+// descriptors signed longer ago than this are refused
+const maxDescriptorAge = time.Minute * 5
+
+// bridges get certificates valid for this long, and renew them every time they register
+const bridgeCertValidity = time.Hour * 24
+
+// a bridge identity may only register this often
+const minRegisterInterval = time.Second * 10
+
+// endpoints that haven't changed are tested again after this long
+const retestInterval = time.Minute * 30
+
+// bridge identities that registered recently. string => bool
+var recentBridges = cache.New(minRegisterInterval, time.Minute)
+
+// workingEndpoints returns those of a registering bridge's endpoints that pass a ping test, and when they were tested. Bridges register every few minutes, so endpoints are only tested again when they or the cookie changed, or when they were last tested long ago.
+func workingEndpoints(desc bridgeauth.BridgeDescriptor) ([]string, time.Time) {
+	if val, ok := bridgeCache.Get(string(desc.Key)); ok {
+		old := val.(bridgeInfo)
+		if bytes.Equal(old.Cookie, desc.Cookie) && sameHosts(old.Desc.Hosts, desc.Hosts) &&
+			time.Since(old.Tested) < retestInterval {
+			return old.Endpoints, old.Tested
+		}
+	}
+	passed := make([]bool, len(desc.Hosts))
+	var wg sync.WaitGroup
+	for i, host := range desc.Hosts {
+		i, host := i, host
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			passed[i] = testBridge(desc.Cookie, host)
+		}()
+	}
+	wg.Wait()
+	var endpoints []string
+	for i, host := range desc.Hosts {
+		if passed[i] {
+			endpoints = append(endpoints, host)
+		}
+	}
+	return endpoints, time.Now()
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func handleAddBridge(w http.ResponseWriter, r *http.Request) {
+	var desc bridgeauth.BridgeDescriptor
+	err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&desc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := desc.Verify(maxDescriptorAge); err != nil {
+		log.Println("bad descriptor from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if recentBridges.Add(string(desc.Key), true, cache.DefaultExpiration) != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	// new identities must know a bridge key; known ones are vouched for by their signature
+	known, err := store.CheckBridgeIdentity(desc.Key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		_, pwd, _ := r.BasicAuth()
+		ok, err := store.CheckBridgeKey(pwd)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := store.AddBridgeIdentity(desc.Key, desc.AllocGroup); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("enrolled bridge identity %x in %v", desc.Key, desc.AllocGroup)
+	}
+	// only advertise the endpoints that actually work
+	bi := bridgeInfo{
+		Cookie:   desc.Cookie,
+		Identity: desc.Key,
+		LastSeen: time.Now(),
+		Desc:     desc,
+	}
+	bi.Endpoints, bi.Tested = workingEndpoints(desc)
+	if len(bi.Endpoints) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	bi.Host = bi.Endpoints[0]
+	sk, err := store.MasterIdentity()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bi.Cert = bridgeauth.NewBridgeCert(sk, desc.Key, bridgeCertValidity)
+	// add the bridge
+	addBridge(bi)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(bi.Cert)
+}
+
+// testBridge pings a bridge endpoint. It is a variable so that tests can fake it.
+var testBridge = func(cookie []byte, host string) bool {
+	udpsock, err := net.ListenPacket("udp", ":")
+	if err != nil {
+		panic(err)
+	}
+	defer udpsock.Close()
+	e2e := niaucchi4.ObfsListen(cookie, udpsock)
+	if err != nil {
+		panic(err)
+	}
+	defer e2e.Close()
+	kcp, err := kcp.NewConn(host, nil, 0, 0, e2e)
+	if err != nil {
+		log.Println(host, "is not a valid endpoint:", err)
+		return false
+	}
+	defer kcp.Close()
+	kcp.SetDeadline(time.Now().Add(time.Second * 10))
+	start := time.Now()
+	if err := bridgeproto.Ping(kcp); err != nil {
+		log.Println(host, "failed ping test:", err)
+		return false
+	}
+	log.Println(host, "passed ping test in", time.Since(start))
+	return true
+}
@@ -0,0 +1,88 @@
+package binder
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+func TestAddBridge(t *testing.T) {
+	var tests int64
+	defer func(tb func([]byte, string) bool) { testBridge = tb }(testBridge)
+	testBridge = func(cookie []byte, host string) bool {
+		atomic.AddInt64(&tests, 1)
+		return host != "5.6.7.8:443"
+	}
+	ms := NewMemStore()
+	ms.AddBridgeKey("secret")
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+
+	_, bsk, _ := ed25519.GenerateKey(nil)
+	register := func(cookie byte, hosts ...string) error {
+		recentBridges.Flush()
+		desc := bridgeauth.BridgeDescriptor{Cookie: make([]byte, 32), Hosts: hosts, AllocGroup: "test", Capacity: 100}
+		desc.Cookie[0] = cookie
+		desc.Sign(bsk)
+		_, err := bc.AddBridge("secret", desc)
+		return err
+	}
+	endpoints := func() []string {
+		val, _ := bridgeCache.Get(string(bsk.Public().(ed25519.PublicKey)))
+		return val.(bridgeInfo).Endpoints
+	}
+	if err := register(1, "1.2.3.4:443", "5.6.7.8:443"); err != nil {
+		t.Fatal(err)
+	}
+	if tests != 2 || !sameHosts(endpoints(), []string{"1.2.3.4:443"}) {
+		t.Fatal("wrong endpoints", endpoints(), "after", tests, "tests")
+	}
+	// nothing changed, so nothing is tested
+	if err := register(1, "1.2.3.4:443", "5.6.7.8:443"); err != nil {
+		t.Fatal(err)
+	}
+	if tests != 2 || !sameHosts(endpoints(), []string{"1.2.3.4:443"}) {
+		t.Fatal("tested again without changes")
+	}
+	// new cookies and new endpoints are
+	if err := register(2, "1.2.3.4:443", "5.6.7.8:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register(2, "1.2.3.4:443", "9.9.9.9:443"); err != nil {
+		t.Fatal(err)
+	}
+	if tests != 6 || !sameHosts(endpoints(), []string{"1.2.3.4:443", "9.9.9.9:443"}) {
+		t.Fatal("changes not tested", endpoints(), "after", tests, "tests")
+	}
+	// registering too often is refused
+	desc := bridgeauth.BridgeDescriptor{Cookie: make([]byte, 32), Hosts: []string{"1.2.3.4:443"}, AllocGroup: "test"}
+	desc.Sign(bsk)
+	if _, err := bc.AddBridge("secret", desc); err == nil {
+		t.Fatal("registered twice in a row")
+	}
+}
+
+func TestGetBridges(t *testing.T) {
+	defer bridgeCache.Flush()
+	defer bridgeMapCache.Flush()
+	setLoad := func(key string, clients uint64) {
+		desc := bridgeauth.BridgeDescriptor{Capacity: 100, Load: bridgeauth.BridgeLoad{Clients: clients, CPUHeadroom: 100}}
+		bridgeCache.SetDefault(key, bridgeInfo{Desc: desc})
+	}
+	setLoad("a", 0)
+	setLoad("b", 0)
+	if bridges := getBridges("client"); !sameHosts(bridges, []string{"a", "b"}) {
+		t.Fatal("wrong bridges", bridges)
+	}
+	// a busy bridge gets the client remapped, even though it still works
+	setLoad("a", 90)
+	bridgeMapCache.SetDefault("client", []string{"a"})
+	if bridges := getBridges("client"); !sameHosts(bridges, []string{"a", "b"}) && !sameHosts(bridges, []string{"b"}) {
+		t.Fatal("kept a busy mapping", bridges)
+	}
+}
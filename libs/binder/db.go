@@ -0,0 +1,400 @@
+package binder
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/lib/pq"
+	"github.com/nullchinchilla/natrium"
+	"golang.org/x/crypto/ed25519"
+)
+
+// pgStore is a Store backed by PostgreSQL.
+type pgStore struct {
+	db *sql.DB
+}
+
+// newPgStore opens a PostgreSQL database, migrating it to the latest schema.
+func newPgStore(dsn string) (*pgStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	ps := &pgStore{db: db}
+	if err := ps.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// CheckBridgeKey checks whether a bridge cookie is allowed.
+func (ps *pgStore) CheckBridgeKey(key string) (ok bool, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var cookieCount uint
+	err = tx.QueryRow("select count(key) from bridgekeys where key = $1",
+		key).Scan(&cookieCount)
+	if err != nil {
+		return
+	}
+	ok = cookieCount > 0
+	err = tx.Commit()
+	return
+}
+
+// CheckBridgeIdentity checks whether a bridge identity key has been enrolled.
+func (ps *pgStore) CheckBridgeIdentity(key []byte) (ok bool, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var count uint
+	err = tx.QueryRow("select count(key) from bridgeids where key = $1", key).Scan(&count)
+	if err != nil {
+		return
+	}
+	ok = count > 0
+	err = tx.Commit()
+	return
+}
+
+// AddBridgeIdentity enrolls a bridge identity key.
+func (ps *pgStore) AddBridgeIdentity(key []byte, allocGroup string) (err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("insert into bridgeids (key, allocgroup, enrolled) values ($1, $2, $3) on conflict do nothing",
+		key, allocGroup, time.Now())
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// TicketIdentity returns the RSA ticket identity for a particular account class and epoch.
+func (ps *pgStore) TicketIdentity(tier string, epoch uint64) (sk *rsa.PrivateKey, err error) {
+	var skBts []byte
+	err = ps.db.QueryRow("select key from ticketkeys where tier = $1 and epoch = $2",
+		tier, int64(epoch)).Scan(&skBts)
+	if err == sql.ErrNoRows {
+		sk, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return
+		}
+		// another binder may have generated it first, in which case we use theirs
+		_, err = ps.db.Exec("insert into ticketkeys values ($1, $2, $3) on conflict do nothing",
+			tier, int64(epoch), x509.MarshalPKCS1PrivateKey(sk))
+		if err != nil {
+			return
+		}
+		err = ps.db.QueryRow("select key from ticketkeys where tier = $1 and epoch = $2",
+			tier, int64(epoch)).Scan(&skBts)
+	}
+	if err != nil {
+		return
+	}
+	sk, err = x509.ParsePKCS1PrivateKey(skBts)
+	return
+}
+
+// MasterIdentity returns the ed25519 master identity.
+func (ps *pgStore) MasterIdentity() (sk ed25519.PrivateKey, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("select value from secrets where key = $1", "master-id").Scan(&sk)
+	if err == sql.ErrNoRows {
+		err = nil
+		_, sk, _ = ed25519.GenerateKey(nil)
+		_, err = tx.Exec("insert into secrets values ($1, $2)", "master-id", sk)
+		if err != nil {
+			return
+		}
+		err = tx.Commit()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// VerifyUser verifies a username/password by looking up the database. uid < 0 means authentication failed.
+func (ps *pgStore) VerifyUser(uname, pwd string) (uid int, subExpiry time.Time, paytx map[time.Time]int, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow("SELECT ID, PwdHash FROM Users WHERE Username = $1", uname)
+	var PwdHash string
+	err = row.Scan(&uid, &PwdHash)
+	if err == sql.ErrNoRows {
+		uid = -1
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if !natrium.PasswordVerify([]byte(pwd), PwdHash) {
+		uid = -1
+		return
+	}
+	// check subscription
+	err = tx.QueryRow("select expires from subscriptions where id = $1", uid).Scan(&subExpiry)
+	if err == sql.ErrNoRows {
+		err = nil
+	} else if err != nil {
+		return
+	} else {
+		var rows *sql.Rows
+		// loop over the invoices
+		rows, err = tx.Query("select createtime, amount from invoices where id=$1 and paid='t'", uid)
+		if err != nil {
+			return
+		}
+		paytx = make(map[time.Time]int)
+		for rows.Next() {
+			var key time.Time
+			var val int
+			err = rows.Scan(&key, &val)
+			if err != nil {
+				return
+			}
+			paytx[key] = val
+		}
+	}
+	// TODO actually verify the pwd hash
+	err = tx.Commit()
+	return
+}
+
+// CreateUser creates a username/password pair, returning ErrUserExists if the username is taken.
+func (ps *pgStore) CreateUser(uname, pwd string) (err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	hpwd := natrium.PasswordHash([]byte(pwd), 5, 32*1024*1024)
+	_, err = tx.Exec("insert into users (username, pwdhash, freebalance, createtime) values ($1, $2, $3, $4)",
+		uname, hpwd, 10000, time.Now())
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// unique_violation
+		err = ErrUserExists
+	}
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// CreateInvoice creates an unpaid invoice for a user, for an amount in USD cents buying some days of subscription.
+func (ps *pgStore) CreateInvoice(uname string, amount, days int) (id string, created time.Time, err error) {
+	id = newInvoiceID()
+	created = time.Now()
+	res, err := ps.db.Exec(`insert into invoices (id, createtime, amount, paid, invoiceid, days)
+		select id, $2, $3, false, $4, $5 from users where username = $1`, uname, created, amount, id, days)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("no such user")
+	}
+	return
+}
+
+// PayInvoice marks an invoice paid and extends its user's subscription. It is idempotent: paying an invoice again changes nothing and returns false.
+func (ps *pgStore) PayInvoice(id string, amount int) (newlyPaid bool, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var uid, invAmount, days int
+	var paid bool
+	err = tx.QueryRow("select id, amount, days, paid from invoices where invoiceid = $1 for update", id).
+		Scan(&uid, &invAmount, &days, &paid)
+	if err == sql.ErrNoRows {
+		err = ErrNoInvoice
+		return
+	}
+	if err != nil || paid {
+		return
+	}
+	if amount < invAmount {
+		err = ErrUnderpaid
+		return
+	}
+	var expires time.Time
+	err = tx.QueryRow("select expires from subscriptions where id = $1 for update", uid).Scan(&expires)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+	now := time.Now()
+	_, err = tx.Exec(`insert into subscriptions (id, expires) values ($1, $2)
+		on conflict (id) do update set expires = excluded.expires`, uid, extendSubscription(expires, days, now))
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("update invoices set paid = true, paidtime = $2 where invoiceid = $1", id, now)
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	newlyPaid = true
+	return
+}
+
+// AddVouchers adds a batch of unredeemed vouchers, each good for some days of subscription.
+func (ps *pgStore) AddVouchers(codes []string, days int, batch string) (err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for _, code := range codes {
+		_, err = tx.Exec("insert into vouchers (code, batch, days, created) values ($1, $2, $3, $4)", code, batch, days, now)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// RedeemVoucher redeems a voucher for a user, recording it as a free invoice and extending the user's subscription until the returned expiry. Each voucher can be redeemed once, and each user can redeem one voucher per batch.
+func (ps *pgStore) RedeemVoucher(uname, code string) (days int, expiry time.Time, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var uid int
+	if err = tx.QueryRow("select id from users where username = $1", uname).Scan(&uid); err != nil {
+		return
+	}
+	var batch string
+	var redeemedBy sql.NullInt64
+	err = tx.QueryRow("select batch, days, redeemedby from vouchers where code = $1 for update", code).Scan(&batch, &days, &redeemedBy)
+	if err == sql.ErrNoRows {
+		err = ErrNoVoucher
+		return
+	}
+	if err != nil {
+		return
+	}
+	if redeemedBy.Valid {
+		err = ErrVoucherRedeemed
+		return
+	}
+	var expires time.Time
+	err = tx.QueryRow("select expires from subscriptions where id = $1 for update", uid).Scan(&expires)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+	now := time.Now()
+	// the unique index on (batch, redeemedby) refuses a second voucher from the batch, even when both are redeemed at once
+	_, err = tx.Exec("update vouchers set redeemedby = $2, redeemed = $3 where code = $1", code, uid, now)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		err = ErrBatchRedeemed
+	}
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`insert into invoices (id, createtime, amount, paid, invoiceid, days, paidtime)
+		values ($1, $2, 0, true, $3, $4, $2)`, uid, now, "voucher-"+code, days)
+	if err != nil {
+		return
+	}
+	expiry = extendSubscription(expires, days, now)
+	_, err = tx.Exec(`insert into subscriptions (id, expires) values ($1, $2)
+		on conflict (id) do update set expires = excluded.expires`, uid, expiry)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// Exits returns every exit, with what clients need to choose between them.
+func (ps *pgStore) Exits() (exits []bridgeauth.ExitEntry, err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("select name, addr, pubkey, region, tiers, load, caps from exits")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ei bridgeauth.ExitEntry
+		var tiers, caps string
+		var load int
+		err = rows.Scan(&ei.Name, &ei.Addr, &ei.Key, &ei.Region, &tiers, &load, &caps)
+		if err != nil {
+			return
+		}
+		ei.Tiers = splitList(tiers)
+		ei.Load = uint64(load)
+		ei.Caps = splitList(caps)
+		exits = append(exits, ei)
+	}
+	err = tx.Commit()
+	return
+}
+
+// AddExit adds an exit, replacing any exit with the same name or key.
+func (ps *pgStore) AddExit(ei bridgeauth.ExitEntry) (err error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("delete from exits where name = $1 or pubkey = $2", ei.Name, ei.Key)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("insert into exits (name, addr, pubkey, region, tiers, load, caps) values ($1, $2, $3, $4, $5, $6, $7)",
+		ei.Name, ei.Addr, ei.Key, ei.Region, strings.Join(ei.Tiers, ","), int(ei.Load), strings.Join(ei.Caps, ","))
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// splitList splits a comma-separated column, which is empty for an empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// PruneTickets forgets the ticket identities of epochs before the given one.
+func (ps *pgStore) PruneTickets(before uint64) (err error) {
+	_, err = ps.db.Exec("delete from ticketkeys where epoch < $1", int64(before))
+	return
+}
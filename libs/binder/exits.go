@@ -0,0 +1,143 @@
+package binder
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/patrickmn/go-cache"
+)
+
+// cache of the signed exit list and directory. "list" => bridgeauth.ExitList, "directory" => bridgeauth.ExitDirectory
+var exitListCache = cache.New(time.Minute, time.Hour)
+
+// exits register every couple of minutes, so one that hasn't for this long is gone
+const exitMaxAge = time.Minute * 10
+
+// when each exit last registered, by name. string => time.Time
+var exitLastSeen = cache.New(exitMaxAge, time.Hour)
+
+// exits we haven't heard from since the binder started get until exitMaxAge after that to register
+var binderStart = time.Now()
+
+// liveExits leaves out exits that have stopped registering.
+func liveExits(exits []bridgeauth.ExitEntry) []bridgeauth.ExitEntry {
+	if time.Since(binderStart) < exitMaxAge {
+		return exits
+	}
+	var live []bridgeauth.ExitEntry
+	for _, e := range exits {
+		if _, ok := exitLastSeen.Get(e.Name); ok {
+			live = append(live, e)
+		}
+	}
+	return live
+}
+
+// exitSecret is what exits must present to register a key or name that isn't theirs yet. If empty, only exits already known by both their key and name can register.
+var exitSecret string
+
+func handleAddExit(w http.ResponseWriter, r *http.Request) {
+	var desc bridgeauth.ExitDescriptor
+	err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&desc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := desc.Verify(maxDescriptorAge); err != nil {
+		log.Println("bad exit descriptor from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	entry := desc.Exit
+	if entry.Name == "" || entry.Addr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if entry.Load > 100 {
+		entry.Load = 100
+	}
+	exits, err := store.Exits()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// known exits are vouched for by their signature, but taking over another exit's name needs the secret
+	known := false
+	for _, e := range exits {
+		if e.Name == entry.Name {
+			known = bytes.Equal(e.Key, entry.Key)
+			break
+		}
+	}
+	if !known {
+		_, pwd, _ := r.BasicAuth()
+		if exitSecret == "" || subtle.ConstantTimeCompare([]byte(pwd), []byte(exitSecret)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		log.Printf("enrolled exit %v with key %x", entry.Name, entry.Key)
+	}
+	if err := store.AddExit(entry); err != nil {
+		log.Println("cannot add exit:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	exitLastSeen.SetDefault(entry.Name, time.Now())
+	exitListCache.Flush()
+}
+
+func handleGetExits(w http.ResponseWriter, r *http.Request) {
+	var el bridgeauth.ExitList
+	if v, ok := exitListCache.Get("list"); ok {
+		el = v.(bridgeauth.ExitList)
+	} else {
+		exits, err := store.Exits()
+		if err != nil {
+			log.Println("cannot get exits:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sk, err := store.MasterIdentity()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, e := range liveExits(exits) {
+			el.Exits = append(el.Exits, e.Info())
+		}
+		el.Sign(sk)
+		exitListCache.SetDefault("list", el)
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(el)
+}
+
+func handleGetExitDirectory(w http.ResponseWriter, r *http.Request) {
+	var ed bridgeauth.ExitDirectory
+	if v, ok := exitListCache.Get("directory"); ok {
+		ed = v.(bridgeauth.ExitDirectory)
+	} else {
+		exits, err := store.Exits()
+		if err != nil {
+			log.Println("cannot get exits:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sk, err := store.MasterIdentity()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ed = bridgeauth.ExitDirectory{Exits: liveExits(exits)}
+		ed.Sign(sk)
+		exitListCache.SetDefault("directory", ed)
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(ed)
+}
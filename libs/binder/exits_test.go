@@ -0,0 +1,123 @@
+package binder
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+func TestAddExit(t *testing.T) {
+	defer func() { exitSecret = "" }()
+	exitSecret = "secret"
+	ms := NewMemStore()
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	msk, _ := ms.MasterIdentity()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+	bc.PinMasterKey(msk.Public().(ed25519.PublicKey))
+
+	_, esk, _ := ed25519.GenerateKey(nil)
+	desc := bridgeauth.ExitDescriptor{Exit: bridgeauth.ExitEntry{
+		Name:   "us-sfo-01.exits.geph.io",
+		Addr:   "1.2.3.4:2389",
+		Region: "us-sfo",
+		Tiers:  []string{"free", "paid"},
+		Caps:   []string{"tier", "resume"},
+	}}
+	desc.Sign(esk)
+	// new exits need the secret
+	if err := bc.AddExit("wrong", desc); err == nil {
+		t.Fatal("new exit registered without the secret")
+	}
+	if err := bc.AddExit("secret", desc); err != nil {
+		t.Fatal(err)
+	}
+	// known ones don't
+	desc.Exit.Load = 40
+	desc.Sign(esk)
+	if err := bc.AddExit("", desc); err != nil {
+		t.Fatal("known exit refused:", err)
+	}
+	dir, err := bc.GetExitDirectory(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Exits) != 1 || dir.Exits[0].Load != 40 || len(dir.Exits[0].Caps) != 2 || !dir.Exits[0].Accepts("free") {
+		t.Fatalf("wrong directory %+v", dir.Exits)
+	}
+	if el, err := bc.GetExits(time.Minute); err != nil || len(el.Exits) != 1 || el.Exits[0].Addr != "1.2.3.4:2389" {
+		t.Fatal("wrong exit list:", el, err)
+	}
+	// another key can't take over the name without the secret
+	_, othersk, _ := ed25519.GenerateKey(nil)
+	desc.Exit.Addr = "6.6.6.6:2389"
+	desc.Sign(othersk)
+	if err := bc.AddExit("", desc); err == nil {
+		t.Fatal("another key took over the exit")
+	}
+	// and a directory signed by someone else is refused
+	other, _, _ := ed25519.GenerateKey(nil)
+	bc.PinMasterKey(other)
+	if _, err := bc.GetExitDirectory(time.Minute); err == nil {
+		t.Fatal("accepted a directory signed by the wrong key")
+	}
+	// clients pin the key built into them without being told to
+	defer func() { bdclient.DefaultMPK = "" }()
+	bdclient.DefaultMPK = hex.EncodeToString(msk.Public().(ed25519.PublicKey))
+	if _, err := bdclient.NewClient(srv.URL, "binder.test").GetExitDirectory(time.Minute); err != nil {
+		t.Fatal("default key not pinned:", err)
+	}
+	bdclient.DefaultMPK = hex.EncodeToString(other)
+	if _, err := bdclient.NewClient(srv.URL, "binder.test").GetExitDirectory(time.Minute); err == nil {
+		t.Fatal("accepted a directory signed by the wrong key")
+	}
+}
+
+func TestExitExpiry(t *testing.T) {
+	defer func(start time.Time) { binderStart = start }(binderStart)
+	defer exitLastSeen.Flush()
+	ms := NewMemStore()
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	msk, _ := ms.MasterIdentity()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+	bc.PinMasterKey(msk.Public().(ed25519.PublicKey))
+
+	// one exit keeps registering, the other never does
+	_, esk, _ := ed25519.GenerateKey(nil)
+	desc := bridgeauth.ExitDescriptor{Exit: bridgeauth.ExitEntry{Name: "alive", Addr: "1.2.3.4:2389", Tiers: []string{"free"}}}
+	desc.Sign(esk)
+	ms.AddExit(desc.Exit)
+	ms.AddExit(bridgeauth.ExitEntry{Name: "gone", Addr: "5.6.7.8:2389", Key: make([]byte, 32), Tiers: []string{"free"}})
+	if err := bc.AddExit("", desc); err != nil {
+		t.Fatal(err)
+	}
+	names := func() (names []string) {
+		exitListCache.Flush()
+		dir, err := bc.GetExitDirectory(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, err := bc.GetExits(time.Minute)
+		if err != nil || len(el.Exits) != len(dir.Exits) {
+			t.Fatal("exit list doesn't match the directory:", err)
+		}
+		for _, e := range dir.Exits {
+			names = append(names, e.Name)
+		}
+		return
+	}
+	// right after starting, we haven't had the chance to hear from every exit
+	if n := names(); len(n) != 2 {
+		t.Fatal("dropped exits too soon:", n)
+	}
+	binderStart = time.Now().Add(-exitMaxAge)
+	if n := names(); len(n) != 1 || n[0] != "alive" {
+		t.Fatal("kept a gone exit:", n)
+	}
+}
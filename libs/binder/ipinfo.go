@@ -0,0 +1,208 @@
+package binder
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Location is what we know about where an IP address is. Unknown fields are left empty.
+type Location struct {
+	Country string
+	City    string
+	ASN     uint
+	ASOrg   string
+}
+
+// Locator finds out where IP addresses are.
+type Locator interface {
+	Locate(ip net.IP) (Location, error)
+}
+
+// LocatorFunc turns a function into a Locator.
+type LocatorFunc func(ip net.IP) (Location, error)
+
+// Locate calls f.
+func (f LocatorFunc) Locate(ip net.IP) (Location, error) {
+	return f(ip)
+}
+
+// GeoIP is the Locator the binder uses. Main points it at the MaxMind databases; until then, nothing is known about any address.
+var GeoIP Locator = LocatorFunc(func(net.IP) (Location, error) {
+	return Location{}, nil
+})
+
+// geoip2Locator looks addresses up in MaxMind's GeoIP2 or GeoLite2 databases.
+type geoip2Locator struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+// OpenGeoIP2 opens a MaxMind city database and, if asnPath isn't empty, an ASN database.
+func OpenGeoIP2(cityPath, asnPath string) (Locator, error) {
+	var gl geoip2Locator
+	var err error
+	gl.city, err = geoip2.Open(cityPath)
+	if err != nil {
+		return nil, err
+	}
+	if asnPath != "" {
+		gl.asn, err = geoip2.Open(asnPath)
+		if err != nil {
+			gl.city.Close()
+			return nil, err
+		}
+	}
+	return gl, nil
+}
+
+func (gl geoip2Locator) Locate(ip net.IP) (loc Location, err error) {
+	city, err := gl.city.City(ip)
+	if err != nil {
+		return
+	}
+	loc.Country = city.Country.IsoCode
+	loc.City = city.City.Names["en"]
+	if gl.asn != nil {
+		var asn *geoip2.ASN
+		asn, err = gl.asn.ASN(ip)
+		if err != nil {
+			return
+		}
+		loc.ASN = asn.AutonomousSystemNumber
+		loc.ASOrg = asn.AutonomousSystemOrganization
+	}
+	return
+}
+
+// trustedProxies are the networks whose forwarded headers we believe. Anything else could be the client lying about its address.
+var trustedProxies []*net.IPNet
+
+// parseProxies parses a comma-separated list of addresses and CIDR ranges.
+func parseProxies(list string) (nets []*net.IPNet, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("bad proxy address: " + s)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the addresses in a request's forwarding headers, client first. The standard Forwarded header wins over X-Forwarded-For. Hops that aren't IP addresses, such as "unknown" or obfuscated identifiers, are nil.
+func forwardedHops(r *http.Request) (hops []net.IP) {
+	if fwd := r.Header["Forwarded"]; len(fwd) > 0 {
+		for _, elem := range strings.Split(strings.Join(fwd, ","), ",") {
+			var hop net.IP
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = parseHop(strings.Trim(kv[1], `"`))
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return
+	}
+	for _, s := range strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			hops = append(hops, parseHop(s))
+		}
+	}
+	return
+}
+
+// parseHop parses an address that may have a port, and IPv6 brackets.
+func parseHop(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// clientIP works out the address of whoever made a request. Forwarding headers are only believed as far back as the chain of trusted proxies goes: the last hop before it is the client.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		// a hop we can't parse could be anything, so stop believing the headers there
+		if hops[i] == nil {
+			break
+		}
+		ip = hops[i]
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func handleClientInfo(w http.ResponseWriter, r *http.Request) {
+	var cinfo struct {
+		Address string
+		Country string
+		City    string
+		ASN     uint
+		ASOrg   string
+	}
+	ip := clientIP(r)
+	if ip != nil {
+		cinfo.Address = ip.String()
+		loc, err := GeoIP.Locate(ip)
+		if err != nil {
+			log.Println("cannot locate", ip, err)
+		}
+		cinfo.Country = loc.Country
+		cinfo.City = loc.City
+		cinfo.ASN = loc.ASN
+		cinfo.ASOrg = loc.ASOrg
+	}
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(cinfo)
+}
+
+// censoredCountries are the country codes where clients should stay away from exits and use bridges.
+var censoredCountries = []string{"CN"}
+
+func handleCensoredCountries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(censoredCountries)
+}
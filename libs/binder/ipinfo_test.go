@@ -0,0 +1,71 @@
+package binder
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedProxies, err = parseProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+	for _, tc := range []struct {
+		remote  string
+		headers map[string]string
+		client  string
+	}{
+		// headers from untrusted peers are ignored
+		{"1.2.3.4:5678", map[string]string{"X-Forwarded-For": "8.8.8.8"}, "1.2.3.4"},
+		{"127.0.0.1:5678", nil, "127.0.0.1"},
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "8.8.8.8"}, "8.8.8.8"},
+		// a client can't pretend to be behind more proxies
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "9.9.9.9, 8.8.8.8, 10.1.2.3"}, "8.8.8.8"},
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "garbage, 10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:5678", map[string]string{
+			"Forwarded":       `for=9.9.9.9, for="[2001:db8::1]:4711";proto=https, for=10.1.2.3`,
+			"X-Forwarded-For": "7.7.7.7",
+		}, "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/client-info", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if ip := clientIP(r); !ip.Equal(net.ParseIP(tc.client)) {
+			t.Errorf("%v %v: got %v, expected %v", tc.remote, tc.headers, ip, tc.client)
+		}
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	defer func(old Locator) { GeoIP = old }(GeoIP)
+	GeoIP = LocatorFunc(func(ip net.IP) (Location, error) {
+		if ip.Equal(net.ParseIP("192.0.2.1")) {
+			return Location{Country: "CN", City: "Shanghai", ASN: 4812, ASOrg: "China Telecom"}, nil
+		}
+		return Location{}, nil
+	})
+	r := httptest.NewRequest("GET", "/client-info", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handleClientInfo(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	}
+	var cinfo bdclient.ClientInfo
+	if err := json.NewDecoder(w.Body).Decode(&cinfo); err != nil {
+		t.Fatal(err)
+	}
+	if cinfo.Address != "192.0.2.1" || cinfo.Country != "CN" || cinfo.City != "Shanghai" || cinfo.ASN != 4812 {
+		t.Fatal("wrong client info:", cinfo)
+	}
+}
@@ -0,0 +1,376 @@
+package binder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/nullchinchilla/natrium"
+	"golang.org/x/crypto/ed25519"
+)
+
+// MemStore is a Store that lives in memory. If it was opened with OpenFileStore, every change is also written to a file, which is enough for small deployments that don't want a database server.
+type MemStore struct {
+	data memData
+	path string
+	lock sync.Mutex
+}
+
+// memData is everything a MemStore knows, in a form that can be saved as JSON.
+type memData struct {
+	Users      map[string]*memUser
+	NextUID    int
+	BridgeKeys map[string]bool
+	// hex-encoded identity key => allocation group
+	BridgeIDs map[string]string
+	// account class => epoch => PKCS#1 private key
+	TicketIDs map[string]map[uint64][]byte
+	MasterID  ed25519.PrivateKey
+	Exits     []bridgeauth.ExitEntry
+	// invoices created through the binder, by ID
+	Invoices map[string]*memInvoice
+	// vouchers by code
+	Vouchers map[string]*memVoucher
+}
+
+type memVoucher struct {
+	Batch      string
+	Days       int
+	Created    time.Time
+	RedeemedBy string
+	Redeemed   time.Time
+}
+
+type memInvoice struct {
+	User    string
+	Created time.Time
+	Amount  int
+	Days    int
+	Paid    bool
+}
+
+type memUser struct {
+	ID        int
+	PwdHash   string
+	Created   time.Time
+	SubExpiry time.Time
+	// paid invoices, by creation time
+	Invoices map[time.Time]int
+}
+
+// NewMemStore creates an empty MemStore with a fresh master identity.
+func NewMemStore() *MemStore {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	return &MemStore{
+		data: memData{
+			Users:      make(map[string]*memUser),
+			NextUID:    1,
+			BridgeKeys: make(map[string]bool),
+			BridgeIDs:  make(map[string]string),
+			TicketIDs:  make(map[string]map[uint64][]byte),
+			MasterID:   sk,
+			Invoices:   make(map[string]*memInvoice),
+			Vouchers:   make(map[string]*memVoucher),
+		},
+	}
+}
+
+// OpenFileStore opens a MemStore saved in a file, creating the file if it doesn't exist.
+func OpenFileStore(path string) (*MemStore, error) {
+	ms := NewMemStore()
+	ms.path = path
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ms, ms.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bts, &ms.data); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// save writes out the store if it is backed by a file. The caller must hold the lock.
+func (ms *MemStore) save() error {
+	if ms.path == "" {
+		return nil
+	}
+	bts, err := json.Marshal(ms.data)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash never leaves a half-written store
+	tmp, err := ioutil.TempFile(filepath.Dir(ms.path), ".binder-store")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bts); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ms.path)
+}
+
+// AddBridgeKey allows bridges to enroll with the given key.
+func (ms *MemStore) AddBridgeKey(key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.data.BridgeKeys[key] = true
+	return ms.save()
+}
+
+// AddExit adds an exit that bridges may forward to and clients may use, replacing any exit with the same name or key.
+func (ms *MemStore) AddExit(ei bridgeauth.ExitEntry) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	exits := ms.data.Exits[:0]
+	for _, e := range ms.data.Exits {
+		if e.Name != ei.Name && !bytes.Equal(e.Key, ei.Key) {
+			exits = append(exits, e)
+		}
+	}
+	ms.data.Exits = append(exits, ei)
+	return ms.save()
+}
+
+// SetSubscription gives a user a paid subscription until the given time.
+func (ms *MemStore) SetSubscription(uname string, expiry time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	u, ok := ms.data.Users[uname]
+	if !ok {
+		return errors.New("no such user")
+	}
+	u.SubExpiry = expiry
+	return ms.save()
+}
+
+// AddInvoice records a paid invoice for a user.
+func (ms *MemStore) AddInvoice(uname string, created time.Time, amount int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	u, ok := ms.data.Users[uname]
+	if !ok {
+		return errors.New("no such user")
+	}
+	if u.Invoices == nil {
+		u.Invoices = make(map[time.Time]int)
+	}
+	u.Invoices[created] = amount
+	return ms.save()
+}
+
+// CreateInvoice creates an unpaid invoice for a user, for an amount in USD cents buying some days of subscription.
+func (ms *MemStore) CreateInvoice(uname string, amount, days int) (string, time.Time, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.data.Users[uname]; !ok {
+		return "", time.Time{}, errors.New("no such user")
+	}
+	if ms.data.Invoices == nil {
+		ms.data.Invoices = make(map[string]*memInvoice)
+	}
+	id := newInvoiceID()
+	created := time.Now()
+	ms.data.Invoices[id] = &memInvoice{User: uname, Created: created, Amount: amount, Days: days}
+	return id, created, ms.save()
+}
+
+// PayInvoice marks an invoice paid and extends its user's subscription. It is idempotent: paying an invoice again changes nothing and returns false.
+func (ms *MemStore) PayInvoice(id string, amount int) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	inv, ok := ms.data.Invoices[id]
+	if !ok {
+		return false, ErrNoInvoice
+	}
+	if inv.Paid {
+		return false, nil
+	}
+	if amount < inv.Amount {
+		return false, ErrUnderpaid
+	}
+	u := ms.data.Users[inv.User]
+	u.SubExpiry = extendSubscription(u.SubExpiry, inv.Days, time.Now())
+	if u.Invoices == nil {
+		u.Invoices = make(map[time.Time]int)
+	}
+	u.Invoices[inv.Created] = inv.Amount
+	inv.Paid = true
+	return true, ms.save()
+}
+
+// AddVouchers adds a batch of unredeemed vouchers, each good for some days of subscription.
+func (ms *MemStore) AddVouchers(codes []string, days int, batch string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.data.Vouchers == nil {
+		ms.data.Vouchers = make(map[string]*memVoucher)
+	}
+	for _, code := range codes {
+		if _, ok := ms.data.Vouchers[code]; ok {
+			return errors.New("duplicate voucher")
+		}
+	}
+	now := time.Now()
+	for _, code := range codes {
+		ms.data.Vouchers[code] = &memVoucher{Batch: batch, Days: days, Created: now}
+	}
+	return ms.save()
+}
+
+// RedeemVoucher redeems a voucher for a user, recording it as a free invoice and extending the user's subscription until the returned expiry. Each voucher can be redeemed once, and each user can redeem one voucher per batch.
+func (ms *MemStore) RedeemVoucher(uname, code string) (int, time.Time, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	u, ok := ms.data.Users[uname]
+	if !ok {
+		return 0, time.Time{}, errors.New("no such user")
+	}
+	v, ok := ms.data.Vouchers[code]
+	if !ok {
+		return 0, time.Time{}, ErrNoVoucher
+	}
+	if v.RedeemedBy != "" {
+		return 0, time.Time{}, ErrVoucherRedeemed
+	}
+	for _, other := range ms.data.Vouchers {
+		if other.Batch == v.Batch && other.RedeemedBy == uname {
+			return 0, time.Time{}, ErrBatchRedeemed
+		}
+	}
+	now := time.Now()
+	v.RedeemedBy = uname
+	v.Redeemed = now
+	u.SubExpiry = extendSubscription(u.SubExpiry, v.Days, now)
+	if u.Invoices == nil {
+		u.Invoices = make(map[time.Time]int)
+	}
+	u.Invoices[now] = 0
+	return v.Days, u.SubExpiry, ms.save()
+}
+
+// CheckBridgeKey checks whether a bridge cookie is allowed.
+func (ms *MemStore) CheckBridgeKey(key string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.data.BridgeKeys[key], nil
+}
+
+// CheckBridgeIdentity checks whether a bridge identity key has been enrolled.
+func (ms *MemStore) CheckBridgeIdentity(key []byte) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, ok := ms.data.BridgeIDs[hex.EncodeToString(key)]
+	return ok, nil
+}
+
+// AddBridgeIdentity enrolls a bridge identity key.
+func (ms *MemStore) AddBridgeIdentity(key []byte, allocGroup string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.data.BridgeIDs[hex.EncodeToString(key)]; ok {
+		return nil
+	}
+	ms.data.BridgeIDs[hex.EncodeToString(key)] = allocGroup
+	return ms.save()
+}
+
+// TicketIdentity returns the RSA ticket identity for a particular account class and epoch.
+func (ms *MemStore) TicketIdentity(tier string, epoch uint64) (*rsa.PrivateKey, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if skBts, ok := ms.data.TicketIDs[tier][epoch]; ok {
+		return x509.ParsePKCS1PrivateKey(skBts)
+	}
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	if ms.data.TicketIDs[tier] == nil {
+		ms.data.TicketIDs[tier] = make(map[uint64][]byte)
+	}
+	ms.data.TicketIDs[tier][epoch] = x509.MarshalPKCS1PrivateKey(sk)
+	return sk, ms.save()
+}
+
+// MasterIdentity returns the ed25519 master identity.
+func (ms *MemStore) MasterIdentity() (ed25519.PrivateKey, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.data.MasterID, nil
+}
+
+// VerifyUser verifies a username/password. uid < 0 means authentication failed.
+func (ms *MemStore) VerifyUser(uname, pwd string) (uid int, subExpiry time.Time, paytx map[time.Time]int, err error) {
+	ms.lock.Lock()
+	u, ok := ms.data.Users[uname]
+	var pwdHash string
+	if ok {
+		pwdHash = u.PwdHash
+		uid = u.ID
+		subExpiry = u.SubExpiry
+		// like the database, only subscribers have their payments listed
+		if !subExpiry.IsZero() {
+			paytx = make(map[time.Time]int)
+			for k, v := range u.Invoices {
+				paytx[k] = v
+			}
+		}
+	}
+	ms.lock.Unlock()
+	if !ok || !natrium.PasswordVerify([]byte(pwd), pwdHash) {
+		return -1, time.Time{}, nil, nil
+	}
+	return
+}
+
+// CreateUser creates a username/password pair, returning ErrUserExists if the username is taken.
+func (ms *MemStore) CreateUser(uname, pwd string) error {
+	hpwd := natrium.PasswordHash([]byte(pwd), 5, 32*1024*1024)
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.data.Users[uname]; ok {
+		return ErrUserExists
+	}
+	ms.data.Users[uname] = &memUser{ID: ms.data.NextUID, PwdHash: hpwd, Created: time.Now()}
+	ms.data.NextUID++
+	return ms.save()
+}
+
+// Exits returns every exit, with what clients need to choose between them.
+func (ms *MemStore) Exits() ([]bridgeauth.ExitEntry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]bridgeauth.ExitEntry(nil), ms.data.Exits...), nil
+}
+
+// PruneTickets forgets the ticket identities of epochs before the given one.
+func (ms *MemStore) PruneTickets(before uint64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, keys := range ms.data.TicketIDs {
+		for epoch := range keys {
+			if epoch < before {
+				delete(keys, epoch)
+			}
+		}
+	}
+	return ms.save()
+}
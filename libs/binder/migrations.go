@@ -0,0 +1,119 @@
+package binder
+
+import (
+	"log"
+	"time"
+)
+
+// pgMigrations are applied in order, each exactly once. Never edit one that has shipped; append a new one instead.
+var pgMigrations = []string{
+	// the schema as it was before migrations existed, so this is a no-op on old databases. Old databases may still lack bridgeids, which bridge registration used before anything created it.
+	`create table if not exists users (
+		id serial primary key,
+		username text unique not null,
+		pwdhash text not null,
+		freebalance integer not null default 0,
+		createtime timestamp not null
+	);
+	create table if not exists subscriptions (
+		id integer primary key references users(id),
+		expires timestamp not null
+	);
+	create table if not exists invoices (
+		id integer not null references users(id),
+		createtime timestamp not null,
+		amount integer not null,
+		paid boolean not null default false
+	);
+	create table if not exists secrets (
+		key text primary key,
+		value bytea not null
+	);
+	create table if not exists bridgekeys (
+		key text primary key
+	);
+	create table if not exists bridgeids (
+		key bytea primary key,
+		allocgroup text not null,
+		enrolled timestamp not null
+	);
+	create table if not exists exits (
+		name text primary key,
+		addr text not null,
+		pubkey bytea not null
+	);`,
+	// ticket keys per epoch, replacing the ticket-id-* secrets
+	`create table ticketkeys (
+		tier text not null,
+		epoch bigint not null,
+		key bytea not null,
+		primary key (tier, epoch)
+	);
+	delete from secrets where key like 'ticket-id-%';`,
+	// what clients need to choose an exit
+	`alter table exits add column region text not null default '';
+	alter table exits add column tiers text not null default 'free,paid';
+	alter table exits add column load integer not null default 0;`,
+	// exits register themselves
+	`alter table exits add column caps text not null default '';`,
+	// invoices created by the binder and paid through the payment processor
+	`alter table invoices add column invoiceid text unique;
+	alter table invoices add column days integer not null default 0;
+	alter table invoices add column paidtime timestamp;`,
+	// vouchers for people who can't pay online
+	`create table vouchers (
+		code text primary key,
+		batch text not null,
+		days integer not null,
+		created timestamp not null,
+		redeemedby integer references users(id),
+		redeemed timestamp
+	);
+	create index vouchers_batch on vouchers (batch, redeemedby);`,
+	// one voucher per user per batch, even when redeemed concurrently
+	`drop index vouchers_batch;
+	create unique index vouchers_batch on vouchers (batch, redeemedby) where redeemedby is not null;`,
+}
+
+// migrate brings the database schema up to date.
+func (ps *pgStore) migrate() (err error) {
+	_, err = ps.db.Exec(`create table if not exists migrations (
+		version integer primary key,
+		applied timestamp not null
+	)`)
+	if err != nil {
+		return
+	}
+	for i, migration := range pgMigrations {
+		version := i + 1
+		err = func() (err error) {
+			tx, err := ps.db.Begin()
+			if err != nil {
+				return
+			}
+			defer tx.Rollback()
+			// serialize concurrent binders starting up
+			if _, err = tx.Exec("lock table migrations in exclusive mode"); err != nil {
+				return
+			}
+			var count int
+			err = tx.QueryRow("select count(*) from migrations where version = $1", version).Scan(&count)
+			if err != nil || count > 0 {
+				return
+			}
+			log.Println("applying database migration", version)
+			if _, err = tx.Exec(migration); err != nil {
+				return
+			}
+			if _, err = tx.Exec("insert into migrations values ($1, $2)", version, time.Now()); err != nil {
+				return
+			}
+			err = tx.Commit()
+			return
+		}()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
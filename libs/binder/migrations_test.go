@@ -0,0 +1,40 @@
+package binder
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMigrationsCreateTables checks that every table the Postgres store uses is created by some migration, so that a fresh database works.
+func TestMigrationsCreateTables(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "db.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := regexp.MustCompile(`(?:from|into|join) ([a-z_]+)|update ([a-z_]+) set`)
+	tables := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			query, _ := strconv.Unquote(lit.Value)
+			for _, m := range used.FindAllStringSubmatch(query, -1) {
+				tables[m[1]+m[2]] = true
+			}
+		}
+		return true
+	})
+	if len(tables) == 0 {
+		t.Fatal("found no queries")
+	}
+	schema := strings.Join(pgMigrations, "\n")
+	for table := range tables {
+		if !regexp.MustCompile(`create table (if not exists )?` + table + ` `).MatchString(schema) {
+			t.Errorf("no migration creates table %v", table)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package binder
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// plan is something users can pay for.
+type plan struct {
+	// Amount is the price in USD cents.
+	Amount int
+	// Days is how long the subscription is extended by.
+	Days int
+}
+
+// plans are what users can buy, by name.
+var plans = map[string]plan{
+	"month": {Amount: 500, Days: 30},
+	"year":  {Amount: 5000, Days: 365},
+}
+
+// webhookSecret is shared with the payment processor, which signs its webhooks with it. If empty, webhooks are refused.
+var webhookSecret string
+
+// checkoutURL is where users pay invoices, if the payment processor has such a page.
+var checkoutURL string
+
+// webhooks signed further than this from now are refused, so that they can't be replayed later
+const webhookTolerance = time.Minute * 5
+
+// the header carrying a webhook's signature, as "t=<unix time>,v1=<hex HMAC-SHA256>"
+const webhookSigHeader = "X-Payment-Signature"
+
+func newInvoiceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// extendSubscription returns when a subscription expiring at expires ends after adding some days. Lapsed subscriptions start again from now.
+func extendSubscription(expires time.Time, days int, now time.Time) time.Time {
+	if expires.Before(now) {
+		expires = now
+	}
+	return expires.Add(time.Hour * 24 * time.Duration(days))
+}
+
+// webhookSignature is the HMAC of a webhook body sent at the given Unix time.
+func webhookSignature(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkWebhook checks a webhook's signature header.
+func checkWebhook(header string, body []byte, now time.Time) error {
+	var ts int64
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > webhookTolerance || skew < -webhookTolerance {
+		return errors.New("webhook timestamp out of range")
+	}
+	good := webhookSignature(webhookSecret, ts, body)
+	// processors rotating their secret send several signatures
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(good)) {
+			return nil
+		}
+	}
+	return errors.New("bad webhook signature")
+}
+
+// paymentEvent is what the payment processor tells us about.
+type paymentEvent struct {
+	// Type is "invoice.paid" for payments. Other events are ignored.
+	Type    string
+	Invoice string
+	// Amount is how much was paid, in USD cents.
+	Amount int
+}
+
+func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
+	uname := r.FormValue("user")
+	uid, _, _, err := store.VerifyUser(uname, r.FormValue("pwd"))
+	if err != nil {
+		log.Println("cannot verify user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if uid < 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("plan")
+	p, ok := plans[name]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, created, err := store.CreateInvoice(uname, p.Amount, p.Days)
+	if err != nil {
+		log.Println("cannot create invoice:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	inv := bdclient.Invoice{ID: id, Plan: name, Amount: p.Amount, Days: p.Days, Created: created}
+	if checkoutURL != "" {
+		v := url.Values{}
+		v.Set("invoice", id)
+		v.Set("amount", strconv.Itoa(p.Amount))
+		inv.PayURL = checkoutURL + "?" + v.Encode()
+	}
+	log.Println("created invoice", id, "for", uname, "on plan", name)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// handlePaymentWebhook hears from the payment processor. Processors retry until they get a 200, so anything that retrying can't fix gets a 4xx.
+func handlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if webhookSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := checkWebhook(r.Header.Get(webhookSigHeader), body, time.Now()); err != nil {
+		log.Println("refusing webhook from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var ev paymentEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if ev.Type != "invoice.paid" {
+		return
+	}
+	newlyPaid, err := store.PayInvoice(ev.Invoice, ev.Amount)
+	switch err {
+	case nil:
+	case ErrNoInvoice, ErrUnderpaid:
+		log.Println("cannot pay invoice", ev.Invoice, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		log.Println("cannot pay invoice", ev.Invoice, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if newlyPaid {
+		log.Println("invoice", ev.Invoice, "paid")
+	} else {
+		log.Println("invoice", ev.Invoice, "was already paid")
+	}
+}
@@ -0,0 +1,97 @@
+package binder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// fakeProcessor stands in for the payment processor, calling the binder's webhook.
+type fakeProcessor struct {
+	url    string
+	secret string
+}
+
+func (fp fakeProcessor) send(ev paymentEvent, signed time.Time) int {
+	body, _ := json.Marshal(ev)
+	req, _ := http.NewRequest("POST", fp.url+"/payment-webhook", bytes.NewReader(body))
+	ts := signed.Unix()
+	req.Header.Set(webhookSigHeader, fmt.Sprintf("t=%v,v1=%v", ts, webhookSignature(fp.secret, ts, body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPayments(t *testing.T) {
+	defer func() { webhookSecret = "" }()
+	webhookSecret = "whsec"
+	ms := NewMemStore()
+	ms.CreateUser("alice", "hunter2")
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+	proc := fakeProcessor{url: srv.URL, secret: webhookSecret}
+
+	if _, err := bc.CreateInvoice("alice", "wrong", "month"); err == nil {
+		t.Fatal("created an invoice with a wrong password")
+	}
+	if _, err := bc.CreateInvoice("alice", "hunter2", "decade"); err == nil {
+		t.Fatal("created an invoice for a made-up plan")
+	}
+	inv, err := bc.CreateInvoice("alice", "hunter2", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Amount != plans["month"].Amount || inv.ID == "" {
+		t.Fatalf("wrong invoice %+v", inv)
+	}
+	// forged, replayed and short payments change nothing
+	forged := fakeProcessor{url: srv.URL, secret: "guess"}
+	if code := forged.send(paymentEvent{Type: "invoice.paid", Invoice: inv.ID, Amount: inv.Amount}, time.Now()); code != http.StatusUnauthorized {
+		t.Fatal("forged webhook got", code)
+	}
+	if code := proc.send(paymentEvent{Type: "invoice.paid", Invoice: inv.ID, Amount: inv.Amount}, time.Now().Add(-time.Hour)); code != http.StatusUnauthorized {
+		t.Fatal("old webhook got", code)
+	}
+	if code := proc.send(paymentEvent{Type: "invoice.paid", Invoice: inv.ID, Amount: 1}, time.Now()); code != http.StatusBadRequest {
+		t.Fatal("underpayment got", code)
+	}
+	if _, _, details, err := bc.GetTicket("alice", "hunter2"); err != nil || details.Tier != "free" {
+		t.Fatal("paid without paying:", details.Tier, err)
+	}
+	// paying for real extends the subscription, once
+	for i := 0; i < 2; i++ {
+		if code := proc.send(paymentEvent{Type: "invoice.paid", Invoice: inv.ID, Amount: inv.Amount}, time.Now()); code != http.StatusOK {
+			t.Fatal("payment got", code)
+		}
+	}
+	_, _, details, err := bc.GetTicket("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Tier != "paid" || len(details.Transactions) != 1 || details.Transactions[0].Amount != inv.Amount {
+		t.Fatalf("payment not shown: %+v", details)
+	}
+	if left := time.Until(details.PaidExpiry); left < time.Hour*24*29 || left > time.Hour*24*30 {
+		t.Fatal("subscription extended wrongly, to", details.PaidExpiry)
+	}
+	// a second invoice adds to the time left
+	inv2, _ := bc.CreateInvoice("alice", "hunter2", "month")
+	proc.send(paymentEvent{Type: "invoice.paid", Invoice: inv2.ID, Amount: inv2.Amount}, time.Now())
+	_, _, details2, _ := bc.GetTicket("alice", "hunter2")
+	if d := details2.PaidExpiry.Sub(details.PaidExpiry); d != time.Hour*24*30 || len(details2.Transactions) != 2 {
+		t.Fatal("second payment extended by", d)
+	}
+	if code := proc.send(paymentEvent{Type: "invoice.paid", Invoice: "nonexistent", Amount: 500}, time.Now()); code != http.StatusBadRequest {
+		t.Fatal("paying a missing invoice got", code)
+	}
+}
@@ -0,0 +1,244 @@
+package binder
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dchest/captcha"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/pow"
+	"github.com/patrickmn/go-cache"
+)
+
+// Username and password rules.
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 32
+	minPasswordLen = 8
+	maxPasswordLen = 256
+)
+
+// reservedUsernames can't be registered, so that nobody can pass for us.
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "geph": true, "root": true, "support": true,
+}
+
+// validateUsername explains what is wrong with a username, if anything.
+func validateUsername(uname string) error {
+	if len(uname) < minUsernameLen || len(uname) > maxUsernameLen {
+		return errors.New("username must be 3 to 32 characters long")
+	}
+	for i, c := range uname {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '_' || c == '-' || c == '.':
+			if i == 0 {
+				return errors.New("username must start with a letter or digit")
+			}
+		default:
+			return errors.New("username may only contain lowercase letters, digits, '_', '-' and '.'")
+		}
+	}
+	if reservedUsernames[uname] {
+		return errors.New("username is reserved")
+	}
+	return nil
+}
+
+// validatePassword explains what is wrong with a password, if anything.
+func validatePassword(pwd string) error {
+	if len(pwd) < minPasswordLen {
+		return errors.New("password must be at least 8 characters long")
+	}
+	if len(pwd) > maxPasswordLen {
+		return errors.New("password must be at most 256 characters long")
+	}
+	return nil
+}
+
+// powBaseDifficulty is how many bits of proof of work registering takes when registrations aren't surging.
+var powBaseDifficulty = 18
+
+// the most bits of work we ever ask for, which takes minutes on a slow phone
+const powMaxDifficulty = 26
+
+// powSurge is how many recent registrations count as a surge. Every time registrations double past it, the proof of work gets one bit harder.
+var powSurge = 50.0
+
+// challenges expire after this long
+const powValidity = time.Minute * 10
+
+// solved challenges, remembered until they expire so that each is only used once
+var powUsed = cache.New(powValidity, powValidity)
+
+// registrations is a count of recent registrations, halving every powValidity.
+var registrations struct {
+	count float64
+	last  time.Time
+	lock  sync.Mutex
+}
+
+// countRegistrations adds n registrations at now, returning the recent count.
+func countRegistrations(now time.Time, n float64) float64 {
+	registrations.lock.Lock()
+	defer registrations.lock.Unlock()
+	elapsed := now.Sub(registrations.last)
+	registrations.count = registrations.count*math.Exp2(-elapsed.Seconds()/powValidity.Seconds()) + n
+	registrations.last = now
+	return registrations.count
+}
+
+// powDifficulty is the proof of work asked for, given the recent registrations.
+func powDifficulty(recent float64) int {
+	d := powBaseDifficulty
+	for surge := powSurge; recent >= surge && d < powMaxDifficulty; surge *= 2 {
+		d++
+	}
+	return d
+}
+
+// powKey authenticates challenges, so that we don't have to remember the ones we hand out. It is derived from the master identity so that every binder sharing a store accepts the same challenges.
+func powKey() ([]byte, error) {
+	sk, err := store.MasterIdentity()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sk.Seed())
+	mac.Write([]byte("geph-pow-key"))
+	return mac.Sum(nil), nil
+}
+
+// challenges are the issue time, the difficulty and some randomness, followed by their MAC
+const powBodyLen = 8 + 1 + 16
+
+// newChallenge issues a challenge of the given difficulty.
+func newChallenge(now time.Time, difficulty int) ([]byte, error) {
+	key, err := powKey()
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, powBodyLen)
+	binary.BigEndian.PutUint64(body, uint64(now.Unix()))
+	body[8] = byte(difficulty)
+	rand.Read(body[9:])
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return mac.Sum(body), nil
+}
+
+// checkChallenge checks that we issued a challenge recently, that the nonce solves it, and that it hasn't been used before.
+func checkChallenge(challenge []byte, nonce uint64, now time.Time) error {
+	key, err := powKey()
+	if err != nil {
+		return err
+	}
+	if len(challenge) != powBodyLen+sha256.Size {
+		return errors.New("malformed challenge")
+	}
+	body := challenge[:powBodyLen]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), challenge[powBodyLen:]) {
+		return errors.New("challenge not issued by us")
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(body)), 0)
+	if now.Sub(issued) > powValidity {
+		return errors.New("challenge expired")
+	}
+	if !pow.Check(challenge, int(body[8]), nonce) {
+		return errors.New("wrong solution")
+	}
+	if powUsed.Add(string(challenge), true, cache.DefaultExpiration) != nil {
+		return errors.New("challenge already used")
+	}
+	return nil
+}
+
+func handlePowChallenge(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	difficulty := powDifficulty(countRegistrations(now, 0))
+	challenge, err := newChallenge(now, difficulty)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	json.NewEncoder(w).Encode(bdclient.PowChallenge{Challenge: challenge, Difficulty: difficulty})
+}
+
+// refuseRegistration tells the client why we won't register it.
+func refuseRegistration(w http.ResponseWriter, status int, reason string, msg string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(bdclient.RegisterError{Reason: reason, Message: msg})
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		return
+	}
+	var req struct {
+		Username    string
+		Password    string
+		CaptchaID   string
+		CaptchaSoln string
+		// PowChallenge and PowNonce can be given instead of a captcha.
+		PowChallenge []byte
+		PowNonce     uint64
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := validateUsername(req.Username); err != nil {
+		refuseRegistration(w, http.StatusBadRequest, bdclient.RegBadUsername, err.Error())
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		refuseRegistration(w, http.StatusBadRequest, bdclient.RegBadPassword, err.Error())
+		return
+	}
+	// check the captcha or the proof of work
+	if req.PowChallenge != nil {
+		if err := checkChallenge(req.PowChallenge, req.PowNonce, time.Now()); err != nil {
+			refuseRegistration(w, http.StatusBadRequest, bdclient.RegBadPow, err.Error())
+			return
+		}
+	} else if !captcha.VerifyString(req.CaptchaID, req.CaptchaSoln) {
+		refuseRegistration(w, http.StatusBadRequest, bdclient.RegBadCaptcha, "wrong captcha")
+		return
+	}
+	// register
+	err = store.CreateUser(req.Username, req.Password)
+	if err == ErrUserExists {
+		refuseRegistration(w, http.StatusConflict, bdclient.RegUsernameTaken, "username is taken")
+		return
+	}
+	if err != nil {
+		log.Println("cannot create user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	countRegistrations(time.Now(), 1)
+	// ok!
+	return
+}
+
+func handleCaptcha(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "image/png")
+	w.Header().Add("cache-control", "no-cache")
+	id := captcha.NewLen(8)
+	w.Header().Add("x-captcha-id", id)
+	captcha.WriteImage(w, id, 200, 100)
+}
@@ -0,0 +1,106 @@
+package binder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/pow"
+)
+
+func TestRegister(t *testing.T) {
+	defer func(d int) { powBaseDifficulty = d }(powBaseDifficulty)
+	powBaseDifficulty = 4
+	ms := NewMemStore()
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+
+	refusals := []struct {
+		uname, pwd, reason string
+	}{
+		{"al", "correct horse", bdclient.RegBadUsername},
+		{"Alice", "correct horse", bdclient.RegBadUsername},
+		{"_alice", "correct horse", bdclient.RegBadUsername},
+		{"alice bob", "correct horse", bdclient.RegBadUsername},
+		{"admin", "correct horse", bdclient.RegBadUsername},
+		{"alice", "short", bdclient.RegBadPassword},
+	}
+	for _, r := range refusals {
+		err := bc.Register(r.uname, r.pwd, time.Minute)
+		if re, ok := err.(bdclient.RegisterError); !ok || re.Reason != r.reason {
+			t.Fatalf("registering %q/%q gave %v, not %v", r.uname, r.pwd, err, r.reason)
+		}
+	}
+	if err := bc.Register("alice.b-2", "correct horse", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := bc.GetTicket("alice.b-2", "correct horse"); err != nil {
+		t.Fatal("cannot log in after registering:", err)
+	}
+	err := bc.Register("alice.b-2", "battery staple", time.Minute)
+	if re, ok := err.(bdclient.RegisterError); !ok || re.Reason != bdclient.RegUsernameTaken {
+		t.Fatal("took a taken username:", err)
+	}
+}
+
+func TestPowChallenge(t *testing.T) {
+	defer func(d int) { powBaseDifficulty = d }(powBaseDifficulty)
+	powBaseDifficulty = 4
+	store = NewMemStore()
+	now := time.Now()
+	challenge, err := newChallenge(now, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := now.Add(time.Minute)
+	nonce, _ := pow.Solve(challenge, 6, deadline)
+	forged := append([]byte(nil), challenge...)
+	forged[8] = 1
+	forgedNonce, _ := pow.Solve(forged, 1, deadline)
+	if checkChallenge(forged, forgedNonce, now) == nil {
+		t.Fatal("accepted a challenge with lowered difficulty")
+	}
+	if checkChallenge(challenge, nonce, now.Add(powValidity*2)) == nil {
+		t.Fatal("accepted an expired challenge")
+	}
+	if err := checkChallenge(challenge, nonce, now); err != nil {
+		t.Fatal(err)
+	}
+	if checkChallenge(challenge, nonce, now) == nil {
+		t.Fatal("accepted a challenge twice")
+	}
+	// surges make registering harder, and calm down again
+	if d := powDifficulty(0); d != powBaseDifficulty {
+		t.Fatal("wrong difficulty when calm:", d)
+	}
+	if d := powDifficulty(powSurge * 4); d != powBaseDifficulty+3 {
+		t.Fatal("wrong difficulty when surging:", d)
+	}
+	if d := powDifficulty(powSurge * 1e9); d != powMaxDifficulty {
+		t.Fatal("difficulty not capped:", d)
+	}
+	countRegistrations(now, 100)
+	if n := countRegistrations(now.Add(powValidity), 0); n < 49 || n > 51 {
+		t.Fatal("registrations didn't halve:", n)
+	}
+}
+
+func TestRegisterTooHard(t *testing.T) {
+	difficulty := bdclient.MaxPowDifficulty + 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(bdclient.PowChallenge{Challenge: []byte("spin"), Difficulty: difficulty})
+	}))
+	defer srv.Close()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+	if err := bc.Register("alice", "correct horse", time.Minute); err != bdclient.ErrPowTooHard {
+		t.Fatal("took on too much work:", err)
+	}
+	difficulty = bdclient.MaxPowDifficulty
+	if err := bc.Register("alice", "correct horse", time.Millisecond*100); err != pow.ErrDeadline {
+		t.Fatal("didn't give up:", err)
+	}
+}
@@ -0,0 +1,61 @@
+package binder
+
+import (
+	"crypto/rsa"
+	"errors"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Store is where the binder keeps users, secrets and bridge keys.
+type Store interface {
+	// CheckBridgeKey checks whether a bridge cookie is allowed.
+	CheckBridgeKey(key string) (ok bool, err error)
+	// CheckBridgeIdentity checks whether a bridge identity key has been enrolled.
+	CheckBridgeIdentity(key []byte) (ok bool, err error)
+	// AddBridgeIdentity enrolls a bridge identity key.
+	AddBridgeIdentity(key []byte, allocGroup string) error
+	// TicketIdentity returns the RSA ticket identity for a particular account class, as named by tiresias.Attrs.Name, and epoch, creating it if needed.
+	TicketIdentity(tier string, epoch uint64) (*rsa.PrivateKey, error)
+	// MasterIdentity returns the ed25519 master identity, creating it if needed.
+	MasterIdentity() (ed25519.PrivateKey, error)
+	// VerifyUser verifies a username/password. uid < 0 means authentication failed.
+	VerifyUser(uname, pwd string) (uid int, subExpiry time.Time, paytx map[time.Time]int, err error)
+	// CreateUser creates a username/password pair, returning ErrUserExists if the username is taken.
+	CreateUser(uname, pwd string) error
+	// CreateInvoice creates an unpaid invoice for a user, for an amount in USD cents buying some days of subscription.
+	CreateInvoice(uname string, amount, days int) (id string, created time.Time, err error)
+	// PayInvoice marks an invoice paid and extends its user's subscription. It is idempotent: paying an invoice again changes nothing and returns false.
+	PayInvoice(id string, amount int) (newlyPaid bool, err error)
+	// AddVouchers adds a batch of unredeemed vouchers, each good for some days of subscription.
+	AddVouchers(codes []string, days int, batch string) error
+	// RedeemVoucher redeems a voucher for a user, recording it as a free invoice and extending the user's subscription until the returned expiry. Each voucher can be redeemed once, and each user can redeem one voucher per batch.
+	RedeemVoucher(uname, code string) (days int, expiry time.Time, err error)
+	// Exits returns every exit, with what clients need to choose between them.
+	Exits() ([]bridgeauth.ExitEntry, error)
+	// AddExit adds an exit, replacing any exit with the same name or key.
+	AddExit(ei bridgeauth.ExitEntry) error
+	// PruneTickets forgets the ticket identities of epochs before the given one.
+	PruneTickets(before uint64) error
+}
+
+// ErrUserExists is returned by CreateUser for a username that is taken.
+var ErrUserExists = errors.New("user already exists")
+
+// Errors returned by PayInvoice.
+var (
+	ErrNoInvoice = errors.New("no such invoice")
+	ErrUnderpaid = errors.New("paid less than the invoice amount")
+)
+
+// Errors returned by RedeemVoucher.
+var (
+	ErrNoVoucher       = errors.New("no such voucher")
+	ErrVoucherRedeemed = errors.New("voucher already redeemed")
+	ErrBatchRedeemed   = errors.New("already redeemed a voucher from this batch")
+)
+
+// store is the Store the handlers use.
+var store Store
@@ -0,0 +1,108 @@
+package binder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binder-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+	ms, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.CreateUser("alice", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.CreateUser("alice", "again"); err == nil {
+		t.Fatal("created the same user twice")
+	}
+	paid := time.Now().Truncate(time.Second).UTC()
+	if err := ms.SetSubscription("alice", paid.Add(time.Hour*24*30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.AddInvoice("alice", paid, 500); err != nil {
+		t.Fatal(err)
+	}
+	ms.AddBridgeKey("secret")
+	ms.AddBridgeIdentity([]byte{0xff, 0x00, 0xfe}, "group")
+	ms.AddExit(bridgeauth.ExitEntry{Name: "exit", Addr: "127.0.0.1:2389", Key: []byte{1, 2, 3}, Region: "local", Tiers: []string{"paid"}})
+	invID, _, err := ms.CreateInvoice("alice", 500, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msk, _ := ms.MasterIdentity()
+	tsk, err := ms.TicketIdentity("free", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything survives reopening
+	ms, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, expiry, paytx, err := ms.VerifyUser("alice", "hunter2")
+	if err != nil || uid < 0 {
+		t.Fatal("cannot log in after reopening", uid, err)
+	}
+	if !expiry.Equal(paid.Add(time.Hour*24*30)) || len(paytx) != 1 || paytx[paid] != 500 {
+		t.Fatal("lost the subscription:", expiry, paytx)
+	}
+	if uid, _, _, _ := ms.VerifyUser("alice", "wrong"); uid >= 0 {
+		t.Fatal("accepted a wrong password")
+	}
+	if ok, _ := ms.CheckBridgeKey("secret"); !ok {
+		t.Fatal("lost the bridge key")
+	}
+	if ok, _ := ms.CheckBridgeIdentity([]byte{0xff, 0x00, 0xfe}); !ok {
+		t.Fatal("lost the bridge identity")
+	}
+	if exits, _ := ms.Exits(); len(exits) != 1 || exits[0].Addr != "127.0.0.1:2389" || exits[0].Region != "local" || !exits[0].Accepts("paid") {
+		t.Fatal("lost the exits:", exits)
+	}
+	if msk2, _ := ms.MasterIdentity(); !bytes.Equal(msk, msk2) {
+		t.Fatal("master identity changed")
+	}
+	if tsk2, _ := ms.TicketIdentity("free", 100); tsk2.N.Cmp(tsk.N) != 0 {
+		t.Fatal("ticket identity changed")
+	}
+	if tsk2, _ := ms.TicketIdentity("free", 101); tsk2.N.Cmp(tsk.N) == 0 {
+		t.Fatal("epochs share a ticket identity")
+	}
+
+	// pruning is persisted too
+	if err := ms.PruneTickets(101); err != nil {
+		t.Fatal(err)
+	}
+	ms, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsk2, _ := ms.TicketIdentity("free", 100); tsk2.N.Cmp(tsk.N) == 0 {
+		t.Fatal("ticket identity not pruned")
+	}
+
+	// and so are invoices
+	if ok, err := ms.PayInvoice(invID, 500); !ok || err != nil {
+		t.Fatal("lost the invoice:", err)
+	}
+	ms, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ms.PayInvoice(invID, 500); ok || err != nil {
+		t.Fatal("invoice paid twice:", err)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package binder
 
 import (
 	"crypto/x509"
@@ -7,15 +7,51 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
-	"github.com/cryptoballot/rsablind"
 	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/tiresias"
 )
 
+// ticketKeys returns the published keys of a set of attributes: every epoch whose tickets are redeemable now, newest first, followed by the next epoch.
+func ticketKeys(attrs tiresias.Attrs, now time.Time) ([]tiresias.KeyInfo, error) {
+	epochs := ticketSchedule.Redeemable(now)
+	epochs = append([]uint64{epochs[0] + 1}, epochs...)
+	var toret []tiresias.KeyInfo
+	for _, epoch := range epochs {
+		sk, err := store.TicketIdentity(attrs.Name(), epoch)
+		if err != nil {
+			return nil, err
+		}
+		toret = append(toret, ticketSchedule.Info(epoch, attrs, &sk.PublicKey))
+	}
+	return toret, nil
+}
+
 func handleGetTicketKey(w http.ResponseWriter, r *http.Request) {
-	// check type
-	key, err := getTicketIdentity(r.FormValue("tier"))
+	// check type; exits ask by the attributes on a ticket
+	attrs, ok := issuedAttrs(r.FormValue("attrs"))
+	if tier := r.FormValue("tier"); tier == "free" || tier == "paid" {
+		attrs, ok = ticketAttrs(tier), true
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// new clients want the whole schedule
+	if r.FormValue("format") == "json" {
+		keys, err := ticketKeys(attrs, time.Now())
+		if err != nil {
+			log.Println("cannot get ticket keys:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+	key, err := store.TicketIdentity(attrs.Name(), ticketSchedule.Epoch(time.Now()))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -25,7 +61,7 @@ func handleGetTicketKey(w http.ResponseWriter, r *http.Request) {
 
 func handleGetTier(w http.ResponseWriter, r *http.Request) {
 	// first authenticate
-	_, expiry, _, err := verifyUser(r.FormValue("user"), r.FormValue("pwd"))
+	_, expiry, _, err := store.VerifyUser(r.FormValue("user"), r.FormValue("pwd"))
 	if err != nil {
 		log.Println("cannot verify user:", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -40,7 +76,7 @@ func handleGetTier(w http.ResponseWriter, r *http.Request) {
 
 func handleGetTicket(w http.ResponseWriter, r *http.Request) {
 	// first authenticate
-	uid, expiry, paytx, err := verifyUser(r.FormValue("user"), r.FormValue("pwd"))
+	uid, expiry, paytx, err := store.VerifyUser(r.FormValue("user"), r.FormValue("pwd"))
 	if err != nil {
 		log.Println("cannot verify user:", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -64,16 +100,26 @@ func handleGetTicket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("get-ticket: user", r.FormValue("user"), "sent us blinded of length", len(blinded))
-	// get the key
-	key, err := getTicketIdentity(tier)
+	// get the key of the epoch the client asked for, which must still be redeemable
+	now := time.Now()
+	epoch := ticketSchedule.Epoch(now)
+	if e := r.FormValue("epoch"); e != "" {
+		epoch, err = strconv.ParseUint(e, 10, 64)
+		if err != nil || !redeemableEpoch(epoch, now) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	key, err := store.TicketIdentity(ticketAttrs(tier).Name(), epoch)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	// issue the ticket. TODO rate limit this
-	ticket, err := rsablind.BlindSign(key, blinded)
+	ticket, err := tiresias.Issue(key, blinded)
 	if err != nil {
-		panic(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	var toWrite bdclient.TicketResp
 	toWrite.Tier = tier
@@ -104,8 +150,9 @@ func handleRedeemTicket(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// obtain key
-	key, err := getTicketIdentity(r.FormValue("tier"))
+	// obtain keys
+	now := time.Now()
+	keys, err := ticketKeys(ticketAttrs(r.FormValue("tier")), now)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -122,9 +169,19 @@ func handleRedeemTicket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// verify
-	if err := rsablind.VerifyBlindSignature(&key.PublicKey, ubmsg, ubsig); err != nil {
+	if _, err := (tiresias.Ticket{Msg: ubmsg, Sig: ubsig}).VerifyKeys(keys, now); err != nil {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	return
 }
+
+// redeemableEpoch says whether tickets of an epoch are redeemable at the given time.
+func redeemableEpoch(epoch uint64, now time.Time) bool {
+	for _, e := range ticketSchedule.Redeemable(now) {
+		if e == epoch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package binder
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// voucherEncoding spells vouchers without letters and digits that look alike
+var voucherEncoding = base32.NewEncoding("ABCDEFGHJKLMNPQRSTUVWXYZ23456789").WithPadding(base32.NoPadding)
+
+// newVoucherCode returns a random 100-bit voucher code, as 20 characters.
+func newVoucherCode() string {
+	b := make([]byte, 13)
+	rand.Read(b)
+	return voucherEncoding.EncodeToString(b)[:20]
+}
+
+// formatVoucher splits a code into groups of four, for people to type.
+func formatVoucher(code string) string {
+	var groups []string
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// normalizeVoucher undoes formatVoucher, and whatever else people do when typing codes in.
+func normalizeVoucher(s string) string {
+	s = strings.ToUpper(s)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// vouchersMain generates a batch of vouchers, adds them to the store and prints them.
+func vouchersMain(args []string) {
+	var count int
+	var days int
+	var batch string
+	flags := flag.NewFlagSet("geph-binder vouchers", flag.ExitOnError)
+	openStore := storeFlags(flags)
+	flags.IntVar(&count, "count", 10, "how many vouchers to generate")
+	flags.IntVar(&days, "days", 30, "days of paid tier each voucher is good for")
+	flags.StringVar(&batch, "batch", "", "name of the batch; each account can redeem one voucher per batch (default: today's date)")
+	flags.Parse(args)
+	if count < 1 || days < 1 {
+		log.Fatal("count and days must be positive")
+	}
+	if batch == "" {
+		batch = time.Now().Format("2006-01-02")
+	}
+	st, err := openStore()
+	if err != nil {
+		log.Fatal("cannot open store:", err)
+	}
+	codes := make([]string, count)
+	for i := range codes {
+		codes[i] = newVoucherCode()
+	}
+	if err := st.AddVouchers(codes, days, batch); err != nil {
+		log.Fatal("cannot add vouchers:", err)
+	}
+	log.Printf("generated %v vouchers for %v days in batch %q", count, days, batch)
+	for _, code := range codes {
+		fmt.Println(formatVoucher(code))
+	}
+}
+
+func handleRedeemVoucher(w http.ResponseWriter, r *http.Request) {
+	uname := r.FormValue("user")
+	uid, _, _, err := store.VerifyUser(uname, r.FormValue("pwd"))
+	if err != nil {
+		log.Println("cannot verify user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if uid < 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	days, expiry, err := store.RedeemVoucher(uname, normalizeVoucher(r.FormValue("code")))
+	switch err {
+	case nil:
+	case ErrNoVoucher:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case ErrVoucherRedeemed, ErrBatchRedeemed:
+		w.WriteHeader(http.StatusConflict)
+		return
+	default:
+		log.Println("cannot redeem voucher:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println(uname, "redeemed a voucher for", days, "days")
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(bdclient.VoucherResp{Days: days, PaidExpiry: expiry})
+}
@@ -0,0 +1,70 @@
+package binder
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+func TestVouchers(t *testing.T) {
+	ms := NewMemStore()
+	ms.CreateUser("alice", "hunter2")
+	ms.CreateUser("bob", "swordfish")
+	srv := httptest.NewServer(Handler(ms))
+	defer srv.Close()
+	bc := bdclient.NewClient(srv.URL, "binder.test")
+
+	codes := []string{newVoucherCode(), newVoucherCode(), newVoucherCode()}
+	if err := ms.AddVouchers(codes[:2], 30, "spring"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.AddVouchers(codes[2:], 7, "summer"); err != nil {
+		t.Fatal(err)
+	}
+	// codes are typed in however people like
+	typed := strings.ToLower(formatVoucher(codes[0]))
+	if normalizeVoucher(typed) != codes[0] {
+		t.Fatal("cannot read back", typed)
+	}
+	if _, err := bc.RedeemVoucher("alice", "wrong", typed); err == nil {
+		t.Fatal("redeemed with a wrong password")
+	}
+	if _, err := bc.RedeemVoucher("alice", "hunter2", "AAAA-BBBB"); err != bdclient.ErrNoVoucher {
+		t.Fatal("redeemed a made-up voucher:", err)
+	}
+	vr, err := bc.RedeemVoucher("alice", "hunter2", typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vr.Days != 30 || time.Until(vr.PaidExpiry) < time.Hour*24*29 {
+		t.Fatalf("wrong redemption %+v", vr)
+	}
+	// once per voucher, and once per batch
+	if _, err := bc.RedeemVoucher("bob", "swordfish", typed); err != bdclient.ErrVoucherRedeemed {
+		t.Fatal("voucher redeemed twice:", err)
+	}
+	if _, err := bc.RedeemVoucher("alice", "hunter2", codes[1]); err != bdclient.ErrVoucherRedeemed {
+		t.Fatal("two vouchers from a batch redeemed:", err)
+	}
+	if _, err := bc.RedeemVoucher("bob", "swordfish", codes[1]); err != nil {
+		t.Fatal(err)
+	}
+	vr2, err := bc.RedeemVoucher("alice", "hunter2", codes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := vr2.PaidExpiry.Sub(vr.PaidExpiry); d != time.Hour*24*7 {
+		t.Fatal("second voucher extended by", d)
+	}
+	// redemptions show up like payments
+	_, _, details, err := bc.GetTicket("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Tier != "paid" || len(details.Transactions) != 2 || !details.PaidExpiry.Equal(vr2.PaidExpiry) {
+		t.Fatalf("redemptions not shown: %+v", details)
+	}
+}
@@ -0,0 +1,251 @@
+// Package bridge implements geph-bridge, which relays clients that can't reach exits directly. The bridge keeps its state in package variables, so only one can run per process.
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/metrics"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+)
+
+var cookieSeed string
+var cookie []byte
+
+var binderFront string
+var binderReal string
+var binderMPKHex string
+var binderKey string
+var statsdAddr string
+var metricsBackend string
+var prometheusAddr string
+var allocGroup string
+var capacity uint64
+var listenAddrs string
+
+// GitVersion is the build version
+var GitVersion string
+
+var bclient *bdclient.Client
+
+var metricSink = metrics.Nop
+var countBytes = func(int64) {}
+var activeClients int64
+var activeConns int64
+var totalBytes uint64
+
+// Main runs the bridge with the given command-line arguments. It never returns.
+func Main(args []string) {
+	Setup(args)
+	listenLoop()
+}
+
+// Setup configures the bridge from command-line arguments and fetches the exit list, without listening anywhere.
+func Setup(args []string) {
+	flags := flag.NewFlagSet("geph-bridge", flag.ExitOnError)
+	flags.StringVar(&cookieSeed, "cookieSeed", "", "seed for generating a cookie")
+	flags.DurationVar(&cookieRotation, "cookieRotation", time.Hour*24, "how often to change the cookie, or 0 to never change it")
+	flags.DurationVar(&cookieOverlap, "cookieOverlap", time.Hour*6, "how long the previous cookie keeps working after a change")
+	flags.StringVar(&binderFront, "binderFront", "https://ajax.aspnetcdn.com/v2", "binder domain-fronting host")
+	flags.StringVar(&binderReal, "binderReal", "gephbinder.azureedge.net", "real hostname of the binder")
+	flags.StringVar(&binderMPKHex, "binderMPK", bdclient.DefaultMPK, "hex-encoded binder master public key, used to check the exit list; defaults to the key this build trusts")
+	flags.StringVar(&metricsBackend, "metrics", "statsd", "metrics backend: statsd, prometheus or none")
+	flags.StringVar(&statsdAddr, "statsdAddr", "c2.geph.io:8125", "address of StatsD for gathering statistics")
+	flags.StringVar(&prometheusAddr, "prometheusAddr", ":9100", "address to serve Prometheus metrics on")
+	flags.StringVar(&binderKey, "binderKey", "", "binder API key")
+	flags.StringVar(&allocGroup, "allocGroup", "", "allocation group")
+	flags.StringVar(&listenAddrs, "listen", ":", "comma-separated UDP addresses to listen on, like \":443,:53,[::]:443\"; each is advertised as a separate endpoint")
+	flags.Uint64Var(&capacity, "capacity", 1000, "how many clients this bridge relays at once before refusing new ones")
+	flags.Parse(args)
+	if GitVersion == "" {
+		GitVersion = "NOVER"
+	}
+	if cookieSeed == "" {
+		log.Fatal("must specify a good cookie seed")
+	}
+	if allocGroup == "" {
+		log.Fatal("must specify an allocation group")
+	}
+	if binderMPKHex == "" {
+		log.Fatal("this build has no binder master key, so -binderMPK is needed")
+	}
+	mpk, err := bdclient.ParseMasterKey(binderMPKHex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	binderMPK = mpk
+	setupMetrics()
+	generateCookie()
+	bclient = bdclient.NewClient(binderFront, binderReal)
+	bclient.PinMasterKey(binderMPK)
+	refreshExits()
+}
+
+func setupMetrics() {
+	var err error
+	switch metricsBackend {
+	case "statsd":
+		metricSink, err = metrics.Open(metricsBackend, statsdAddr, allocGroup)
+	case "prometheus":
+		metricSink, err = metrics.Open(metricsBackend, prometheusAddr, "geph_bridge")
+	default:
+		metricSink, err = metrics.Open(metricsBackend, "", "")
+	}
+	if err != nil {
+		log.Fatalln("cannot set up metrics:", err)
+	}
+	countBytes = metrics.Accumulate(metricSink, metrics.Bytes, time.Second*10)
+	go metrics.ReportKCP(metricSink, time.Second*10)
+}
+
+func generateCookie() {
+	epoch, _ := cookieEpoch(time.Now())
+	cookieLock.Lock()
+	cookie = cookieFor(epoch)
+	cookieLock.Unlock()
+	log.Printf("Cookie generated: %x", cookie)
+	// the identity is derived separately, since the cookie is public
+	idseed := sha256.Sum256([]byte("geph-bridge-identity" + cookieSeed))
+	bridgeSK = ed25519.NewKeyFromSeed(idseed[:])
+	bridgePK = bridgeSK.Public().(ed25519.PublicKey)
+	log.Printf("Identity: %x", bridgePK)
+}
+
+func listenLoop() {
+	var socks []net.PacketConn
+	var hosts []string
+	for _, addr := range strings.Split(listenAddrs, ",") {
+		udpsock, host, err := listenUDP(strings.TrimSpace(addr))
+		if err != nil {
+			log.Println("cannot listen on", addr, err)
+			continue
+		}
+		log.Println("server started UDP on", host)
+		socks = append(socks, udpsock)
+		hosts = append(hosts, host)
+	}
+	if len(socks) == 0 {
+		log.Fatal("not listening anywhere")
+	}
+	Serve(socks, hosts)
+}
+
+// Serve serves clients on already-open sockets, registering them with the binder as reachable at the given hosts. It never returns.
+func Serve(wires []net.PacketConn, hosts []string) {
+	var socks []*niaucchi4.ObfsSocket
+	for _, wire := range wires {
+		socks = append(socks, listenObfs(wire))
+	}
+	go rotateCookies(socks)
+	go registerLoop(hosts)
+	for _, e2e := range socks[1:] {
+		go acceptLoop(e2e)
+	}
+	acceptLoop(socks[0])
+}
+
+// listenUDP listens on a local address, returning the address clients can reach it at.
+func listenUDP(addr string) (udpsock net.PacketConn, host string, err error) {
+	ipstr, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(ipstr)
+	network := "udp"
+	if ip != nil && ip.To4() == nil {
+		network = "udp6"
+	} else if ip != nil {
+		network = "udp4"
+	}
+	udpsock, err = net.ListenPacket(network, addr)
+	if err != nil {
+		return
+	}
+	udpsock.(*net.UDPConn).SetWriteBuffer(1000 * 1000 * 10)
+	port := strconv.Itoa(udpsock.LocalAddr().(*net.UDPAddr).Port)
+	switch {
+	case ip != nil && !ip.IsUnspecified():
+		host = net.JoinHostPort(ipstr, port)
+	case network == "udp6":
+		var myip string
+		myip, err = guessIPv6()
+		if err != nil {
+			udpsock.Close()
+			return
+		}
+		host = net.JoinHostPort(myip, port)
+	default:
+		host = net.JoinHostPort(guessIP(), port)
+	}
+	return
+}
+
+func acceptLoop(e2e *niaucchi4.ObfsSocket) {
+	listener := niaucchi4.Listen(e2e)
+	log.Println("KCP listener spinned up on", e2e.LocalAddr())
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Accepted client", client.RemoteAddr())
+		metricSink.Count(metrics.SessionsTotal, 1)
+		metricSink.Gauge(metrics.Sessions, float64(atomic.AddInt64(&activeClients, 1)))
+		go func() {
+			defer func() {
+				metricSink.Gauge(metrics.Sessions, float64(atomic.AddInt64(&activeClients, -1)))
+			}()
+			err := serveClient(client)
+			log.Println("Closed client", client.RemoteAddr(), "reason", err)
+		}()
+	}
+}
+
+func guessIP() string {
+	resp, err := http.Get("https://checkip.amazonaws.com")
+	if err != nil {
+		panic("stuck while getting our own IP: " + err.Error())
+	}
+	buf := new(bytes.Buffer)
+	io.Copy(buf, resp.Body)
+	resp.Body.Close()
+	myip := strings.Trim(string(buf.Bytes()), "\n ")
+	return myip
+}
+
+// guessIPv6 finds our public IPv6 address, if we have one.
+func guessIPv6() (string, error) {
+	hclient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "tcp6", addr)
+			},
+		},
+		Timeout: time.Second * 10,
+	}
+	resp, err := hclient.Get("https://api6.ipify.org")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf := new(bytes.Buffer)
+	io.Copy(buf, io.LimitReader(resp.Body, 100))
+	myip := strings.Trim(buf.String(), "\n ")
+	if ip := net.ParseIP(myip); ip == nil || ip.To4() != nil {
+		return "", fmt.Errorf("not an IPv6 address: %q", myip)
+	}
+	return myip, nil
+}
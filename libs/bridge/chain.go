@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/patrickmn/go-cache"
+)
+
+// allowLocalHops lets clients chain to bridges on loopback or private addresses, which only tests should do.
+var allowLocalHops = false
+
+// hosts that proved they hold a bridge identity, so that we don't make them prove it for every client. string => bool
+var provenHops = cache.New(time.Minute*10, time.Minute*10)
+
+// decodeCert decodes and checks the certificate of the bridge a client wants to chain to, so that we never dial anything the binder didn't vouch for.
+func decodeCert(arg string) (cert bridgeauth.BridgeCert, err error) {
+	bts, err := hex.DecodeString(arg)
+	if err != nil {
+		return
+	}
+	if err = rlp.DecodeBytes(bts, &cert); err != nil {
+		return
+	}
+	err = cert.Verify(binderMPK)
+	return
+}
+
+// checkHop refuses hosts that are not a literal public IP address and port, so that clients can't use us to reach our own network. Hostnames are refused too, since they could resolve to anything.
+func checkHop(host string) error {
+	ipstr, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return fmt.Errorf("next bridge %q is not an IP address", host)
+	}
+	if allowLocalHops {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("next bridge %q is not public", host)
+	}
+	return nil
+}
+
+// proveHop checks that the bridge at host holds the identity key, by sealing a throwaway connection to it.
+func proveHop(host string, cookie []byte, identity ed25519.PublicKey) error {
+	key := host + "/" + hex.EncodeToString(identity)
+	if _, ok := provenHops.Get(key); ok {
+		return nil
+	}
+	probe, err := niaucchi4.Dial(host, cookie)
+	if err != nil {
+		return err
+	}
+	defer probe.Close()
+	probe.SetDeadline(time.Now().Add(time.Second * 10))
+	if _, err := bridgeproto.Seal(probe, identity); err != nil {
+		return err
+	}
+	provenHops.SetDefault(key, true)
+	return nil
+}
+
+// dialNextBridge connects to another bridge for a client chaining bridges. The bridge must prove that it holds the certified identity first, so that clients can't send us anywhere else. It is then pinged, so that the client learns right away if it can't be reached.
+func dialNextBridge(host string, cookie []byte, identity ed25519.PublicKey) (net.Conn, error) {
+	if err := proveHop(host, cookie, identity); err != nil {
+		return nil, fmt.Errorf("next bridge failed to prove its identity: %w", err)
+	}
+	next, err := niaucchi4.Dial(host, cookie)
+	if err != nil {
+		return nil, err
+	}
+	next.SetDeadline(time.Now().Add(time.Second * 10))
+	if err := bridgeproto.Ping(next); err != nil {
+		next.Close()
+		return nil, err
+	}
+	next.SetDeadline(time.Time{})
+	return next, nil
+}
@@ -0,0 +1,151 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+)
+
+// bridgeProcessEnv holds the command line of a bridge process started by the test binary
+const bridgeProcessEnv = "GEPH_BRIDGE_TEST_ARGS"
+
+// startBridgeProcess runs a real bridge in another process, returning the descriptor it registered with the test binder.
+func startBridgeProcess(t *testing.T, seed string) (*exec.Cmd, bridgeauth.BridgeDescriptor) {
+	args := fmt.Sprintf("-cookieSeed %v -cookieRotation 0 -allocGroup %v -listen 127.0.0.1:0 -metrics none "+
+		"-binderFront %v -binderReal binder.test -binderKey secret -binderMPK %x",
+		seed, seed, testBinderURL, binderMPK)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), bridgeProcessEnv+"="+args)
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	idseed := sha256.Sum256([]byte("geph-bridge-identity" + seed))
+	identity := ed25519.NewKeyFromSeed(idseed[:]).Public().(ed25519.PublicKey)
+	for start := time.Now(); time.Since(start) < time.Second*10; time.Sleep(time.Millisecond * 100) {
+		for _, desc := range testBinder.Bridges() {
+			if bytes.Equal(desc.Key, identity) {
+				return cmd, desc
+			}
+		}
+	}
+	cmd.Process.Kill()
+	t.Fatal("bridge", seed, "never registered")
+	return nil, bridgeauth.BridgeDescriptor{}
+}
+
+// dialChain connects to the fake exit through two bridges, presenting a certificate for the second one and checking that it has the given identity.
+func dialChain(first, second bridgeauth.BridgeDescriptor, cert bridgeauth.BridgeCert, identity ed25519.PublicKey) (io.ReadWriteCloser, error) {
+	conn, err := niaucchi4.Dial(first.Hosts[0], first.Cookie)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	if err := bridgeproto.ConnectBridge(conn, second.Hosts[0], second.Cookie, cert); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sealed, err := bridgeproto.Seal(conn, identity)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := bridgeproto.Connect(sealed, testExit); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
+
+func TestChain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts bridge processes")
+	}
+	// this process is the client, the binder and the exit; the two bridges run on their own
+	first, a := startBridgeProcess(t, "chain-first")
+	defer first.Process.Kill()
+	second, b := startBridgeProcess(t, "chain-second")
+	defer second.Process.Kill()
+	certA := bridgeauth.NewBridgeCert(testBinder.MSK(), a.Key, time.Hour)
+	certB := bridgeauth.NewBridgeCert(testBinder.MSK(), b.Key, time.Hour)
+	conn, err := dialChain(a, b, certB, b.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("through two bridges")
+	conn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatal("echo through the chain failed:", err)
+	}
+	// the first bridge can't pretend to be the second
+	if _, err := dialChain(a, b, certB, a.Key); err == nil {
+		t.Fatal("sealed to the wrong bridge")
+	}
+	// nor can a client send the first bridge somewhere its certificate doesn't hold
+	if _, err := dialChain(a, b, certA, b.Key); err == nil {
+		t.Fatal("chained to a bridge without its certificate")
+	}
+	// bad cookies are refused before dialing
+	conn2, err := niaucchi4.Dial(a.Hosts[0], a.Cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(time.Second * 10))
+	certBts, _ := rlp.EncodeToBytes(certB)
+	err = bridgeproto.Do(conn2, bridgeproto.CmdConn, b.Hosts[0], hex.EncodeToString(b.Cookie[:8]), hex.EncodeToString(certBts))
+	expectRefusal(t, err, bridgeproto.ErrBadRequest)
+}
+
+func TestCheckHop(t *testing.T) {
+	for host, ok := range map[string]bool{
+		"1.2.3.4:5000":        true,
+		"[2001:db8::1]:5000":  true,
+		"bridge.example:5000": false,
+		"1.2.3.4":             false,
+		"127.0.0.1:5000":      false,
+		"10.1.2.3:5000":       false,
+		"192.168.1.1:5000":    false,
+		"172.16.0.1:5000":     false,
+		"169.254.169.254:80":  false,
+		"[::1]:5000":          false,
+		"[fe80::1]:5000":      false,
+		"[fd00::1]:5000":      false,
+		"0.0.0.0:5000":        false,
+		"224.0.0.1:5000":      false,
+	} {
+		if err := checkHop(host); (err == nil) != ok {
+			t.Errorf("%v: got %v", host, err)
+		}
+	}
+}
+
+func TestForgedCert(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	cert := bridgeauth.NewBridgeCert(sk, sk.Public().(ed25519.PublicKey), time.Hour)
+	certBts, _ := rlp.EncodeToBytes(cert)
+	if _, err := decodeCert(hex.EncodeToString(certBts)); err == nil {
+		t.Fatal("accepted a certificate the binder didn't sign")
+	}
+	cert = bridgeauth.NewBridgeCert(testBinder.MSK(), sk.Public().(ed25519.PublicKey), time.Hour)
+	certBts, _ = rlp.EncodeToBytes(cert)
+	if _, err := decodeCert(hex.EncodeToString(certBts)); err != nil {
+		t.Fatal(err)
+	}
+}
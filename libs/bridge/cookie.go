@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/niaucchi4"
+)
+
+// how often the cookie changes, and for how long the previous one keeps working. Zero means the cookie never changes.
+var cookieRotation time.Duration
+var cookieOverlap time.Duration
+
+var cookieLock sync.Mutex
+
+// cookieEpoch returns which cookie is current at a given time, and when that cookie took over. Every bridge rotates at a different moment, so that the binder isn't flooded with registrations at once.
+func cookieEpoch(t time.Time) (epoch int64, start time.Time) {
+	if cookieRotation <= 0 {
+		return
+	}
+	h := sha256.Sum256([]byte("geph-bridge-rotation" + cookieSeed))
+	offset := int64(binary.BigEndian.Uint64(h[:8]) % uint64(cookieRotation))
+	epoch = (t.UnixNano() + offset) / int64(cookieRotation)
+	start = time.Unix(0, epoch*int64(cookieRotation)-offset)
+	return
+}
+
+// cookieFor derives the cookie for an epoch from the cookie seed, so that restarting doesn't change it.
+func cookieFor(epoch int64) []byte {
+	if cookieRotation <= 0 {
+		z := sha256.Sum256([]byte(cookieSeed))
+		return z[:]
+	}
+	z := sha256.Sum256([]byte(fmt.Sprintf("%v/%v", cookieSeed, epoch)))
+	return z[:]
+}
+
+func currentCookie() []byte {
+	cookieLock.Lock()
+	defer cookieLock.Unlock()
+	return cookie
+}
+
+// listenObfs obfuscates the socket with the current cookie, still accepting the previous one if it retired less than cookieOverlap ago.
+func listenObfs(wire net.PacketConn) *niaucchi4.ObfsSocket {
+	epoch, start := cookieEpoch(time.Now())
+	if remaining := cookieOverlap - time.Since(start); cookieRotation > 0 && remaining > 0 {
+		sock := niaucchi4.ObfsListen(cookieFor(epoch-1), wire)
+		sock.SetCookie(cookieFor(epoch), remaining)
+		return sock
+	}
+	return niaucchi4.ObfsListen(cookieFor(epoch), wire)
+}
+
+// rotateCookies switches the sockets to a new cookie at the start of every epoch, and tells the binder about it.
+func rotateCookies(socks []*niaucchi4.ObfsSocket) {
+	if cookieRotation <= 0 {
+		return
+	}
+	for {
+		epoch, start := cookieEpoch(time.Now())
+		time.Sleep(time.Until(start.Add(cookieRotation)))
+		newCookie := cookieFor(epoch + 1)
+		for _, sock := range socks {
+			sock.SetCookie(newCookie, cookieOverlap)
+		}
+		cookieLock.Lock()
+		cookie = newCookie
+		cookieLock.Unlock()
+		log.Printf("Cookie rotated: %x", newCookie)
+		select {
+		case registerNow <- true:
+		default:
+		}
+	}
+}
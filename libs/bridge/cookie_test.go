@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/niaucchi4"
+)
+
+func TestCookieEpoch(t *testing.T) {
+	oldRotation := cookieRotation
+	defer func() { cookieRotation = oldRotation }()
+	cookieRotation = 0
+	if _, start := cookieEpoch(time.Now()); !start.IsZero() || !bytes.Equal(cookieFor(0), cookie) {
+		t.Fatal("cookie changes without rotation")
+	}
+	cookieRotation = time.Hour
+	now := time.Now()
+	epoch, start := cookieEpoch(now)
+	if start.After(now) || now.Sub(start) >= cookieRotation {
+		t.Fatal("epoch starts at", start, "which doesn't contain", now)
+	}
+	if next, _ := cookieEpoch(start.Add(cookieRotation)); next != epoch+1 {
+		t.Fatal("epoch did not advance after an interval")
+	}
+	if prev, _ := cookieEpoch(start.Add(-time.Nanosecond)); prev != epoch-1 {
+		t.Fatal("epoch did not start at", start)
+	}
+	if !bytes.Equal(cookieFor(epoch), cookieFor(epoch)) || bytes.Equal(cookieFor(epoch), cookieFor(epoch+1)) {
+		t.Fatal("cookies not derived per epoch")
+	}
+}
+
+func TestListenObfsOverlap(t *testing.T) {
+	oldRotation, oldOverlap := cookieRotation, cookieOverlap
+	defer func() { cookieRotation, cookieOverlap = oldRotation, oldOverlap }()
+	// an overlap as long as the rotation always includes the previous cookie
+	cookieRotation, cookieOverlap = time.Hour, time.Hour
+	epoch, _ := cookieEpoch(time.Now())
+	wire, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := listenObfs(wire)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+	for _, e := range []int64{epoch - 1, epoch} {
+		if !echoes(t, server.LocalAddr(), cookieFor(e)) {
+			t.Fatal("cookie of epoch", e-epoch, "refused")
+		}
+	}
+	if echoes(t, server.LocalAddr(), cookieFor(epoch-2)) {
+		t.Fatal("long-retired cookie accepted")
+	}
+}
+
+// echoes checks whether an obfuscated echo server accepts a cookie.
+func echoes(t *testing.T, server net.Addr, cookie []byte) bool {
+	wire, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := niaucchi4.ObfsListen(cookie, wire)
+	defer client.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			// the first writes only send hellos
+			client.WriteTo([]byte("hello"), server)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 20):
+			}
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	buf := make([]byte, 1000)
+	n, _, err := client.ReadFrom(buf)
+	return err == nil && string(buf[:n]) == "hello"
+}
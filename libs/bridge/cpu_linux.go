@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package bridge
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuTimes returns the idle and total CPU time since boot, in arbitrary units.
+func cpuTimes() (idle, total uint64, ok bool) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return
+	}
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return
+		}
+		total += n
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package bridge
+
+// cpuTimes can't tell CPU usage on this platform.
+func cpuTimes() (idle, total uint64, ok bool) {
+	return
+}
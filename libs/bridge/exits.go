@@ -0,0 +1,198 @@
+package bridge
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/flowmux"
+)
+
+var binderMPK ed25519.PublicKey
+
+var exitsLock sync.RWMutex
+var exitList bridgeauth.ExitList
+var bridgeCert bridgeauth.BridgeCert
+
+// exit lists older than this are not trusted, even when correctly signed
+const exitListMaxAge = time.Hour * 24
+
+// refreshExits fetches the exit list, then keeps refreshing it in the background.
+func refreshExits() {
+	fetch := func() error {
+		el, err := bclient.GetExits(exitListMaxAge)
+		if err != nil {
+			return err
+		}
+		exitsLock.Lock()
+		exitList = el
+		exitsLock.Unlock()
+		log.Println("got", len(el.Exits), "exits from binder")
+		return nil
+	}
+	for {
+		err := fetch()
+		if err == nil {
+			break
+		}
+		log.Println("error getting exit list, retrying:", err)
+		time.Sleep(time.Second * 10)
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute * 10)
+			if err := fetch(); err != nil {
+				log.Println("error refreshing exit list:", err)
+			}
+		}
+	}()
+}
+
+func findExit(name string) (bridgeauth.ExitInfo, bool) {
+	exitsLock.RLock()
+	defer exitsLock.RUnlock()
+	if time.Since(time.Unix(int64(exitList.Issued), 0)) > exitListMaxAge {
+		return bridgeauth.ExitInfo{}, false
+	}
+	return exitList.Find(name)
+}
+
+// how many pooled connections to keep to each exit
+const poolSize = 2
+
+// how long to wait before dialing an exit again after failing to, doubling up to poolBackoffMax
+const (
+	poolBackoffMin = time.Second
+	poolBackoffMax = time.Minute
+)
+
+var errNoPooled = errors.New("no pooled connection to exit")
+
+// pooled connections to an exit
+type exitConns struct {
+	lock     sync.Mutex
+	sessions []*flowmux.Session
+	dialing  chan struct{} // closed when the dial in flight finishes; nil if there is none
+	lastErr  error
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+var poolLock sync.Mutex
+var pool = make(map[string]*exitConns)
+
+// dialExit opens a flow to an exit on behalf of a client, over a pooled connection.
+func dialExit(exit bridgeauth.ExitInfo, clientAddr string) (net.Conn, error) {
+	poolLock.Lock()
+	ec, ok := pool[exit.Addr]
+	if !ok {
+		ec = new(exitConns)
+		pool[exit.Addr] = ec
+	}
+	poolLock.Unlock()
+	sess, err := ec.get(exit)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open(clientAddr)
+}
+
+// get returns the least loaded live connection, growing the pool in the background if there are fewer than poolSize. It only waits for a dial when there is no live connection at all.
+func (ec *exitConns) get(exit bridgeauth.ExitInfo) (*flowmux.Session, error) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.prune()
+	if len(ec.sessions) < poolSize {
+		ec.grow(exit)
+	}
+	if len(ec.sessions) == 0 {
+		done := ec.dialing
+		if done == nil {
+			// still backing off from the last failure
+			return nil, ec.lastErr
+		}
+		ec.lock.Unlock()
+		<-done
+		ec.lock.Lock()
+		ec.prune()
+		if len(ec.sessions) == 0 {
+			if ec.lastErr != nil {
+				return nil, ec.lastErr
+			}
+			return nil, errNoPooled
+		}
+	}
+	best := ec.sessions[0]
+	for _, sess := range ec.sessions[1:] {
+		if sess.NumFlows() < best.NumFlows() {
+			best = sess
+		}
+	}
+	return best, nil
+}
+
+// prune drops closed connections. The caller holds ec.lock.
+func (ec *exitConns) prune() {
+	live := ec.sessions[:0]
+	for _, sess := range ec.sessions {
+		if !sess.IsClosed() {
+			live = append(live, sess)
+		}
+	}
+	ec.sessions = live
+}
+
+// grow starts dialing another connection, unless a dial is already in flight or we are backing off. The caller holds ec.lock.
+func (ec *exitConns) grow(exit bridgeauth.ExitInfo) {
+	if ec.dialing != nil || time.Now().Before(ec.retryAt) {
+		return
+	}
+	done := make(chan struct{})
+	ec.dialing = done
+	go func() {
+		sess, err := dialPooled(exit)
+		ec.lock.Lock()
+		defer ec.lock.Unlock()
+		ec.dialing = nil
+		close(done)
+		if err != nil {
+			log.Println("cannot grow pool to", exit.Name, err)
+			ec.lastErr = err
+			ec.backoff *= 2
+			if ec.backoff < poolBackoffMin {
+				ec.backoff = poolBackoffMin
+			} else if ec.backoff > poolBackoffMax {
+				ec.backoff = poolBackoffMax
+			}
+			ec.retryAt = time.Now().Add(ec.backoff)
+			return
+		}
+		ec.lastErr = nil
+		ec.backoff = 0
+		ec.retryAt = time.Time{}
+		ec.sessions = append(ec.sessions, sess)
+	}()
+}
+
+// dialPooled makes a new pooled connection to an exit and authenticates us to it.
+var dialPooled = func(exit bridgeauth.ExitInfo) (*flowmux.Session, error) {
+	exitsLock.RLock()
+	cert := bridgeCert
+	exitsLock.RUnlock()
+	remote, err := net.DialTimeout("tcp", exit.Addr, time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	remote.SetDeadline(time.Now().Add(time.Second * 30))
+	if err := bridgeauth.DialMux(remote, cert, bridgeSK); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	remote.SetDeadline(time.Time{})
+	log.Println("new pooled connection to", exit.Name)
+	return flowmux.Client(remote), nil
+}
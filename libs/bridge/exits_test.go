@@ -0,0 +1,78 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/flowmux"
+)
+
+func TestExitPool(t *testing.T) {
+	var dials int32
+	results := make(chan error)
+	defer func(dp func(bridgeauth.ExitInfo) (*flowmux.Session, error)) { dialPooled = dp }(dialPooled)
+	dialPooled = func(bridgeauth.ExitInfo) (*flowmux.Session, error) {
+		atomic.AddInt32(&dials, 1)
+		if err := <-results; err != nil {
+			return nil, err
+		}
+		conn, _ := net.Pipe()
+		return flowmux.Client(conn), nil
+	}
+	ec := new(exitConns)
+	exit := bridgeauth.ExitInfo{Name: "pool.test"}
+
+	// callers with nothing to use share a single dial
+	var wg sync.WaitGroup
+	sessions := make([]*flowmux.Session, 5)
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sessions[i], _ = ec.get(exit)
+		}(i)
+	}
+	time.Sleep(time.Millisecond * 100)
+	results <- nil
+	wg.Wait()
+	for _, sess := range sessions {
+		if sess == nil || sess != sessions[0] {
+			t.Fatal("callers didn't share the dial")
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatal("dialed", n, "times for one connection")
+	}
+	// a live connection is handed out while the pool grows
+	got := make(chan *flowmux.Session)
+	go func() {
+		sess, _ := ec.get(exit)
+		got <- sess
+	}()
+	select {
+	case sess := <-got:
+		if sess != sessions[0] {
+			t.Fatal("wrong connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waited for the pool to grow")
+	}
+	// failing to grow it backs off
+	results <- errors.New("unreachable")
+	time.Sleep(time.Millisecond * 100)
+	if sess, err := ec.get(exit); err != nil || sess != sessions[0] {
+		t.Fatal("lost the live connection:", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("dialed again without backing off")
+	}
+	sessions[0].Close()
+	if _, err := ec.get(exit); err == nil || err.Error() != "unreachable" {
+		t.Fatal("dead pool gave", err)
+	}
+}
@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+// loadSampler measures load between successive registrations.
+type loadSampler struct {
+	lastTime  time.Time
+	lastBytes uint64
+	lastIdle  uint64
+	lastTotal uint64
+}
+
+// sample returns the load since the previous sample.
+func (ls *loadSampler) sample() bridgeauth.BridgeLoad {
+	now := time.Now()
+	bytes := atomic.LoadUint64(&totalBytes)
+	load := bridgeauth.BridgeLoad{
+		Clients:     uint64(atomic.LoadInt64(&activeConns)),
+		CPUHeadroom: 100,
+	}
+	if !ls.lastTime.IsZero() {
+		if secs := now.Sub(ls.lastTime).Seconds(); secs > 0 {
+			load.Bandwidth = uint64(float64(bytes-ls.lastBytes) / secs)
+		}
+	}
+	idle, total, ok := cpuTimes()
+	if ok && total > ls.lastTotal {
+		load.CPUHeadroom = 100 * (idle - ls.lastIdle) / (total - ls.lastTotal)
+	}
+	ls.lastTime, ls.lastBytes = now, bytes
+	ls.lastIdle, ls.lastTotal = idle, total
+	return load
+}
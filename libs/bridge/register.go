@@ -0,0 +1,65 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+// our identity towards the binder and exits, derived from the cookie seed so that it survives restarts
+var bridgePK ed25519.PublicKey
+var bridgeSK ed25519.PrivateKey
+
+// registerInterval is how often we register with the binder. Every registration reports our load and renews our certificate.
+var registerInterval = time.Minute * 2
+
+var loadStats loadSampler
+
+// registerNow makes the registration loop register right away, for instance when our cookie changes
+var registerNow = make(chan bool, 1)
+
+// register sends a signed descriptor to the binder and keeps the certificate it returns.
+func register(hosts []string) error {
+	desc := bridgeauth.BridgeDescriptor{
+		Cookie:     currentCookie(),
+		Hosts:      hosts,
+		AllocGroup: allocGroup,
+		Capacity:   capacity,
+		Load:       loadStats.sample(),
+		Version:    GitVersion,
+	}
+	desc.Sign(bridgeSK)
+	cert, err := bclient.AddBridge(binderKey, desc)
+	if err != nil {
+		return err
+	}
+	if err := cert.Verify(binderMPK); err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Key, bridgePK) {
+		return errors.New("binder certified the wrong key")
+	}
+	exitsLock.Lock()
+	bridgeCert = cert
+	exitsLock.Unlock()
+	return nil
+}
+
+// registerLoop registers with the binder forever, retrying sooner when registration fails.
+func registerLoop(hosts []string) {
+	for {
+		interval := registerInterval
+		if err := register(hosts); err != nil {
+			log.Println("error adding bridge:", err)
+			interval = registerInterval / 10
+		}
+		select {
+		case <-time.After(interval):
+		case <-registerNow:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+var testHosts = []string{"127.0.0.1:12345", "[::1]:443"}
+
+func TestRegister(t *testing.T) {
+	exitsLock.Lock()
+	first := bridgeCert
+	exitsLock.Unlock()
+	if !bytes.Equal(first.Key, bridgePK) {
+		t.Fatal("certificate is not for our identity")
+	}
+	time.Sleep(time.Second)
+	if err := register(testHosts); err != nil {
+		t.Fatal(err)
+	}
+	exitsLock.Lock()
+	renewed := bridgeCert
+	exitsLock.Unlock()
+	if renewed.Expires <= first.Expires {
+		t.Fatal("registering again did not renew the certificate")
+	}
+	var desc bridgeauth.BridgeDescriptor
+	for _, d := range testBinder.Bridges() {
+		if bytes.Equal(d.Key, bridgePK) {
+			desc = d
+		}
+	}
+	if len(desc.Hosts) != 2 || desc.Hosts[1] != testHosts[1] || desc.Capacity != capacity || !bytes.Equal(desc.Cookie, cookie) {
+		t.Fatalf("binder got a wrong descriptor: %+v", desc)
+	}
+	if desc.Load.CPUHeadroom > 100 {
+		t.Fatal("bad CPU headroom", desc.Load.CPUHeadroom)
+	}
+	// known identities re-register without the secret
+	binderKey = ""
+	defer func() { binderKey = "secret" }()
+	if err := register(testHosts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterUnknownIdentity(t *testing.T) {
+	oldSeed, oldKey := cookieSeed, binderKey
+	oldCert := bridgeCert
+	defer func() {
+		cookieSeed, binderKey = oldSeed, oldKey
+		generateCookie()
+		bridgeCert = oldCert
+	}()
+	cookieSeed = "someone else"
+	binderKey = "wrong"
+	generateCookie()
+	if err := register([]string{"127.0.0.1:23456"}); err == nil {
+		t.Fatal("binder enrolled a new identity without the secret")
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		udpsock, host, err := listenUDP(addr)
+		if err != nil {
+			if addr == "[::1]:0" {
+				t.Log("no IPv6 here:", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		defer udpsock.Close()
+		if host != udpsock.LocalAddr().String() {
+			t.Fatalf("listening on %v, but advertising %v", udpsock.LocalAddr(), host)
+		}
+	}
+	if _, _, err := listenUDP("nonsense"); err == nil {
+		t.Fatal("listened on a nonsense address")
+	}
+}
@@ -0,0 +1,169 @@
+package bridge
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/cwl"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/metrics"
+	"golang.org/x/time/rate"
+)
+
+// limits on how clients may use the control protocol; variables so that tests can tighten them
+var (
+	// firstCommandTimeout is how long a new client has to send its first command
+	firstCommandTimeout = time.Second * 10
+	// commandTimeout is how long a client may idle between commands
+	commandTimeout = time.Minute
+	// maxCommands is how many commands a client may send on one connection
+	maxCommands = 16
+)
+
+// serveClient runs the control protocol for one client, relaying it to an exit or another bridge if it asks.
+func serveClient(client *kcp.UDPSession) (err error) {
+	defer client.Close()
+	// conn is what the client speaks over, which changes once it seals the connection
+	var conn net.Conn = client
+	sealed := false
+	conn.SetDeadline(time.Now().Add(firstCommandTimeout))
+	for i := 0; ; i++ {
+		var req bridgeproto.Request
+		req, err = bridgeproto.ReadRequest(conn)
+		if err != nil {
+			// only answer requests that actually arrived; silence and timeouts get silence back
+			if _, ok := err.(bridgeproto.MalformedError); ok {
+				bridgeproto.RefuseMalformed(conn)
+			}
+			return
+		}
+		if i >= maxCommands {
+			req.Reply(conn, bridgeproto.ErrTooManyCommands)
+			return fmt.Errorf("more than %v commands", maxCommands)
+		}
+		if req.Version > bridgeproto.Version {
+			req.Reply(conn, bridgeproto.ErrUnsupportedVersion)
+			return fmt.Errorf("unsupported version %v", req.Version)
+		}
+		switch req.Canonical() {
+		case bridgeproto.CmdPing:
+			if err = req.Reply(conn, ""); err != nil || !req.KeepAlive() {
+				return
+			}
+		case bridgeproto.CmdSeal:
+			if sealed || req.Version == 0 {
+				req.Reply(conn, bridgeproto.ErrBadRequest)
+				return errors.New("bad seal request")
+			}
+			if err = req.Reply(conn, ""); err != nil {
+				return
+			}
+			if conn, err = bridgeproto.AcceptSeal(client, bridgeSK); err != nil {
+				return
+			}
+			sealed = true
+		case bridgeproto.CmdConn:
+			return relayClient(client, conn, req)
+		default:
+			req.Reply(conn, bridgeproto.ErrUnknownCommand)
+			return fmt.Errorf("unknown command %q", req.Command)
+		}
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+	}
+}
+
+// relayClient connects a client to the exit or bridge it asked for and relays until either side hangs up.
+func relayClient(client *kcp.UDPSession, conn net.Conn, req bridgeproto.Request) error {
+	var target string
+	var dial func() (net.Conn, error)
+	switch len(req.Args) {
+	case 1:
+		exit, ok := findExit(req.Args[0])
+		if !ok {
+			req.Reply(conn, bridgeproto.ErrBadExit)
+			return fmt.Errorf("not an exit: %v", req.Args[0])
+		}
+		target = exit.Addr
+		dial = func() (net.Conn, error) {
+			return dialExit(exit, client.RemoteAddr().String())
+		}
+	case 3:
+		cookie, err := hex.DecodeString(req.Args[1])
+		if err != nil || len(cookie) != 32 || req.Version == 0 {
+			req.Reply(conn, bridgeproto.ErrBadRequest)
+			return fmt.Errorf("bad bridge cookie %q", req.Args[1])
+		}
+		cert, err := decodeCert(req.Args[2])
+		if err != nil {
+			req.Reply(conn, bridgeproto.ErrBadRequest)
+			return err
+		}
+		if err := checkHop(req.Args[0]); err != nil {
+			req.Reply(conn, bridgeproto.ErrBadRequest)
+			return err
+		}
+		target = req.Args[0]
+		dial = func() (net.Conn, error) {
+			return dialNextBridge(target, cookie, cert.Key)
+		}
+	default:
+		req.Reply(conn, bridgeproto.ErrBadRequest)
+		return fmt.Errorf("conn with %v args", len(req.Args))
+	}
+	// reserve a slot before dialing, so that a burst of clients can't overshoot the cap
+	conns := atomic.AddInt64(&activeConns, 1)
+	defer func() {
+		metricSink.Gauge(metrics.Streams, float64(atomic.AddInt64(&activeConns, -1)))
+	}()
+	if uint64(conns) > capacity {
+		req.Reply(conn, bridgeproto.ErrFull)
+		return fmt.Errorf("at capacity with %v clients", capacity)
+	}
+	dialStart := time.Now()
+	remote, err := dial()
+	if err != nil {
+		req.Reply(conn, bridgeproto.ErrDialFailed)
+		return err
+	}
+	defer remote.Close()
+	metricSink.Timing(metrics.DialLatency, time.Since(dialStart))
+	log.Println("connected to", target)
+	if err := req.Reply(conn, ""); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	metricSink.Gauge(metrics.Streams, float64(conns))
+	// report stats in the background
+	statsDone := make(chan bool)
+	defer close(statsDone)
+	go func() {
+		for {
+			select {
+			case <-statsDone:
+				return
+			case <-time.After(time.Millisecond * time.Duration(rand.ExpFloat64()*3000)):
+				btlBw, latency, _ := client.FlowStats()
+				metricSink.Timing("client.latency", time.Duration(latency*float64(time.Millisecond)))
+				metricSink.Gauge("client.btlbw", btlBw)
+			}
+		}
+	}()
+	onPacket := func(l int) {
+		countBytes(int64(l))
+		atomic.AddUint64(&totalBytes, uint64(l))
+	}
+	go func() {
+		defer remote.Close()
+		defer conn.Close()
+		cwl.CopyWithLimit(remote, conn, rate.NewLimiter(rate.Inf, 0), onPacket)
+	}()
+	cwl.CopyWithLimit(conn, remote, rate.NewLimiter(rate.Inf, 0), onPacket)
+	return nil
+}
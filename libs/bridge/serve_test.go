@@ -0,0 +1,333 @@
+package bridge
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bdclient/bdtest"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/flowmux"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/xtaci/lossyconn"
+)
+
+const testExit = "test.exits.geph.io"
+
+var testCookie = make([]byte, 32)
+
+var testBinder *bdtest.Binder
+var testBinderURL string
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(bridgeProcessEnv); args != "" {
+		// we are a bridge started by startBridgeProcess, chaining to others on this machine
+		allowLocalHops = true
+		Main(strings.Fields(args))
+		return
+	}
+	firstCommandTimeout = time.Millisecond * 500
+	commandTimeout = time.Millisecond * 500
+	maxCommands = 4
+	capacity = 1000
+	// register with a fake binder that allowlists a fake exit echoing every flow
+	exitListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go fakeExit(exitListener)
+	testBinder = bdtest.New("secret")
+	testBinder.AddExit(bridgeauth.ExitInfo{Name: testExit, Addr: exitListener.Addr().String()})
+	srv := httptest.NewServer(testBinder)
+	testBinderURL = srv.URL
+	bclient = bdclient.NewClient(srv.URL, "binder.test")
+	binderKey = "secret"
+	binderMPK = testBinder.MPK()
+	bclient.PinMasterKey(binderMPK)
+	cookieSeed = "test"
+	generateCookie()
+	refreshExits()
+	if err := register(testHosts); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+func fakeExit(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, bridge, err := bridgeauth.Accept(conn, binderMPK)
+			if err != nil || bridge == nil || !bridge.Multiplexed {
+				conn.Close()
+				return
+			}
+			sess := flowmux.Server(conn)
+			for {
+				flow, err := sess.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(flow, flow)
+			}
+		}()
+	}
+}
+
+// testBridge runs serveClient on every session accepted over an in-memory niaucchi4 socket.
+type testBridge struct {
+	addr    net.Addr
+	results chan error
+}
+
+func newTestBridge(t testing.TB) *testBridge {
+	wire, err := lossyconn.NewLossyConn(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &testBridge{addr: wire.LocalAddr(), results: make(chan error, 100)}
+	listener := niaucchi4.Listen(niaucchi4.ObfsListen(testCookie, wire))
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tb.results <- serveClient(client)
+			}()
+		}
+	}()
+	return tb
+}
+
+// dial connects a new client to the bridge. Since KCP has no handshake, the bridge only sees it once it sends something.
+func (tb *testBridge) dial(t testing.TB) *kcp.UDPSession {
+	wire, err := lossyconn.NewLossyConn(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := kcp.NewConn2(tb.addr, nil, 0, 0, niaucchi4.ObfsListen(testCookie, wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetNoDelay(0, 50, 3, 0)
+	conn.SetStreamMode(true)
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	return conn
+}
+
+// result waits for the bridge to be done with a client.
+func (tb *testBridge) result(t testing.TB, within time.Duration) error {
+	select {
+	case err := <-tb.results:
+		return err
+	case <-time.After(within):
+		t.Fatal("bridge still serving a client after", within)
+		return nil
+	}
+}
+
+func expectRefusal(t *testing.T, err error, reason string) {
+	t.Helper()
+	if err != (bridgeproto.RefusedError{Reason: reason}) {
+		t.Fatalf("expected refusal %v, got %v", reason, err)
+	}
+}
+
+func TestPingAndConn(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	for i := 0; i < maxCommands-1; i++ {
+		if err := bridgeproto.Ping(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bridgeproto.Connect(conn, testExit); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello exit"))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello exit" {
+		t.Fatalf("relay broken: %q %v", buf, err)
+	}
+}
+
+func TestBadExit(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	expectRefusal(t, bridgeproto.Connect(conn, "evil.example.com"), bridgeproto.ErrBadExit)
+	expectRefusal(t, bridgeproto.Do(tb.dial(t), bridgeproto.CmdConn), bridgeproto.ErrBadRequest)
+	tb.result(t, time.Second)
+	tb.result(t, time.Second)
+}
+
+func TestFull(t *testing.T) {
+	oldCapacity := capacity
+	// relays from other tests may still be running
+	capacity = uint64(atomic.LoadInt64(&activeConns)) + 1
+	defer func() { capacity = oldCapacity }()
+	tb := newTestBridge(t)
+	first := tb.dial(t)
+	defer first.Close()
+	if err := bridgeproto.Connect(first, testExit); err != nil {
+		t.Fatal(err)
+	}
+	// a full bridge still answers pings, but refuses to relay
+	second := tb.dial(t)
+	defer second.Close()
+	if err := bridgeproto.Ping(second); err != nil {
+		t.Fatal(err)
+	}
+	expectRefusal(t, bridgeproto.Connect(second, testExit), bridgeproto.ErrFull)
+	if tb.result(t, time.Second) == nil {
+		t.Fatal("expected an error from serveClient")
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	expectRefusal(t, bridgeproto.Do(conn, "frobnicate"), bridgeproto.ErrUnknownCommand)
+	if tb.result(t, time.Second) == nil {
+		t.Fatal("expected an error from serveClient")
+	}
+	conn = tb.dial(t)
+	defer conn.Close()
+	rlp.Encode(conn, bridgeproto.Request{Version: bridgeproto.Version + 1, Command: bridgeproto.CmdPing})
+	var resp bridgeproto.Response
+	rlp.Decode(conn, &resp)
+	expectRefusal(t, resp.Err(), bridgeproto.ErrUnsupportedVersion)
+}
+
+func TestMalformed(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	conn.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	var resp bridgeproto.Response
+	if err := rlp.Decode(conn, &resp); err != nil {
+		t.Fatal(err)
+	}
+	expectRefusal(t, resp.Err(), bridgeproto.ErrBadRequest)
+	tb.result(t, time.Second)
+}
+
+func TestTooManyCommands(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	for i := 0; i < maxCommands; i++ {
+		if err := bridgeproto.Ping(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRefusal(t, bridgeproto.Ping(conn), bridgeproto.ErrTooManyCommands)
+	tb.result(t, time.Second)
+}
+
+func TestDeadlines(t *testing.T) {
+	tb := newTestBridge(t)
+	// half a request, then nothing
+	conn := tb.dial(t)
+	defer conn.Close()
+	conn.Write([]byte{0xc8})
+	start := time.Now()
+	tb.result(t, firstCommandTimeout*4)
+	if time.Since(start) < firstCommandTimeout/2 {
+		t.Fatal("bridge gave up too early")
+	}
+	// without saying anything that would give it away
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if n, _ := conn.Read(make([]byte, 1)); n > 0 {
+		t.Fatal("bridge answered a client that timed out")
+	}
+	// idling after a ping
+	conn = tb.dial(t)
+	defer conn.Close()
+	if err := bridgeproto.Ping(conn); err != nil {
+		t.Fatal(err)
+	}
+	tb.result(t, commandTimeout*4)
+}
+
+func TestLegacy(t *testing.T) {
+	tb := newTestBridge(t)
+	conn := tb.dial(t)
+	defer conn.Close()
+	var pong string
+	rlp.Encode(conn, "ping/repeat")
+	if err := rlp.Decode(conn, &pong); err != nil || pong != "ping" {
+		t.Fatal("legacy ping/repeat broken:", pong, err)
+	}
+	rlp.Encode(conn, "conn/feedback")
+	rlp.Encode(conn, testExit)
+	var feedback uint
+	if err := rlp.Decode(conn, &feedback); err != nil {
+		t.Fatal("legacy conn/feedback broken:", err)
+	}
+	// legacy ping closes the connection
+	conn = tb.dial(t)
+	defer conn.Close()
+	rlp.Encode(conn, "ping")
+	if err := rlp.Decode(conn, &pong); err != nil || pong != "ping" {
+		t.Fatal("legacy ping broken:", pong, err)
+	}
+	if err := tb.result(t, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FuzzServeClient checks that whatever a client sends, the bridge neither crashes nor hangs on to it.
+func FuzzServeClient(f *testing.F) {
+	seed := func(vals ...interface{}) []byte {
+		buf := new(bytes.Buffer)
+		for _, v := range vals {
+			rlp.Encode(buf, v)
+		}
+		return buf.Bytes()
+	}
+	ping := bridgeproto.Request{Version: bridgeproto.Version, Command: bridgeproto.CmdPing}
+	f.Add(seed(ping))
+	f.Add(seed(ping, ping, ping, ping, ping, ping))
+	f.Add(seed(bridgeproto.Request{Version: bridgeproto.Version, Command: bridgeproto.CmdConn, Args: []string{"a", "b"}}))
+	f.Add(seed(bridgeproto.Request{Version: 1000, Command: "x"}))
+	f.Add(seed("ping/repeat", "ping/repeat", "conn"))
+	f.Add(seed("conn/feedback", []string{"a"}))
+	f.Add(seed([]interface{}{uint(1), []string{"ping"}}))
+	f.Add([]byte{0xf8})
+	f.Add([]byte{0xc0})
+	tb := newTestBridge(f)
+	bound := firstCommandTimeout + commandTimeout*time.Duration(maxCommands) + time.Second*2
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		conn := tb.dial(t)
+		defer conn.Close()
+		conn.Write(data)
+		if bytes.Contains(data, []byte(testExit)) {
+			// may legitimately end up relaying to the exit
+			return
+		}
+		tb.result(t, bound)
+	})
+}
@@ -0,0 +1,384 @@
+// Package bridgeauth implements the signed statements that bridges, exits and the binder use to trust each other: the descriptors bridges register with, the exit allowlist that bridges forward to, and the certificates that bridges present to exits.
+package bridgeauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// domain separators for everything signed in this package
+const (
+	exitListCtx   = "geph-exit-list-1"
+	exitDirCtx    = "geph-exit-dir-1"
+	exitDescCtx   = "geph-exit-desc-1"
+	bridgeCertCtx = "geph-bridge-cert-1"
+	bridgeAuthCtx = "geph-bridge-auth-1"
+	bridgeDescCtx = "geph-bridge-desc-1"
+)
+
+// ExitInfo describes an exit that bridges may forward to.
+type ExitInfo struct {
+	// Name is the hostname that clients ask bridges to connect to.
+	Name string
+	// Addr is the host:port bridges should actually dial.
+	Addr string
+	// Key is the exit's long-term ed25519 public key.
+	Key []byte
+}
+
+// ExitList is a list of exits signed by the binder's master key.
+type ExitList struct {
+	Exits     []ExitInfo
+	Issued    uint64
+	Signature []byte
+}
+
+func (el ExitList) signedMsg() []byte {
+	body, _ := rlp.EncodeToBytes([]interface{}{el.Exits, el.Issued})
+	return append([]byte(exitListCtx), body...)
+}
+
+// Sign signs the list with the binder's master key, setting Issued to now.
+func (el *ExitList) Sign(sk ed25519.PrivateKey) {
+	el.Issued = uint64(time.Now().Unix())
+	el.Signature = ed25519.Sign(sk, el.signedMsg())
+}
+
+// Verify checks the list's signature, and that it was issued no longer than maxAge ago so that a stale list can't be replayed to resurrect a removed exit.
+func (el ExitList) Verify(mpk ed25519.PublicKey, maxAge time.Duration) error {
+	if len(mpk) != ed25519.PublicKeySize || !ed25519.Verify(mpk, el.signedMsg(), el.Signature) {
+		return errors.New("bad signature on exit list")
+	}
+	if time.Since(time.Unix(int64(el.Issued), 0)) > maxAge {
+		return errors.New("exit list is stale")
+	}
+	return nil
+}
+
+// Find looks up an exit by name.
+func (el ExitList) Find(name string) (ExitInfo, bool) {
+	for _, e := range el.Exits {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return ExitInfo{}, false
+}
+
+// ExitEntry describes an exit to clients choosing one.
+type ExitEntry struct {
+	Name string
+	Addr string
+	Key  []byte
+	// Region is where the exit is, as a short code like "us-sfo".
+	Region string
+	// Tiers are the tiers whose users the exit accepts.
+	Tiers []string
+	// Load is how busy the exit is, from 0 to 100.
+	Load uint64
+	// Caps are the capabilities the exit offers clients, as in exitproto.
+	Caps []string
+}
+
+// Info returns what bridges need to know about the exit.
+func (ee ExitEntry) Info() ExitInfo {
+	return ExitInfo{Name: ee.Name, Addr: ee.Addr, Key: ee.Key}
+}
+
+// Accepts says whether the exit accepts users of a tier.
+func (ee ExitEntry) Accepts(tier string) bool {
+	for _, t := range ee.Tiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitDirectory is the list of exits that clients choose from, signed by the binder's master key. It is separate from ExitList so that bridges that only know ExitList can still check its signature.
+type ExitDirectory struct {
+	Exits     []ExitEntry
+	Issued    uint64
+	Signature []byte
+}
+
+func (ed ExitDirectory) signedMsg() []byte {
+	body, _ := rlp.EncodeToBytes([]interface{}{ed.Exits, ed.Issued})
+	return append([]byte(exitDirCtx), body...)
+}
+
+// Sign signs the directory with the binder's master key, setting Issued to now.
+func (ed *ExitDirectory) Sign(sk ed25519.PrivateKey) {
+	ed.Issued = uint64(time.Now().Unix())
+	ed.Signature = ed25519.Sign(sk, ed.signedMsg())
+}
+
+// Verify checks the directory's signature, and that it was issued no longer than maxAge ago.
+func (ed ExitDirectory) Verify(mpk ed25519.PublicKey, maxAge time.Duration) error {
+	if len(mpk) != ed25519.PublicKeySize || !ed25519.Verify(mpk, ed.signedMsg(), ed.Signature) {
+		return errors.New("bad signature on exit directory")
+	}
+	if time.Since(time.Unix(int64(ed.Issued), 0)) > maxAge {
+		return errors.New("exit directory is stale")
+	}
+	return nil
+}
+
+// ExitDescriptor is what an exit registers with the binder. It is signed by the exit's own key, which is Exit.Key.
+type ExitDescriptor struct {
+	Exit      ExitEntry
+	Timestamp uint64
+	Signature []byte
+}
+
+func (xd ExitDescriptor) signedMsg() []byte {
+	body, _ := rlp.EncodeToBytes([]interface{}{xd.Exit, xd.Timestamp})
+	return append([]byte(exitDescCtx), body...)
+}
+
+// Sign sets the descriptor's key and timestamp, and signs it.
+func (xd *ExitDescriptor) Sign(sk ed25519.PrivateKey) {
+	xd.Exit.Key = sk.Public().(ed25519.PublicKey)
+	xd.Timestamp = uint64(time.Now().Unix())
+	xd.Signature = ed25519.Sign(sk, xd.signedMsg())
+}
+
+// Verify checks the descriptor's signature, and that it was signed within maxAge of now, so that old descriptors can't be replayed.
+func (xd ExitDescriptor) Verify(maxAge time.Duration) error {
+	if len(xd.Exit.Key) != ed25519.PublicKeySize || !ed25519.Verify(xd.Exit.Key, xd.signedMsg(), xd.Signature) {
+		return errors.New("bad signature on exit descriptor")
+	}
+	skew := time.Since(time.Unix(int64(xd.Timestamp), 0))
+	if skew > maxAge || skew < -maxAge {
+		return errors.New("exit descriptor timestamp out of range")
+	}
+	return nil
+}
+
+// BridgeCert certifies a bridge's ed25519 key. It is issued by the binder to bridges that know a bridge key.
+type BridgeCert struct {
+	Key       []byte
+	Expires   uint64
+	Signature []byte
+}
+
+func (bc BridgeCert) signedMsg() []byte {
+	body, _ := rlp.EncodeToBytes([]interface{}{bc.Key, bc.Expires})
+	return append([]byte(bridgeCertCtx), body...)
+}
+
+// NewBridgeCert issues a certificate for a bridge key, valid for the given duration.
+func NewBridgeCert(sk ed25519.PrivateKey, bridgeKey ed25519.PublicKey, valid time.Duration) BridgeCert {
+	bc := BridgeCert{
+		Key:     bridgeKey,
+		Expires: uint64(time.Now().Add(valid).Unix()),
+	}
+	bc.Signature = ed25519.Sign(sk, bc.signedMsg())
+	return bc
+}
+
+// Verify checks the certificate's signature and expiry.
+func (bc BridgeCert) Verify(mpk ed25519.PublicKey) error {
+	if len(mpk) != ed25519.PublicKeySize || len(bc.Key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(mpk, bc.signedMsg(), bc.Signature) {
+		return errors.New("bad signature on bridge certificate")
+	}
+	if uint64(time.Now().Unix()) > bc.Expires {
+		return errors.New("bridge certificate expired")
+	}
+	return nil
+}
+
+// BridgeDescriptor is what a bridge registers with the binder. It is signed by the bridge's own identity key.
+type BridgeDescriptor struct {
+	Key    []byte
+	Cookie []byte
+	// Hosts are the addresses the bridge listens on, all reachable with the same cookie.
+	Hosts      []string
+	AllocGroup string
+	// Capacity is how many clients the bridge is willing to carry at once.
+	Capacity  uint64
+	Load      BridgeLoad
+	Version   string
+	Timestamp uint64
+	Signature []byte
+}
+
+// BridgeLoad is how busy a bridge was when it signed its descriptor.
+type BridgeLoad struct {
+	// Clients is how many clients the bridge is relaying.
+	Clients uint64
+	// Bandwidth is the bridge's average throughput since its last registration, in bytes per second.
+	Bandwidth uint64
+	// CPUHeadroom is the percentage of CPU time left idle since the last registration. Bridges that can't tell report 100.
+	CPUHeadroom uint64
+}
+
+// Saturated returns whether the bridge should not be given any more clients.
+func (bd BridgeDescriptor) Saturated() bool {
+	return bd.Load.Clients >= bd.Capacity || bd.Load.CPUHeadroom < minCPUHeadroom
+}
+
+// Utilization returns how close the bridge is to saturation, from 0 for an idle bridge to 1 for a saturated one.
+func (bd BridgeDescriptor) Utilization() float64 {
+	if bd.Saturated() {
+		return 1
+	}
+	byClients := float64(bd.Load.Clients) / float64(bd.Capacity)
+	byCPU := float64(100-bd.Load.CPUHeadroom) / float64(100-minCPUHeadroom)
+	if byCPU > byClients {
+		return byCPU
+	}
+	return byClients
+}
+
+// bridges with less idle CPU than this, in percent, are saturated
+const minCPUHeadroom = 5
+
+func (bd BridgeDescriptor) signedMsg() []byte {
+	body, _ := rlp.EncodeToBytes([]interface{}{bd.Key, bd.Cookie, bd.Hosts, bd.AllocGroup,
+		bd.Capacity, bd.Load, bd.Version, bd.Timestamp})
+	return append([]byte(bridgeDescCtx), body...)
+}
+
+// Sign sets the descriptor's key and timestamp, and signs it.
+func (bd *BridgeDescriptor) Sign(sk ed25519.PrivateKey) {
+	bd.Key = sk.Public().(ed25519.PublicKey)
+	bd.Timestamp = uint64(time.Now().Unix())
+	bd.Signature = ed25519.Sign(sk, bd.signedMsg())
+}
+
+// Verify checks the descriptor's signature, and that it was signed within maxAge of now, so that old descriptors can't be replayed.
+func (bd BridgeDescriptor) Verify(maxAge time.Duration) error {
+	if len(bd.Key) != ed25519.PublicKeySize || !ed25519.Verify(bd.Key, bd.signedMsg(), bd.Signature) {
+		return errors.New("bad signature on bridge descriptor")
+	}
+	skew := time.Since(time.Unix(int64(bd.Timestamp), 0))
+	if skew > maxAge || skew < -maxAge {
+		return errors.New("bridge descriptor timestamp out of range")
+	}
+	return nil
+}
+
+// Magic strings that start bridge-authenticated connections. They have the same length as the TinySS greeting, which is what direct clients start with.
+const (
+	// bridgeMagic starts a connection carrying a single client
+	bridgeMagic = "GephBr-1"
+	// bridgeMuxMagic starts a flowmux connection carrying many clients
+	bridgeMuxMagic = "GephBm-1"
+)
+
+const nonceSize = 32
+
+const maxHelloSize = 1024
+
+type bridgeHello struct {
+	Cert BridgeCert
+	Sig  []byte
+}
+
+// Dial authenticates a freshly dialed connection to an exit as coming from the bridge owning sk and cert. Afterwards, the connection carries the client's traffic unchanged.
+func Dial(conn net.Conn, cert BridgeCert, sk ed25519.PrivateKey) error {
+	return dial(conn, bridgeMagic, cert, sk)
+}
+
+// DialMux is like Dial, but afterwards the connection is the client end of a flowmux session, with every flow carrying one client.
+func DialMux(conn net.Conn, cert BridgeCert, sk ed25519.PrivateKey) error {
+	return dial(conn, bridgeMuxMagic, cert, sk)
+}
+
+func dial(conn net.Conn, magic string, cert BridgeCert, sk ed25519.PrivateKey) error {
+	if _, err := io.WriteString(conn, magic); err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	// the hello is length-prefixed, since client data follows right after it and rlp would buffer past its end
+	hello, _ := rlp.EncodeToBytes(bridgeHello{
+		Cert: cert,
+		Sig:  ed25519.Sign(sk, append([]byte(bridgeAuthCtx), nonce...)),
+	})
+	buf := make([]byte, 2, 2+len(hello))
+	binary.BigEndian.PutUint16(buf, uint16(len(hello)))
+	_, err := conn.Write(append(buf, hello...))
+	return err
+}
+
+// Bridge describes an authenticated bridge connection.
+type Bridge struct {
+	Cert BridgeCert
+	// Multiplexed is set if the connection is a flowmux session rather than a single client.
+	Multiplexed bool
+}
+
+// Accept is called by exits on every incoming connection. Connections that don't come from bridges are returned unchanged with a nil Bridge; connections from bridges are authenticated against the binder's master key.
+func Accept(conn net.Conn, mpk ed25519.PublicKey) (net.Conn, *Bridge, error) {
+	magic := make([]byte, len(bridgeMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != bridgeMagic && string(magic) != bridgeMuxMagic {
+		return &prefixConn{Conn: conn, prefix: magic}, nil, nil
+	}
+	if mpk == nil {
+		return nil, nil, errors.New("bridge connection, but no binder key to check it with")
+	}
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	if _, err := conn.Write(nonce); err != nil {
+		return nil, nil, err
+	}
+	lenbuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenbuf); err != nil {
+		return nil, nil, err
+	}
+	hlen := binary.BigEndian.Uint16(lenbuf)
+	if hlen > maxHelloSize {
+		return nil, nil, errors.New("bridge hello too big")
+	}
+	helloBts := make([]byte, hlen)
+	if _, err := io.ReadFull(conn, helloBts); err != nil {
+		return nil, nil, err
+	}
+	var hello bridgeHello
+	if err := rlp.DecodeBytes(helloBts, &hello); err != nil {
+		return nil, nil, err
+	}
+	if err := hello.Cert.Verify(mpk); err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(hello.Cert.Key, append([]byte(bridgeAuthCtx), nonce...), hello.Sig) {
+		return nil, nil, errors.New("bad bridge signature")
+	}
+	return conn, &Bridge{Cert: hello.Cert, Multiplexed: string(magic) == bridgeMuxMagic}, nil
+}
+
+// prefixConn replays bytes that were read to tell bridges from clients.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixConn) Read(p []byte) (int, error) {
+	if len(pc.prefix) > 0 {
+		n := copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(p)
+}
+
+// Fingerprint returns a short printable identifier for a bridge.
+func (bc BridgeCert) Fingerprint() string {
+	return hex.EncodeToString(bc.Key[:8])
+}
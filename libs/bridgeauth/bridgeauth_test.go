@@ -0,0 +1,233 @@
+package bridgeauth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExitList(t *testing.T) {
+	mpk, msk, _ := ed25519.GenerateKey(nil)
+	epk, _, _ := ed25519.GenerateKey(nil)
+	el := ExitList{Exits: []ExitInfo{{Name: "us-sfo-01.exits.geph.io", Addr: "1.2.3.4:2389", Key: epk}}}
+	el.Sign(msk)
+	if err := el.Verify(mpk, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := el.Find("us-sfo-01.exits.geph.io"); !ok {
+		t.Fatal("cannot find exit")
+	}
+	if _, ok := el.Find("evil.example.com"); ok {
+		t.Fatal("found nonexistent exit")
+	}
+	tampered := el
+	tampered.Exits = []ExitInfo{{Name: "us-sfo-01.exits.geph.io", Addr: "6.6.6.6:2389", Key: epk}}
+	if tampered.Verify(mpk, time.Hour) == nil {
+		t.Fatal("tampered list verified")
+	}
+	stale := el
+	stale.Issued -= 7200
+	if stale.Verify(mpk, time.Hour) == nil {
+		t.Fatal("backdated list verified")
+	}
+	otherpk, _, _ := ed25519.GenerateKey(nil)
+	if el.Verify(otherpk, time.Hour) == nil {
+		t.Fatal("list verified under the wrong key")
+	}
+}
+
+func TestExitDirectory(t *testing.T) {
+	mpk, msk, _ := ed25519.GenerateKey(nil)
+	epk, _, _ := ed25519.GenerateKey(nil)
+	entry := ExitEntry{Name: "us-sfo-01.exits.geph.io", Addr: "1.2.3.4:2389", Key: epk, Region: "us-sfo", Tiers: []string{"paid"}, Load: 30}
+	ed := ExitDirectory{Exits: []ExitEntry{entry}}
+	ed.Sign(msk)
+	if err := ed.Verify(mpk, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Accepts("paid") || entry.Accepts("free") {
+		t.Fatal("wrong tiers")
+	}
+	tampered := ed
+	tampered.Exits = []ExitEntry{entry}
+	tampered.Exits[0].Tiers = []string{"free", "paid"}
+	if tampered.Verify(mpk, time.Hour) == nil {
+		t.Fatal("tampered directory verified")
+	}
+	// a directory can't pass for an exit list, or the other way round
+	el := ExitList{Exits: []ExitInfo{entry.Info()}, Issued: ed.Issued, Signature: ed.Signature}
+	if el.Verify(mpk, time.Hour) == nil {
+		t.Fatal("directory signature verified as an exit list")
+	}
+	stale := ed
+	stale.Issued -= 7200
+	if stale.Verify(mpk, time.Hour) == nil {
+		t.Fatal("backdated directory verified")
+	}
+}
+
+func TestExitDescriptor(t *testing.T) {
+	_, esk, _ := ed25519.GenerateKey(nil)
+	xd := ExitDescriptor{
+		Exit: ExitEntry{Name: "us-sfo-01.exits.geph.io", Addr: "1.2.3.4:2389", Region: "us-sfo", Tiers: []string{"free", "paid"}, Caps: []string{"tier"}},
+	}
+	xd.Sign(esk)
+	if err := xd.Verify(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(xd.Exit.Key, esk.Public().(ed25519.PublicKey)) {
+		t.Fatal("signing didn't set the key")
+	}
+	tampered := xd
+	tampered.Exit.Addr = "6.6.6.6:2389"
+	if tampered.Verify(time.Minute) == nil {
+		t.Fatal("tampered descriptor verified")
+	}
+	// someone else can't register under the exit's key
+	other := xd
+	other.Exit.Key = nil
+	_, othersk, _ := ed25519.GenerateKey(nil)
+	other.Sign(othersk)
+	other.Exit.Key = xd.Exit.Key
+	if other.Verify(time.Minute) == nil {
+		t.Fatal("descriptor signed by another key verified")
+	}
+	old := xd
+	old.Timestamp -= 600
+	if old.Verify(time.Minute) == nil {
+		t.Fatal("old descriptor verified")
+	}
+}
+
+func TestBridgeCert(t *testing.T) {
+	mpk, msk, _ := ed25519.GenerateKey(nil)
+	bpk, _, _ := ed25519.GenerateKey(nil)
+	if err := NewBridgeCert(msk, bpk, time.Hour).Verify(mpk); err != nil {
+		t.Fatal(err)
+	}
+	if NewBridgeCert(msk, bpk, -time.Hour).Verify(mpk) == nil {
+		t.Fatal("expired cert verified")
+	}
+	_, othersk, _ := ed25519.GenerateKey(nil)
+	if NewBridgeCert(othersk, bpk, time.Hour).Verify(mpk) == nil {
+		t.Fatal("cert from the wrong key verified")
+	}
+}
+
+// accept runs Accept on one end of a pipe, with the bridge side running dial, and returns what the exit reads afterwards.
+func accept(t *testing.T, mpk ed25519.PublicKey, dial func(net.Conn) error) (*Bridge, string, error) {
+	bridge, exit := net.Pipe()
+	defer bridge.Close()
+	go func() {
+		if dial(bridge) == nil {
+			io.WriteString(bridge, "TinySS-1 and the rest")
+		}
+		bridge.Close()
+	}()
+	conn, b, err := Accept(exit, mpk)
+	if err != nil {
+		exit.Close()
+		return nil, "", err
+	}
+	rest, _ := ioutil.ReadAll(conn)
+	return b, string(rest), nil
+}
+
+func TestHandshake(t *testing.T) {
+	mpk, msk, _ := ed25519.GenerateKey(nil)
+	bpk, bsk, _ := ed25519.GenerateKey(nil)
+	cert := NewBridgeCert(msk, bpk, time.Hour)
+	// direct clients pass through untouched
+	got, rest, err := accept(t, mpk, func(net.Conn) error { return nil })
+	if err != nil || got != nil || rest != "TinySS-1 and the rest" {
+		t.Fatal("direct connection mangled:", got, rest, err)
+	}
+	// a good bridge
+	got, rest, err = accept(t, mpk, func(c net.Conn) error { return Dial(c, cert, bsk) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Cert.Fingerprint() != cert.Fingerprint() || got.Multiplexed || rest != "TinySS-1 and the rest" {
+		t.Fatal("bridged connection mangled:", got, rest)
+	}
+	got, _, err = accept(t, mpk, func(c net.Conn) error { return DialMux(c, cert, bsk) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Multiplexed {
+		t.Fatal("multiplexed connection not marked as such")
+	}
+	// a bridge signing with a key that isn't its certificate's
+	_, wrongsk, _ := ed25519.GenerateKey(nil)
+	if _, _, err := accept(t, mpk, func(c net.Conn) error { return Dial(c, cert, wrongsk) }); err == nil {
+		t.Fatal("bridge with the wrong key accepted")
+	}
+	// a bridge with an uncertified key
+	_, othermsk, _ := ed25519.GenerateKey(nil)
+	badCert := NewBridgeCert(othermsk, bpk, time.Hour)
+	if _, _, err := accept(t, mpk, func(c net.Conn) error { return Dial(c, badCert, bsk) }); err == nil {
+		t.Fatal("bridge with a bad certificate accepted")
+	}
+	// exits without a binder key refuse bridges
+	if _, _, err := accept(t, nil, func(c net.Conn) error { return Dial(c, cert, bsk) }); err == nil {
+		t.Fatal("bridge accepted without a binder key")
+	}
+}
+
+func TestBridgeDescriptor(t *testing.T) {
+	_, bsk, _ := ed25519.GenerateKey(nil)
+	bd := BridgeDescriptor{Cookie: make([]byte, 32), Hosts: []string{"1.2.3.4:5678", "[2001:db8::1]:443"}, AllocGroup: "test", Capacity: 100, Version: "1.0"}
+	bd.Sign(bsk)
+	if err := bd.Verify(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bd
+	tampered.Hosts = []string{"6.6.6.6:5678"}
+	if tampered.Verify(time.Minute) == nil {
+		t.Fatal("tampered descriptor verified")
+	}
+	stale := bd
+	stale.Timestamp -= 3600
+	if stale.Verify(time.Minute) == nil {
+		t.Fatal("backdated descriptor verified")
+	}
+	stolen := bd
+	otherpk, _, _ := ed25519.GenerateKey(nil)
+	stolen.Key = otherpk
+	if stolen.Verify(time.Minute) == nil {
+		t.Fatal("descriptor verified under someone else's key")
+	}
+}
+
+func TestBridgeLoad(t *testing.T) {
+	_, bsk, _ := ed25519.GenerateKey(nil)
+	bd := BridgeDescriptor{Capacity: 100, Load: BridgeLoad{Clients: 10, CPUHeadroom: 100}}
+	bd.Sign(bsk)
+	tampered := bd
+	tampered.Load.Clients = 0
+	if tampered.Verify(time.Minute) == nil {
+		t.Fatal("descriptor with tampered load verified")
+	}
+	for _, c := range []struct {
+		load BridgeLoad
+		util float64
+	}{
+		{BridgeLoad{Clients: 0, CPUHeadroom: 100}, 0},
+		{BridgeLoad{Clients: 50, CPUHeadroom: 100}, 0.5},
+		{BridgeLoad{Clients: 10, CPUHeadroom: 62}, 0.4},
+		{BridgeLoad{Clients: 100, CPUHeadroom: 100}, 1},
+		{BridgeLoad{Clients: 0, CPUHeadroom: 2}, 1},
+	} {
+		bd.Load = c.load
+		if u := bd.Utilization(); u < c.util-0.001 || u > c.util+0.001 {
+			t.Errorf("%+v: utilization %v, expected %v", c.load, u, c.util)
+		}
+		if bd.Saturated() != (c.util == 1) {
+			t.Errorf("%+v: wrong saturation", c.load)
+		}
+	}
+}
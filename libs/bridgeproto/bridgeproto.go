@@ -0,0 +1,210 @@
+// Package bridgeproto implements the control protocol that clients and the binder speak to bridges over niaucchi4. Every request gets a response, so that a client always learns why a bridge turned it away.
+package bridgeproto
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Version is the protocol version implemented by this package. Legacy clients that send bare command strings are version 0.
+const Version = 1
+
+// Commands.
+const (
+	// CmdPing checks that the bridge is alive. The connection stays open for more commands.
+	CmdPing = "ping"
+	// CmdConn connects to the exit named by the first argument. After a successful response, the connection is relayed to the exit. Given a host, a hex-encoded cookie and the other bridge's hex-encoded certificate instead, it connects to another bridge, so that clients can chain bridges.
+	CmdConn = "conn"
+	// CmdSeal encrypts the rest of the connection end-to-end with the bridge, which proves its identity. Clients chaining bridges use it so that the first bridge can't see which exit they pick.
+	CmdSeal = "seal"
+)
+
+// Legacy commands, as sent by version 0 clients.
+const (
+	legacyPing         = "ping"
+	legacyPingRepeat   = "ping/repeat"
+	legacyConn         = "conn"
+	legacyConnFeedback = "conn/feedback"
+)
+
+// Reasons a bridge may refuse a request.
+const (
+	ErrBadRequest         = "bad-request"
+	ErrUnsupportedVersion = "unsupported-version"
+	ErrUnknownCommand     = "unknown-command"
+	ErrTooManyCommands    = "too-many-commands"
+	ErrBadExit            = "bad-exit"
+	ErrDialFailed         = "dial-failed"
+	// ErrFull means the bridge is carrying as many clients as it can. Clients should try another bridge.
+	ErrFull = "full"
+)
+
+// maxRequestSize bounds how much a bridge reads for a single request.
+const maxRequestSize = 4096
+
+// Request is a command sent to a bridge.
+type Request struct {
+	Version uint
+	Command string
+	Args    []string
+}
+
+// Response is the bridge's answer to a Request.
+type Response struct {
+	Version uint
+	OK      bool
+	Error   string
+}
+
+// Err returns a RefusedError if the bridge refused the request.
+func (r Response) Err() error {
+	if r.OK {
+		return nil
+	}
+	return RefusedError{Reason: r.Error}
+}
+
+// RefusedError is returned when a bridge refuses a request.
+type RefusedError struct {
+	Reason string
+}
+
+func (e RefusedError) Error() string {
+	return "bridge refused request: " + e.Reason
+}
+
+// exactReader lets rlp read exactly one value from a stream. Without it, rlp buffers, swallowing whatever follows the value, which is usually relayed traffic.
+type exactReader struct {
+	io.Reader
+}
+
+func (er exactReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(er.Reader, b[:])
+	return b[0], err
+}
+
+// MalformedError is returned by ReadRequest when a request arrived but couldn't be decoded, as opposed to the connection failing or going quiet.
+type MalformedError struct {
+	Err error
+}
+
+func (me MalformedError) Error() string {
+	return "malformed request: " + me.Err.Error()
+}
+
+// failReader remembers whether the underlying reader failed.
+type failReader struct {
+	io.Reader
+	err error
+}
+
+func (fr *failReader) Read(p []byte) (int, error) {
+	n, err := fr.Reader.Read(p)
+	if err != nil {
+		fr.err = err
+	}
+	return n, err
+}
+
+// ReadRequest reads a request, accepting both versioned and legacy formats. Legacy requests have version 0 and keep their legacy command names. Requests that can't be decoded give a MalformedError; failures reading the connection are returned as they are.
+func ReadRequest(r io.Reader) (req Request, err error) {
+	fr := &failReader{Reader: r}
+	req, err = readRequest(fr)
+	if err != nil && fr.err == nil {
+		err = MalformedError{err}
+	}
+	return
+}
+
+func readRequest(r io.Reader) (req Request, err error) {
+	stream := rlp.NewStream(exactReader{r}, maxRequestSize)
+	kind, _, err := stream.Kind()
+	if err != nil {
+		return
+	}
+	if kind == rlp.List {
+		err = stream.Decode(&req)
+		if err == nil && req.Version == 0 {
+			err = errors.New("versioned request with version 0")
+		}
+		return
+	}
+	// legacy: a bare command, followed by the host for conn commands
+	var command string
+	if err = stream.Decode(&command); err != nil {
+		return
+	}
+	req.Command = command
+	if command == legacyConn || command == legacyConnFeedback {
+		var host string
+		if err = rlp.NewStream(exactReader{r}, maxRequestSize).Decode(&host); err != nil {
+			return
+		}
+		req.Args = []string{host}
+	}
+	return
+}
+
+// Canonical returns the command with legacy names mapped to the current ones.
+func (req Request) Canonical() string {
+	switch req.Command {
+	case legacyPingRepeat:
+		return CmdPing
+	case legacyConnFeedback:
+		return CmdConn
+	}
+	return req.Command
+}
+
+// KeepAlive returns whether the connection should stay open for more commands after a successful ping. Legacy plain pings close the connection.
+func (req Request) KeepAlive() bool {
+	return req.Version > 0 || req.Command == legacyPingRepeat
+}
+
+// Reply answers the request, in whatever format the client understands. An empty reason means success. Legacy clients have no way of receiving errors, so nothing is sent to them on failure.
+func (req Request) Reply(w io.Writer, reason string) error {
+	if req.Version == 0 {
+		if reason != "" {
+			return nil
+		}
+		switch req.Command {
+		case legacyPing, legacyPingRepeat:
+			return rlp.Encode(w, "ping")
+		case legacyConnFeedback:
+			return rlp.Encode(w, uint(0))
+		}
+		return nil
+	}
+	return rlp.Encode(w, Response{Version: Version, OK: reason == "", Error: reason})
+}
+
+// RefuseMalformed tells a client that sent something unparseable why it is being dropped. It should only be used for a MalformedError, so that probes that send nothing get nothing back.
+func RefuseMalformed(w io.Writer) error {
+	return rlp.Encode(w, Response{Version: Version, Error: ErrBadRequest})
+}
+
+// Do sends a request and waits for the bridge's response.
+func Do(conn io.ReadWriter, command string, args ...string) error {
+	err := rlp.Encode(conn, Request{Version: Version, Command: command, Args: args})
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := rlp.NewStream(exactReader{conn}, maxRequestSize).Decode(&resp); err != nil {
+		return err
+	}
+	return resp.Err()
+}
+
+// Ping pings a bridge.
+func Ping(conn io.ReadWriter) error {
+	return Do(conn, CmdPing)
+}
+
+// Connect asks a bridge to relay the connection to an exit.
+func Connect(conn io.ReadWriter, exitName string) error {
+	return Do(conn, CmdConn, exitName)
+}
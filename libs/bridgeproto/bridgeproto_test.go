@@ -0,0 +1,88 @@
+package bridgeproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestReadRequest(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rlp.Encode(buf, Request{Version: Version, Command: CmdConn, Args: []string{"us-sfo-01.exits.geph.io"}})
+	buf.WriteString("TinySS-1")
+	req, err := ReadRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Canonical() != CmdConn || len(req.Args) != 1 || req.Args[0] != "us-sfo-01.exits.geph.io" {
+		t.Fatalf("wrong request %+v", req)
+	}
+	if rest, _ := ioutil.ReadAll(buf); string(rest) != "TinySS-1" {
+		t.Fatalf("ReadRequest swallowed what came after: %q", rest)
+	}
+}
+
+func TestReadLegacyRequest(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rlp.Encode(buf, "ping/repeat")
+	rlp.Encode(buf, "conn/feedback")
+	rlp.Encode(buf, "us-sfo-01.exits.geph.io")
+	buf.WriteString("TinySS-1")
+	req, err := ReadRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != 0 || req.Canonical() != CmdPing || !req.KeepAlive() {
+		t.Fatalf("wrong request %+v", req)
+	}
+	req, err = ReadRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Canonical() != CmdConn || req.Args[0] != "us-sfo-01.exits.geph.io" {
+		t.Fatalf("wrong request %+v", req)
+	}
+	reply := new(bytes.Buffer)
+	req.Reply(reply, "")
+	var feedback uint
+	if err := rlp.Decode(reply, &feedback); err != nil {
+		t.Fatal("legacy feedback not understood:", err)
+	}
+	if rest, _ := ioutil.ReadAll(buf); string(rest) != "TinySS-1" {
+		t.Fatalf("ReadRequest swallowed what came after: %q", rest)
+	}
+}
+
+func TestReadBadRequest(t *testing.T) {
+	for _, bad := range []struct {
+		req []byte
+		// whether the request is at fault rather than the connection running dry
+		malformed bool
+	}{
+		{nil, false},
+		{[]byte{0xc0}, true},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, false},
+		{func() []byte { b, _ := rlp.EncodeToBytes(Request{Command: CmdPing}); return b }(), true},
+		{func() []byte { b, _ := rlp.EncodeToBytes([]uint{1, 2, 3}); return b }(), true},
+	} {
+		req, err := ReadRequest(bytes.NewReader(bad.req))
+		if err == nil {
+			t.Errorf("%x parsed as %+v", bad.req, req)
+		}
+		if _, malformed := err.(MalformedError); malformed != bad.malformed {
+			t.Errorf("%x: wrong error %v", bad.req, err)
+		}
+	}
+}
+
+func TestRefusal(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Request{Version: Version, Command: "frobnicate"}.Reply(buf, ErrUnknownCommand)
+	// the reply is already in the buffer, ahead of the request Ping writes
+	err := Ping(buf)
+	if err != (RefusedError{Reason: ErrUnknownCommand}) {
+		t.Fatal("expected refusal, got", err)
+	}
+}
@@ -0,0 +1,60 @@
+package bridgeproto
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/tinyss"
+)
+
+// sealCtx separates seal signatures from everything else bridge identity keys sign
+const sealCtx = "geph-bridge-seal-1"
+
+// ConnectBridge asks a bridge to relay the connection to another bridge, whose identity the binder certified with cert. Afterwards, the client speaks to the other bridge as if it were directly connected.
+func ConnectBridge(conn io.ReadWriter, host string, cookie []byte, cert bridgeauth.BridgeCert) error {
+	certBts, err := rlp.EncodeToBytes(cert)
+	if err != nil {
+		return err
+	}
+	return Do(conn, CmdConn, host, hex.EncodeToString(cookie), hex.EncodeToString(certBts))
+}
+
+// Seal asks a bridge to encrypt the rest of the connection, checking that the bridge owns the given identity key. The returned connection must be used from then on.
+func Seal(conn net.Conn, identity ed25519.PublicKey) (net.Conn, error) {
+	if err := Do(conn, CmdSeal); err != nil {
+		return nil, err
+	}
+	sealed, err := tinyss.Handshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	if err := rlp.NewStream(exactReader{sealed}, maxRequestSize).Decode(&sig); err != nil {
+		return nil, err
+	}
+	if len(identity) != ed25519.PublicKeySize || !ed25519.Verify(identity, sealMsg(sealed), sig) {
+		return nil, errors.New("bridge failed to prove its identity")
+	}
+	return sealed, nil
+}
+
+// AcceptSeal is the bridge's side of Seal, called after successfully replying to a seal request.
+func AcceptSeal(conn net.Conn, sk ed25519.PrivateKey) (net.Conn, error) {
+	sealed, err := tinyss.Handshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := rlp.Encode(sealed, ed25519.Sign(sk, sealMsg(sealed))); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+func sealMsg(sealed *tinyss.Socket) []byte {
+	return append([]byte(sealCtx), sealed.SharedSec()...)
+}
@@ -0,0 +1,47 @@
+package bridgeproto
+
+import (
+	"crypto/ed25519"
+	"io"
+	"net"
+	"testing"
+)
+
+// sealServer answers one seal request with sk, then echoes whatever comes through the sealed connection.
+func sealServer(conn net.Conn, sk ed25519.PrivateKey) {
+	defer conn.Close()
+	req, err := ReadRequest(conn)
+	if err != nil || req.Canonical() != CmdSeal {
+		return
+	}
+	req.Reply(conn, "")
+	sealed, err := AcceptSeal(conn, sk)
+	if err != nil {
+		return
+	}
+	io.Copy(sealed, sealed)
+}
+
+func TestSeal(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	client, server := net.Pipe()
+	go sealServer(server, sk)
+	sealed, err := Seal(client, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sealed, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("sealed connection doesn't work", err)
+	}
+	sealed.Close()
+	// a bridge without the right key is caught
+	otherpk, _, _ := ed25519.GenerateKey(nil)
+	client, server = net.Pipe()
+	go sealServer(server, sk)
+	defer client.Close()
+	if _, err := Seal(client, otherpk); err == nil {
+		t.Fatal("sealed to an impostor")
+	}
+}
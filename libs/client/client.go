@@ -0,0 +1,322 @@
+// Package client implements geph-client, which exposes SOCKS5 and HTTP proxies that tunnel through Geph. The client keeps its state in package variables, so only one can run per process.
+package client
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bunsim/goproxy"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/cwl"
+	"github.com/geph-official/geph2/libs/tinysocks"
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
+)
+
+var username string
+var password string
+var ticketFile string
+var binderFront string
+var binderHost string
+var exitName string
+var exitKey string
+var exitRegion string
+var binderMPK string
+var forceBridge bool
+var multipath int
+var chainBridges bool
+
+var loginCheck bool
+var binderProxy string
+
+var modeCache string
+var selector *modeSelector
+
+var socksAddr string
+var httpAddr string
+var statsAddr string
+var dnsAddr string
+
+var bindClient *bdclient.Client
+
+var cpuprofile string
+
+var sWrap *muxWrap
+
+// GitVersion is the build version
+var GitVersion string
+
+// Main runs the client with the given command-line arguments. It never returns.
+func Main(args []string) {
+	mrand.Seed(time.Now().UnixNano())
+	// flags
+	flags := flag.NewFlagSet("geph-client", flag.ExitOnError)
+	flags.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to `file`")
+	flags.StringVar(&username, "username", "pwtest", "username")
+	flags.StringVar(&password, "password", "pwtest", "password")
+	flags.StringVar(&ticketFile, "ticketFile", "", "location for caching auth tickets")
+	flags.StringVar(&binderFront, "binderFront", "https://ajax.aspnetcdn.com/v2", "front location of binder")
+	flags.StringVar(&binderHost, "binderHost", "gephbinder.azureedge.net", "true hostname of binder")
+	flags.StringVar(&exitName, "exitName", "", "qualified name of the exit to use; empty to pick the best one")
+	flags.StringVar(&exitKey, "exitKey", "", "ed25519 pubkey of the exit; empty to look it up in the binder's exit directory")
+	flags.StringVar(&exitRegion, "exitRegion", "", "only use exits in this region, such as us-sfo")
+	flags.StringVar(&binderMPK, "binderMPK", bdclient.DefaultMPK, "hex-encoded binder master public key, used to check the exit directory; defaults to the key this build trusts")
+	flags.BoolVar(&forceBridge, "forceBridge", false, "force the use of obfuscated bridges")
+	flags.StringVar(&modeCache, "modeCache", defaultModeCache(), "file to remember which way of reaching the exit works on each network; empty to not remember across restarts")
+	flags.IntVar(&multipath, "multipath", 1, "number of bridges to stripe traffic across, if the exit supports it")
+	flags.BoolVar(&chainBridges, "chainBridges", false, "go through two bridges, so that no single bridge sees both our address and the exit; implies -forceBridge")
+	flags.StringVar(&socksAddr, "socksAddr", "localhost:9909", "SOCKS5 listening address")
+	flags.StringVar(&httpAddr, "httpAddr", "localhost:9910", "HTTP proxy listener")
+	flags.StringVar(&statsAddr, "statsAddr", "localhost:9809", "HTTP listener for statistics")
+	flags.StringVar(&dnsAddr, "dnsAddr", "localhost:9983", "local DNS listener")
+	flags.BoolVar(&loginCheck, "loginCheck", false, "do a login check and immediately exit with code 0")
+	flags.StringVar(&binderProxy, "binderProxy", "", "if set, proxy the binder at the given listening address and do nothing else")
+	flags.Parse(args)
+	if chainBridges {
+		forceBridge = true
+	}
+	if cpuprofile != "" {
+		f, err := os.Create(cpuprofile)
+		if err != nil {
+			log.Fatal("could not create CPU profile: ", err)
+		}
+		c := make(chan os.Signal)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal("could not start CPU profile: ", err)
+		}
+		go func() {
+			<-c
+			pprof.StopCPUProfile()
+			f.Close()
+			debug.SetTraceback("all")
+			panic("TB")
+		}()
+	}
+
+	if GitVersion == "" {
+		GitVersion = "NOVER"
+	}
+	logPipeR, logPipeW, _ := os.Pipe()
+	log.SetOutput(logPipeW)
+	go func() {
+		buffi := bufio.NewReader(logPipeR)
+		for {
+			line, err := buffi.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprint(os.Stderr, line)
+			useStats(func(sc *stats) {
+				sc.LogLines = append(sc.LogLines, strings.TrimSpace(line))
+			})
+		}
+	}()
+
+	log.Println("GephNG version", GitVersion)
+
+	// special actions
+	if loginCheck {
+		log.Println("loginCheck mode")
+		go func() {
+			time.Sleep(time.Second * 30)
+			os.Exit(-1)
+		}()
+	}
+	if binderProxy != "" {
+		log.Println("binderProxy mode on", binderProxy)
+		binderURL, err := url.Parse(binderFront)
+		if err != nil {
+			panic(err)
+		}
+		revProx := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				log.Println("reverse proxying", req.Method, req.URL)
+				req.Host = binderHost
+				req.URL.Scheme = binderURL.Scheme
+				req.URL.Host = binderURL.Host
+				req.URL.Path = binderURL.Path + "/" + req.URL.Path
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Add("Access-Control-Allow-Origin", "*")
+				resp.Header.Add("Access-Control-Expose-Headers", "*")
+				resp.Header.Add("Access-Control-Allow-Methods", "*")
+				resp.Header.Add("Access-Control-Allow-Headers", "*")
+				return nil
+			},
+		}
+		if http.ListenAndServe(binderProxy, revProx) != nil {
+			panic(err)
+		}
+	}
+
+	// connect to bridge
+	bindClient = bdclient.NewClient(binderFront, binderHost)
+	if binderMPK != "" {
+		mpk, err := bdclient.ParseMasterKey(binderMPK)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bindClient.PinMasterKey(mpk)
+	} else if exitName == "" && exitKey == "" {
+		// without a key to check the exit directory against, stick to the exit clients always used
+		log.Println("no binder master key, so using", fallbackExitName)
+		exitName, exitKey = fallbackExitName, fallbackExitKey
+	} else if !exitPinned() {
+		log.Fatal("picking an exit needs -binderMPK; otherwise give both -exitName and -exitKey")
+	}
+	sWrap = newSmuxWrapper()
+
+	// find out whether we can go direct
+	selector = newModeSelector(modeCache)
+	if !forceBridge {
+		selector.learnCountry(bindClient)
+	}
+
+	if dnsAddr != "" {
+		go doDNSProxy()
+	}
+
+	// spin up stats server
+	statsMux := http.NewServeMux()
+	statsMux.HandleFunc("/proxy.pac", handleProxyPac)
+	statsMux.HandleFunc("/", handleStats)
+	statsMux.HandleFunc("/logs", handleLogs)
+	go func() {
+		err := http.ListenAndServe(statsAddr, statsMux)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	// confirm we are connected
+	func() {
+		rm, _ := sWrap.DialCmd("ip")
+		defer rm.Close()
+		var ip string
+		err := rlp.Decode(rm, &ip)
+		if err != nil {
+			log.Println("Uh oh, cannot get IP!")
+			os.Exit(404)
+		}
+		ip = strings.TrimSpace(ip)
+		log.Println("Successfully got external IP", ip)
+		useStats(func(sc *stats) {
+			sc.Connected = true
+			sc.PublicIP = ip
+		})
+		if loginCheck {
+			os.Exit(0)
+		}
+	}()
+
+	// HTTP proxy
+	srv := goproxy.NewProxyHttpServer()
+	srv.Tr = &http.Transport{
+		Dial: func(n, d string) (net.Conn, error) {
+			return dialTun(d)
+		},
+		IdleConnTimeout: time.Second * 60,
+		Proxy:           nil,
+	}
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	go func() {
+		err := http.ListenAndServe(httpAddr, srv)
+		if err != nil {
+			panic(err.Error())
+		}
+	}()
+
+	listenLoop()
+}
+
+// defaultModeCache returns where modes are remembered unless told otherwise.
+func defaultModeCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "geph", "modes.json")
+}
+
+func dialTun(dest string) (conn net.Conn, err error) {
+	sks, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+	if err != nil {
+		return
+	}
+	conn, err = sks.Dial("tcp", dest)
+	return
+}
+
+func listenLoop() {
+	listener, err := net.Listen("tcp", socksAddr)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("SOCKS5 on", socksAddr)
+	for {
+		cl, err := listener.Accept()
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			defer cl.Close()
+			rmAddr, err := tinysocks.ReadRequest(cl)
+			if err != nil {
+				return
+			}
+			start := time.Now()
+			remote, ok := sWrap.DialCmd("proxy", rmAddr)
+			if !ok {
+				return
+			}
+			defer remote.Close()
+			ping := time.Since(start)
+			log.Printf("opened %v in %v", rmAddr, ping)
+			useStats(func(sc *stats) {
+				pmil := ping.Milliseconds()
+				if time.Since(sc.PingTime).Seconds() > 30 || uint64(pmil) < sc.MinPing {
+					sc.MinPing = uint64(pmil)
+					sc.PingTime = time.Now()
+				}
+			})
+			if !ok {
+				tinysocks.CompleteRequest(5, cl)
+				return
+			}
+			tinysocks.CompleteRequest(0, cl)
+			go func() {
+				defer remote.Close()
+				defer cl.Close()
+				cwl.CopyWithLimit(remote, cl, rate.NewLimiter(rate.Inf, 10000000), func(n int) {
+					useStats(func(sc *stats) {
+						sc.UpBytes += uint64(n)
+					})
+				})
+			}()
+			cwl.CopyWithLimit(cl, remote,
+				rate.NewLimiter(rate.Inf, 10000000), func(n int) {
+					useStats(func(sc *stats) {
+						sc.DownBytes += uint64(n)
+					})
+				})
+		}()
+	}
+}
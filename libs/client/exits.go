@@ -0,0 +1,299 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/tinyss"
+)
+
+// how old an exit directory may be before we refuse it
+const exitDirMaxAge = time.Hour
+
+// how many times in a row the exit may be unreachable before we move on to the next one
+const exitTroubleLimit = 3
+
+// the exit used when we can't check the exit directory, because this build has no binder master key and none was given
+const (
+	fallbackExitName = "us-sfo-01.exits.geph.io"
+	fallbackExitKey  = "2f8571e4795032433098af285c0ce9e43c973ac3ad71bf178e4f2aaa39794aec"
+)
+
+// exitChoice is an exit we use.
+type exitChoice struct {
+	Name string
+	Key  []byte
+}
+
+var exitLock sync.Mutex
+
+// theExit is the exit in use, empty if we haven't picked one yet.
+var theExit exitChoice
+
+// exitQueue is the exits to fail over to, best first.
+var exitQueue []bridgeauth.ExitEntry
+var exitTrouble int
+
+// exitPinned says whether the exit was given on the command line, in which case we never pick another.
+func exitPinned() bool {
+	return exitName != "" && exitKey != ""
+}
+
+// currentExit returns the exit in use.
+func currentExit() exitChoice {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	return theExit
+}
+
+// ensureExit makes sure we have an exit that takes tickets of the given tier, picking the best one if we don't.
+func ensureExit(ubmsg, ubsig []byte, tier string) (ex exitChoice, err error) {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	if theExit.Name != "" {
+		return theExit, nil
+	}
+	if exitPinned() {
+		key, err := hex.DecodeString(exitKey)
+		if err != nil {
+			panic(err)
+		}
+		theExit = exitChoice{Name: exitName, Key: key}
+	} else {
+		if len(exitQueue) == 0 {
+			exitQueue, err = rankExits(ubmsg, ubsig, tier)
+			if err != nil {
+				return
+			}
+		}
+		theExit = exitChoice{Name: exitQueue[0].Name, Key: exitQueue[0].Key}
+		exitQueue = exitQueue[1:]
+		log.Println("using exit", theExit.Name)
+	}
+	exitTrouble = 0
+	useStats(func(sc *stats) {
+		sc.Exit = theExit.Name
+	})
+	return theExit, nil
+}
+
+// failExit moves on from an exit that stopped accepting us, so that the next session goes to the next best one. It returns false if the exit is pinned and there is nowhere else to go.
+func failExit(ex exitChoice, why string) bool {
+	if exitPinned() {
+		return false
+	}
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	if theExit.Name == ex.Name {
+		log.Println("giving up on exit", ex.Name+":", why)
+		theExit = exitChoice{}
+	}
+	return true
+}
+
+// exitWorked and exitFailed keep count of how often we couldn't reach the exit, failing over once it happens too often.
+func exitWorked() {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	exitTrouble = 0
+}
+
+func exitFailed(ex exitChoice) {
+	exitLock.Lock()
+	exitTrouble++
+	trouble := exitTrouble
+	exitLock.Unlock()
+	if trouble >= exitTroubleLimit {
+		failExit(ex, "unreachable")
+	}
+}
+
+// exitCandidate is an exit we might use, with how long it took to answer us. A zero latency means it wasn't probed.
+type exitCandidate struct {
+	bridgeauth.ExitEntry
+	Latency     time.Duration
+	Unreachable bool
+}
+
+// score is lower for better exits. Busy exits count as slower than they are.
+func (ec exitCandidate) score() time.Duration {
+	latency := ec.Latency
+	if latency == 0 {
+		latency = time.Second
+	}
+	return latency * time.Duration(100+ec.Load) / 100
+}
+
+// orderExits sorts candidates best first, with unreachable ones last.
+func orderExits(cands []exitCandidate) {
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].Unreachable != cands[j].Unreachable {
+			return !cands[i].Unreachable
+		}
+		return cands[i].score() < cands[j].score()
+	})
+}
+
+// filterExits picks out the exits we may use: those accepting the tier, and matching -exitName and -exitRegion if given.
+func filterExits(exits []bridgeauth.ExitEntry, tier string) (good []bridgeauth.ExitEntry) {
+	for _, ee := range exits {
+		if exitName != "" && ee.Name != exitName {
+			continue
+		}
+		if exitRegion != "" && ee.Region != exitRegion {
+			continue
+		}
+		if tier != "" && !ee.Accepts(tier) {
+			continue
+		}
+		good = append(good, ee)
+	}
+	return
+}
+
+// rankExits fetches the exit directory and ranks the exits we may use by latency and load. Exits are probed the way we would reach them: directly, or through the fastest bridge.
+func rankExits(ubmsg, ubsig []byte, tier string) ([]bridgeauth.ExitEntry, error) {
+	dir, err := bindClient.GetExitDirectory(exitDirMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get exit directory: %w", err)
+	}
+	exits := filterExits(dir.Exits, tier)
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no exit takes tier %q in region %q", tier, exitRegion)
+	}
+	cands := make([]exitCandidate, len(exits))
+	for i, ee := range exits {
+		cands[i].ExitEntry = ee
+	}
+	probe := func(ee bridgeauth.ExitEntry) (time.Duration, error) { return 0, nil }
+	_, modes := selector.modes()
+	switch {
+	case chainBridges:
+		// probing through a chain would tell the first bridge which exits we consider
+		log.Println("ranking exits by load only")
+	case modes[len(modes)-1] == modeBridged:
+		bi, err := fastestBridge(ubmsg, ubsig)
+		if err != nil {
+			log.Println("cannot find a bridge to probe exits through, ranking by load only:", err)
+			break
+		}
+		probe = func(ee bridgeauth.ExitEntry) (time.Duration, error) {
+			return probeExit(ee, &bi)
+		}
+	default:
+		probe = func(ee bridgeauth.ExitEntry) (time.Duration, error) {
+			return probeExit(ee, nil)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range cands {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency, err := probe(cands[i].ExitEntry)
+			if err != nil {
+				log.Println("exit", cands[i].Name, "failed probe:", err)
+				cands[i].Unreachable = true
+				return
+			}
+			cands[i].Latency = latency
+		}()
+	}
+	wg.Wait()
+	orderExits(cands)
+	for i, ee := range cands {
+		exits[i] = ee.ExitEntry
+		log.Printf("exit %v: region %v, load %v, latency %v, unreachable %v", ee.Name, ee.Region, ee.Load, ee.Latency, ee.Unreachable)
+	}
+	return exits, nil
+}
+
+// fastestBridge returns whichever bridge answers a ping first.
+func fastestBridge(ubmsg, ubsig []byte) (bdclient.BridgeInfo, error) {
+	bridges, err := bindClient.GetBridges(ubmsg, ubsig)
+	if err != nil {
+		return bdclient.BridgeInfo{}, fmt.Errorf("getting bridges failed: %w", err)
+	}
+	race := make(chan bdclient.BridgeInfo, len(bridges))
+	errs := make(chan error, len(bridges))
+	for _, bi := range bridges {
+		bi := bi
+		go func() {
+			kcpConn, err := dialBridge(bi)
+			if err != nil {
+				errs <- err
+				return
+			}
+			kcpConn.Close()
+			race <- bi
+		}()
+	}
+	err = errors.New("no bridges")
+	for range bridges {
+		select {
+		case bi := <-race:
+			return bi, nil
+		case err = <-errs:
+		}
+	}
+	return bdclient.BridgeInfo{}, err
+}
+
+// probeExit measures how long an exit takes to prove who it is, either directly or through a bridge.
+func probeExit(ee bridgeauth.ExitEntry, via *bdclient.BridgeInfo) (time.Duration, error) {
+	var conn net.Conn
+	var start time.Time
+	if via == nil {
+		start = time.Now()
+		var err error
+		conn, err = dialDirect(ee.Name)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		kcpConn, err := dialBridge(*via)
+		if err != nil {
+			return 0, err
+		}
+		start = time.Now()
+		if err := bridgeproto.Connect(kcpConn, ee.Name); err != nil {
+			kcpConn.Close()
+			return 0, err
+		}
+		conn = kcpConn
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	if err := checkExit(conn, ee.Key); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// checkExit checks that whatever is on the other end of conn holds the exit's key.
+func checkExit(conn net.Conn, pk []byte) error {
+	cryptConn, err := tinyss.Handshake(conn)
+	if err != nil {
+		return fmt.Errorf("tinyss handshake failed: %w", err)
+	}
+	var sssig []byte
+	if err := rlp.Decode(cryptConn, &sssig); err != nil {
+		return fmt.Errorf("cannot decode sssig: %w", err)
+	}
+	if !ed25519.Verify(pk, cryptConn.SharedSec(), sssig) {
+		return errors.New("man in the middle")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+func TestOrderExits(t *testing.T) {
+	cands := []exitCandidate{
+		{ExitEntry: bridgeauth.ExitEntry{Name: "dead"}, Unreachable: true},
+		{ExitEntry: bridgeauth.ExitEntry{Name: "busy", Load: 100}, Latency: time.Millisecond * 60},
+		{ExitEntry: bridgeauth.ExitEntry{Name: "far", Load: 10}, Latency: time.Millisecond * 200},
+		{ExitEntry: bridgeauth.ExitEntry{Name: "near", Load: 50}, Latency: time.Millisecond * 50},
+	}
+	orderExits(cands)
+	var names []string
+	for _, c := range cands {
+		names = append(names, c.Name)
+	}
+	if names[0] != "near" || names[1] != "busy" || names[2] != "far" || names[3] != "dead" {
+		t.Fatal("wrong order:", names)
+	}
+	// without probes, only load counts
+	cands = []exitCandidate{
+		{ExitEntry: bridgeauth.ExitEntry{Name: "busy", Load: 90}},
+		{ExitEntry: bridgeauth.ExitEntry{Name: "idle", Load: 5}},
+	}
+	orderExits(cands)
+	if cands[0].Name != "idle" {
+		t.Fatal("preferred the busy exit")
+	}
+}
+
+func TestFilterExits(t *testing.T) {
+	defer func() { exitName, exitRegion = "", "" }()
+	exits := []bridgeauth.ExitEntry{
+		{Name: "sfo", Region: "us-sfo", Tiers: []string{"free", "paid"}},
+		{Name: "fra", Region: "de-fra", Tiers: []string{"paid"}},
+		{Name: "sfo-paid", Region: "us-sfo", Tiers: []string{"paid"}},
+	}
+	count := func(tier string) int { return len(filterExits(exits, tier)) }
+	if count("free") != 1 || count("paid") != 3 {
+		t.Fatal("tiers not respected")
+	}
+	exitRegion = "us-sfo"
+	if count("paid") != 2 {
+		t.Fatal("region not respected")
+	}
+	exitName = "sfo-paid"
+	if count("free") != 0 || count("paid") != 1 {
+		t.Fatal("name not respected")
+	}
+}
@@ -0,0 +1,567 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeproto"
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/resconn"
+	"github.com/geph-official/geph2/libs/tinyss"
+	"github.com/xtaci/smux"
+)
+
+func getBridged(greeting exitproto.ClientHello, kcpConn net.Conn, exitName string, exitPK []byte) (ss *smux.Session, reply exitproto.ExitHello, err error) {
+	err = bridgeproto.Connect(kcpConn, exitName)
+	if err != nil {
+		return
+	}
+	ss, reply, err = negotiateSmux(greeting, kcpConn, exitPK, nil)
+	return
+}
+
+func dialDirect(host string) (conn net.Conn, err error) {
+	conn, err = niaucchi4.Dial(host+":2389", make([]byte, 32))
+	if err != nil {
+		err = fmt.Errorf("plain TCP failed: %w", err)
+	}
+	return
+}
+
+// exits that hung up on a versioned greeting, by public key. They predate exitproto, so they get the legacy greeting instead.
+var legacyExits sync.Map
+
+var errLegacyExit = errors.New("exit hung up on our greeting, so it wants the legacy one")
+
+// handshakeExit authenticates the exit and exchanges greetings with it.
+func handshakeExit(greeting exitproto.ClientHello, rawConn net.Conn, pk []byte) (cryptConn *tinyss.Socket, reply exitproto.ExitHello, err error) {
+	rawConn.SetDeadline(time.Now().Add(time.Second * 10))
+	cryptConn, err = tinyss.Handshake(rawConn)
+	if err != nil {
+		err = fmt.Errorf("tinyss handshake failed: %w", err)
+		rawConn.Close()
+		return
+	}
+	// verify the actual msg
+	var sssig []byte
+	err = rlp.Decode(cryptConn, &sssig)
+	if err != nil {
+		err = fmt.Errorf("cannot decode sssig: %w", err)
+		rawConn.Close()
+		return
+	}
+	if !ed25519.Verify(pk, cryptConn.SharedSec(), sssig) {
+		err = errors.New("man in the middle")
+		rawConn.Close()
+		return
+	}
+	// send the greeting
+	if _, ok := legacyExits.Load(string(pk)); ok {
+		greeting = exitproto.ClientHello{Ubmsg: greeting.Ubmsg, Ubsig: greeting.Ubsig}
+	}
+	greeting.Encode(cryptConn)
+	// wait for the reply
+	reply, err = exitproto.ReadExitHello(cryptConn)
+	if err != nil {
+		if greeting.Version > 0 && greeting.Ubmsg != nil && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			legacyExits.Store(string(pk), true)
+			err = errLegacyExit
+		} else {
+			err = fmt.Errorf("cannot decode reply: %w", err)
+		}
+		rawConn.Close()
+		return
+	}
+	if err = reply.Err(); err != nil {
+		rawConn.Close()
+		return
+	}
+	rawConn.SetDeadline(time.Time{})
+	return
+}
+
+// negotiateSmux starts a session over rawConn. If redial is given and the exit supports it, the session survives rawConn dying by resuming over whatever redial returns. If the exit also supports multipath, the extra connections are joined to the session as additional paths.
+func negotiateSmux(greeting exitproto.ClientHello, rawConn net.Conn, pk []byte, redial func() (net.Conn, error), extra ...net.Conn) (ss *smux.Session, reply exitproto.ExitHello, err error) {
+	multi := false
+	if redial != nil {
+		greeting.Caps = append(greeting.Caps, exitproto.CapResume)
+		if multipath > 1 {
+			greeting.Caps = append(greeting.Caps, exitproto.CapMultipath)
+		}
+	}
+	defer func() {
+		if !multi {
+			for _, ec := range extra {
+				ec.Close()
+			}
+		}
+	}()
+	cryptConn, reply, err := handshakeExit(greeting, rawConn, pk)
+	if err != nil {
+		return
+	}
+	log.Printf("exit accepted us as %v (greeting v%v, caps %v)", reply.Tier, reply.Version, reply.Caps)
+	var wire net.Conn = cryptConn
+	var rc *resconn.Conn
+	if token := reply.Option(exitproto.OptResumeToken); token != nil && redial != nil {
+		rc = resconn.New(resumeGrace)
+		wire = rc
+		multi = multipath > 1 && reply.HasCap(exitproto.CapMultipath)
+		go keepPath(rc, cryptConn, niaucchi4.BandwidthLatency(rawConn), token, pk, redial, multi)
+		if multi {
+			log.Println("striping session across", len(extra)+1, "paths")
+			for _, ec := range extra {
+				ec := ec
+				go func() {
+					var wire net.Conn
+					if ew, _, err := handshakeExit(resumeGreeting(token, true), ec, pk); err != nil {
+						log.Println("cannot join extra path:", err)
+					} else {
+						wire = ew
+					}
+					keepPath(rc, wire, niaucchi4.BandwidthLatency(ec), token, pk, redial, true)
+				}()
+			}
+		}
+	}
+	ss, err = smux.Client(wire, &smux.Config{
+		KeepAliveInterval: time.Minute * 20,
+		KeepAliveTimeout:  time.Minute * 22,
+		MaxFrameSize:      32768,
+		MaxReceiveBuffer:  1024 * 1024 * 100,
+	})
+	if err != nil {
+		rawConn.Close()
+		err = fmt.Errorf("smux error: %w", err)
+		return
+	}
+	if rc != nil {
+		resumables.Store(ss, rc)
+	}
+	return
+}
+
+// smux session => *resconn.Conn
+var resumables sync.Map
+
+// resetSession forces a stuck session to reconnect, resuming it if possible.
+func resetSession(ss *smux.Session) {
+	if rci, ok := resumables.Load(ss); ok {
+		if !rci.(*resconn.Conn).Closed() {
+			rci.(*resconn.Conn).Kick()
+			return
+		}
+		resumables.Delete(ss)
+	}
+	ss.Close()
+}
+
+func resumeGreeting(token []byte, multi bool) exitproto.ClientHello {
+	greeting := exitproto.ClientHello{
+		Version: exitproto.Version,
+		Caps:    append(clientCaps(), exitproto.CapResume),
+		Options: []exitproto.Option{{Key: exitproto.OptResume, Value: token}},
+	}
+	if multi {
+		greeting.Caps = append(greeting.Caps, exitproto.CapMultipath)
+	}
+	return greeting
+}
+
+// keepPath keeps one transport of rc alive, redialing and rejoining the session whenever it dies. A nil wire means we start by dialing. In multipath mode the transport is used alongside the others; otherwise it replaces them.
+func keepPath(rc *resconn.Conn, wire net.Conn, pathStats resconn.StatsFunc, token []byte, pk []byte, redial func() (net.Conn, error), multi bool) {
+	defer rc.Close()
+	for {
+		if wire != nil {
+			var err error
+			if multi {
+				err = rc.AddPath(wire, pathStats)
+			} else {
+				err = rc.Attach(wire)
+			}
+			if errors.Is(err, resconn.ErrClosed) {
+				return
+			}
+			log.Println("transport died, rejoining session:", err)
+			if rc.Paths() == 0 {
+				useStats(func(sc *stats) {
+					sc.Connected = false
+				})
+			}
+			wire = nil
+		}
+		if rc.Closed() {
+			log.Println("gave up resuming session")
+			return
+		}
+		rawConn, err := redial()
+		if err != nil {
+			log.Println("cannot redial for resumption:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		cryptConn, _, err := handshakeExit(resumeGreeting(token, multi), rawConn, pk)
+		if err != nil {
+			var refused exitproto.RefusedError
+			if errors.As(err, &refused) {
+				log.Println("exit refused resumption:", err)
+				return
+			}
+			log.Println("resumption handshake failed:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		log.Println("transport joined session")
+		wire = cryptConn
+		pathStats = niaucchi4.BandwidthLatency(rawConn)
+		useStats(func(sc *stats) {
+			sc.Connected = true
+		})
+	}
+}
+
+func newSmuxWrapper() *muxWrap {
+	return &muxWrap{getSession: func() *smux.Session {
+		useStats(func(sc *stats) {
+			sc.Connected = false
+		})
+	retry:
+		// obtain a ticket
+		ubmsg, ubsig, details, err := bindClient.GetTicket(username, password)
+		if err != nil {
+			log.Println("error authenticating:", err)
+			if errors.Is(err, io.EOF) {
+				os.Exit(403)
+			}
+			time.Sleep(time.Second)
+			goto retry
+		}
+		useStats(func(sc *stats) {
+			sc.Username = username
+			sc.Expiry = details.PaidExpiry
+			sc.Tier = details.Tier
+			sc.PayTxes = details.Transactions
+		})
+		ex, err := ensureExit(ubmsg, ubsig, details.Tier)
+		if err != nil {
+			log.Println("cannot pick an exit:", err)
+			time.Sleep(time.Second)
+			goto retry
+		}
+		greeting := exitproto.NewClientHello(ubmsg, ubsig, clientCaps()...)
+		redial := func() (net.Conn, error) {
+			conns, err := dialExit(ex, ubmsg, ubsig, 1)
+			if err != nil {
+				return nil, err
+			}
+			return conns[0], nil
+		}
+		conns, err := dialExit(ex, ubmsg, ubsig, multipath)
+		if err != nil {
+			log.Println("cannot reach exit, retrying:", err)
+			exitFailed(ex)
+			time.Sleep(time.Second)
+			goto retry
+		}
+		rawConn := conns[0]
+		sm, reply, err := negotiateSmux(greeting, rawConn, ex.Key, redial, conns[1:]...)
+		if err != nil {
+			log.Println("Failed negotiating smux:", err)
+			rawConn.Close()
+			if errors.Is(err, errLegacyExit) {
+				// straight back with the greeting it understands
+				goto retry
+			}
+			handleRefusal(ex, err)
+			time.Sleep(time.Second)
+			goto retry
+		}
+		exitWorked()
+		useExitHello(reply)
+		return sm
+	}}
+}
+
+// dialBridge connects to whichever of a bridge's endpoints answers a ping first. Endpoints are tried in order, each one getting a head start over the next.
+func dialBridge(bi bdclient.BridgeInfo) (*kcp.UDPSession, error) {
+	endpoints := bi.AllEndpoints()
+	race := make(chan *kcp.UDPSession)
+	errs := make(chan error, len(endpoints))
+	done := make(chan bool)
+	defer close(done)
+	for i, host := range endpoints {
+		host := host
+		headStart := time.Millisecond * 300 * time.Duration(i)
+		go func() {
+			select {
+			case <-time.After(headStart):
+			case <-done:
+				errs <- errors.New("another endpoint won")
+				return
+			}
+			kcpConn, err := niaucchi4.Dial(host, bi.Cookie)
+			if err != nil {
+				errs <- err
+				return
+			}
+			kcpConn.SetDeadline(time.Now().Add(time.Second * 30))
+			if err := bridgeproto.Ping(kcpConn); err != nil {
+				kcpConn.Close()
+				errs <- fmt.Errorf("%v: %w", host, err)
+				return
+			}
+			select {
+			case race <- kcpConn:
+			case <-done:
+				kcpConn.Close()
+				errs <- errors.New("another endpoint won")
+			}
+		}()
+	}
+	var err error
+	for range endpoints {
+		select {
+		case kcpConn := <-race:
+			return kcpConn, nil
+		case err = <-errs:
+		}
+	}
+	return nil, err
+}
+
+// dialChain reaches the exit through two bridges picked by the binder. The first bridge learns our address but not the exit, and the second learns the exit but not our address.
+func dialChain(ex exitChoice, ubmsg, ubsig []byte) (net.Conn, error) {
+	first, second, err := bindClient.GetChain(ubmsg, ubsig)
+	if err != nil {
+		return nil, fmt.Errorf("getting a chain failed: %w", err)
+	}
+	for _, host := range second.AllEndpoints() {
+		kcpConn, err := dialBridge(first)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := func() (net.Conn, error) {
+			if err := bridgeproto.ConnectBridge(kcpConn, host, second.Cookie, second.Cert); err != nil {
+				return nil, err
+			}
+			// from here on, the first bridge only relays ciphertext
+			sealed, err := bridgeproto.Seal(kcpConn, second.Identity)
+			if err != nil {
+				return nil, err
+			}
+			if err := bridgeproto.Connect(sealed, ex.Name); err != nil {
+				return nil, err
+			}
+			return sealed, nil
+		}()
+		if err != nil {
+			log.Println("chaining", first.Host, "to", host, "failed:", err)
+			kcpConn.Close()
+			continue
+		}
+		log.Println("chained", first.Host, "to", host)
+		kcpConn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+	return nil, errors.New("no way through the chain")
+}
+
+// dialExit obtains connections to the exit, either directly or through the n fastest bridges, as the mode selector decides. When it can't decide, both ways race, and whichever loses is thrown away.
+func dialExit(ex exitChoice, ubmsg, ubsig []byte, n int) ([]net.Conn, error) {
+	netID, modes := selector.modes()
+	type result struct {
+		mode  string
+		conns []net.Conn
+		err   error
+	}
+	results := make(chan result, len(modes))
+	for _, mode := range modes {
+		mode := mode
+		go func() {
+			r := result{mode: mode}
+			if mode == modeDirect {
+				var conn net.Conn
+				conn, r.err = dialDirectExit(ex)
+				r.conns = []net.Conn{conn}
+			} else {
+				r.conns, r.err = dialBridges(ex, ubmsg, ubsig, n)
+			}
+			selector.record(netID, mode, r.err == nil)
+			results <- r
+		}()
+	}
+	var err error
+	for i := range modes {
+		r := <-results
+		if r.err != nil {
+			log.Println("cannot reach exit in", r.mode, "mode:", r.err)
+			err = r.err
+			continue
+		}
+		go func(left int) {
+			for ; left > 0; left-- {
+				if r := <-results; r.err == nil {
+					for _, conn := range r.conns {
+						conn.Close()
+					}
+				}
+			}
+		}(len(modes) - i - 1)
+		useStats(func(sc *stats) {
+			sc.Mode = r.mode
+		})
+		return r.conns, nil
+	}
+	return nil, err
+}
+
+// dialDirectExit connects straight to the exit. Connecting over UDP always seems to work, even when a censor drops or intercepts everything, so we first check that the exit really answers.
+func dialDirectExit(ex exitChoice) (net.Conn, error) {
+	probe, err := dialDirect(ex.Name)
+	if err != nil {
+		return nil, err
+	}
+	probe.SetDeadline(time.Now().Add(time.Second * 10))
+	err = checkExit(probe, ex.Key)
+	probe.Close()
+	if err != nil {
+		return nil, err
+	}
+	return dialDirect(ex.Name)
+}
+
+// dialBridges obtains connections to the exit through the n fastest bridges, or through a chain of two.
+func dialBridges(ex exitChoice, ubmsg, ubsig []byte, n int) (conns []net.Conn, err error) {
+	if chainBridges {
+		conn, err := dialChain(ex, ubmsg, ubsig)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Conn{conn}, nil
+	}
+	if n < 1 {
+		n = 1
+	}
+	bridges, err := bindClient.GetBridges(ubmsg, ubsig)
+	if err != nil {
+		err = fmt.Errorf("getting bridges failed: %w", err)
+		return
+	}
+	log.Println("racing between", len(bridges), "bridges...")
+	bridgeRace := make(chan net.Conn, n)
+	bridgeDeadWait := new(sync.WaitGroup)
+	bridgeDeadWait.Add(len(bridges))
+	go func() {
+		bridgeDeadWait.Wait()
+		close(bridgeRace)
+	}()
+	for _, bi := range bridges {
+		bi := bi
+		syncChan := time.After(time.Second * 3)
+		go func() {
+			defer bridgeDeadWait.Done()
+			kcpConn, err := dialBridge(bi)
+			if err != nil {
+				log.Println(bi.Host, "failed ping:", err)
+				return
+			}
+			<-syncChan
+			start := time.Now()
+			err = bridgeproto.Connect(kcpConn, ex.Name)
+			if err != nil {
+				log.Println(bi.Host, "failed feedback:", err)
+				kcpConn.Close()
+				return
+			}
+			select {
+			case bridgeRace <- kcpConn:
+				log.Println(bi.Host, "WON with latency", time.Since(start))
+			default:
+				log.Println(bi.Host, "LOST with latency", time.Since(start))
+				kcpConn.Close()
+			}
+		}()
+	}
+	// get the bridges
+	kcpConn, ok := <-bridgeRace
+	if !ok {
+		err = errors.New("everything failed")
+		return
+	}
+	conns = append(conns, kcpConn)
+	stragglers := time.After(time.Second * 3)
+collect:
+	for len(conns) < n {
+		select {
+		case kcpConn, ok := <-bridgeRace:
+			if !ok {
+				break collect
+			}
+			conns = append(conns, kcpConn)
+		case <-stragglers:
+			break collect
+		}
+	}
+	go func() {
+		for kcpConn := range bridgeRace {
+			kcpConn.Close()
+		}
+	}()
+	return
+}
+
+// how long a session may go without a transport before we give up resuming it
+const resumeGrace = time.Minute * 5
+
+// clientCaps returns the capabilities we advertise to the exit.
+func clientCaps() []string {
+	return []string{exitproto.CapTier}
+}
+
+// handleRefusal moves on to another exit, or gives up if there is none, when the exit refused us for a reason retrying cannot fix.
+func handleRefusal(ex exitChoice, err error) {
+	var refused exitproto.RefusedError
+	if !errors.As(err, &refused) {
+		return
+	}
+	switch refused.Reason {
+	case exitproto.FailPaidOnly:
+		log.Println("this exit only accepts paid users!")
+		if !failExit(ex, refused.Reason) {
+			os.Exit(403)
+		}
+	case exitproto.FailWrongGroup:
+		log.Println("our ticket is not good for this exit!")
+		if !failExit(ex, refused.Reason) {
+			os.Exit(403)
+		}
+	case exitproto.FailBadTicket:
+		log.Println("exit rejected our ticket, getting a new one")
+	case "":
+		// legacy exits do not give reasons
+		log.Println("authentication failed")
+		os.Exit(403)
+	}
+}
+
+// useExitHello records what the exit told us about the session.
+func useExitHello(reply exitproto.ExitHello) {
+	useStats(func(sc *stats) {
+		sc.Connected = true
+		if reply.Tier != "" {
+			sc.Tier = reply.Tier
+		}
+		sc.ExitCaps = reply.Caps
+	})
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/tinyss"
+)
+
+func TestLegacyExit(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	defer legacyExits.Delete(string(pk))
+	// an exit from before versioned greetings, which hangs up on anything else
+	legacyExit := func(conn net.Conn) {
+		defer conn.Close()
+		tss, err := tinyss.Handshake(conn)
+		if err != nil {
+			return
+		}
+		sig := ed25519.Sign(sk, tss.SharedSec())
+		rlp.Encode(tss, &sig)
+		var greeting [2][]byte
+		if err := rlp.Decode(tss, &greeting); err != nil {
+			return
+		}
+		rlp.Encode(tss, "OK")
+	}
+	hello := exitproto.NewClientHello(make([]byte, 192), []byte("sig"), clientCaps()...)
+	handshake := func() error {
+		client, server := net.Pipe()
+		go legacyExit(server)
+		_, reply, err := handshakeExit(hello, client, pk)
+		if err == nil && !reply.OK() {
+			t.Fatal("exit refused us")
+		}
+		return err
+	}
+	if err := handshake(); err != errLegacyExit {
+		t.Fatal("didn't notice the legacy exit:", err)
+	}
+	if err := handshake(); err != nil {
+		t.Fatal("legacy greeting failed:", err)
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// Ways of reaching the exit.
+const (
+	modeDirect  = "direct"
+	modeBridged = "bridged"
+)
+
+// how many direct connections in a row may fail before we decide a network blocks them
+const directFailLimit = 3
+
+// how long we go by what we learned about a network before trying both ways again
+const modeMemory = time.Hour * 24 * 7
+
+// modeSelector decides how to reach the exit. It remembers which way last worked on every network, and can keep that in a file so that it survives restarts.
+type modeSelector struct {
+	// Networks is what we know about each network, by networkID.
+	Networks map[string]*networkMode
+	// Censored is the latest list of censored countries from the binder, kept for when the binder can't be reached.
+	Censored []string
+
+	path    string
+	country string
+	lock    sync.Mutex
+}
+
+type networkMode struct {
+	// Mode is the way that last worked.
+	Mode string
+	// DirectFailures counts the direct connections that failed since one last worked.
+	DirectFailures int
+	Updated        time.Time
+}
+
+// newModeSelector creates a mode selector that remembers things in the given file, or only in memory if the path is empty.
+func newModeSelector(path string) *modeSelector {
+	ms := &modeSelector{
+		Networks: make(map[string]*networkMode),
+		path:     path,
+	}
+	if path == "" {
+		return ms
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(bts, ms)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("cannot load remembered modes, starting afresh:", err)
+	}
+	if ms.Networks == nil {
+		ms.Networks = make(map[string]*networkMode)
+	}
+	return ms
+}
+
+// save writes out what we remember. The caller must hold the lock.
+func (ms *modeSelector) save() {
+	if ms.path == "" {
+		return
+	}
+	bts, err := json.Marshal(ms)
+	if err != nil {
+		panic(err)
+	}
+	os.MkdirAll(filepath.Dir(ms.path), 0700)
+	if err := ioutil.WriteFile(ms.path, bts, 0600); err != nil {
+		log.Println("cannot remember modes:", err)
+	}
+}
+
+// learnCountry asks the binder where we are and where censorship is. If the binder can't be reached, we go by the list of censored countries from last time, and by what we remember.
+func (ms *modeSelector) learnCountry(bc *bdclient.Client) {
+	cinfo, err := bc.GetClientInfo()
+	if err != nil {
+		log.Println("cannot get country:", err)
+		return
+	}
+	censored, err := bc.GetCensoredCountries()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.country = cinfo.Country
+	if err != nil {
+		log.Println("cannot get censored countries, using the ones from last time:", err)
+	} else {
+		ms.Censored = censored
+		ms.save()
+	}
+	log.Println("country is", ms.country)
+}
+
+// censored says whether we are in a censored country. The caller must hold the lock.
+func (ms *modeSelector) censored() bool {
+	for _, cc := range ms.Censored {
+		if cc == ms.country {
+			return true
+		}
+	}
+	return false
+}
+
+// modes returns the network we are on and the ways to try reaching the exit from it. If there is more than one, they should be tried at once.
+func (ms *modeSelector) modes() (netID string, modes []string) {
+	netID = networkID()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if forceBridge {
+		return netID, []string{modeBridged}
+	}
+	if ms.censored() {
+		return netID, []string{modeBridged}
+	}
+	if nm, ok := ms.Networks[netID]; ok && nm.Mode != "" && time.Since(nm.Updated) < modeMemory {
+		return netID, []string{nm.Mode}
+	}
+	return netID, []string{modeDirect, modeBridged}
+}
+
+// record notes whether a way of reaching the exit worked on a network. Once direct connections keep failing, the network is switched over to bridges.
+func (ms *modeSelector) record(netID, mode string, ok bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	nm, known := ms.Networks[netID]
+	if !known {
+		nm = &networkMode{}
+		ms.Networks[netID] = nm
+	}
+	switch {
+	case ok:
+		if mode != nm.Mode {
+			log.Println("remembering that", mode, "works on network", netID)
+		}
+		nm.Mode = mode
+		nm.Updated = time.Now()
+		if mode == modeDirect {
+			nm.DirectFailures = 0
+		}
+	case mode == modeDirect:
+		nm.DirectFailures++
+		if nm.DirectFailures >= directFailLimit && nm.Mode != modeBridged {
+			log.Println("direct connections keep failing on network", netID, "so falling back to bridges")
+			nm.Mode = modeBridged
+			nm.Updated = time.Now()
+		}
+	default:
+		return
+	}
+	ms.save()
+}
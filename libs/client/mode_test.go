@@ -0,0 +1,56 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestModeSelector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geph-modes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "modes.json")
+
+	ms := newModeSelector(path)
+	netID, modes := ms.modes()
+	if !reflect.DeepEqual(modes, []string{modeDirect, modeBridged}) {
+		t.Fatal("a new network should race both modes, got", modes)
+	}
+	ms.record(netID, modeDirect, true)
+	if _, modes := ms.modes(); !reflect.DeepEqual(modes, []string{modeDirect}) {
+		t.Fatal("direct worked, yet got", modes)
+	}
+	// direct keeps failing, so we fall back to bridges
+	for i := 0; i < directFailLimit; i++ {
+		if _, modes := ms.modes(); modes[0] != modeDirect {
+			t.Fatal("gave up on direct after", i, "failures")
+		}
+		ms.record(netID, modeDirect, false)
+	}
+	if _, modes := ms.modes(); !reflect.DeepEqual(modes, []string{modeBridged}) {
+		t.Fatal("direct kept failing, yet got", modes)
+	}
+	// which is remembered across restarts, along with the censored countries
+	ms.Censored = []string{"CN", "IR"}
+	ms.save()
+	ms = newModeSelector(path)
+	if _, modes := ms.modes(); !reflect.DeepEqual(modes, []string{modeBridged}) {
+		t.Fatal("forgot the network, got", modes)
+	}
+	// other networks aren't affected
+	ms.record("elsewhere", modeDirect, true)
+	if ms.Networks["elsewhere"].Mode != modeDirect || ms.Networks[netID].Mode != modeBridged {
+		t.Fatal("networks mixed up")
+	}
+	// censored countries never go direct
+	ms.Networks[netID].Mode = modeDirect
+	ms.country = "IR"
+	if _, modes := ms.modes(); !reflect.DeepEqual(modes, []string{modeBridged}) {
+		t.Fatal("went direct from a censored country")
+	}
+}
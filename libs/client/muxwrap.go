@@ -1,4 +1,4 @@
-package main
+package client
 
 import (
 	"log"
@@ -36,7 +36,7 @@ func (sw *muxWrap) DialCmd(cmds ...string) (conn net.Conn, ok bool) {
 			select {
 			case <-time.After(time.Second * 10):
 				log.Println(cmds, "timing out, resetting")
-				sess.Close()
+				resetSession(sess)
 			case <-timeoutCancel:
 			}
 		}()
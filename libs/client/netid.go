@@ -0,0 +1,48 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// networkID identifies the network we are on, so that what we learn about one network isn't used on another. It hashes the default gateway and the interface it is reached through where we can find them, and otherwise the interface and subnet our traffic leaves through.
+func networkID() string {
+	raw, ok := defaultGateway()
+	if !ok {
+		raw, ok = outboundInterface()
+	}
+	if !ok {
+		return "unknown"
+	}
+	h := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(h[:8])
+}
+
+// outboundInterface describes the interface and subnet that traffic to the Internet leaves through.
+func outboundInterface() (string, bool) {
+	// connecting a UDP socket sends nothing, but makes the OS pick a route
+	conn, err := net.Dial("udp", "1.1.1.1:53")
+	if err != nil {
+		return "", false
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", false
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(local) {
+				subnet := net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+				return "if " + iface.Name + " " + iface.HardwareAddr.String() + " " + subnet.String(), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultGateway describes the default route's interface and gateway, from /proc. The gateway's MAC address is left out: the ARP cache often lacks it, or still has the old one, right after switching networks, which would give one network several IDs.
+func defaultGateway() (string, bool) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		// the kernel prints addresses in host byte order, which is little-endian on everything we run on
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return "gw " + fields[0] + " " + ip.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+// defaultGateway can't find the default route on this platform.
+func defaultGateway() (string, bool) {
+	return "", false
+}
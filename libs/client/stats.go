@@ -1,4 +1,4 @@
-package main
+package client
 
 import (
 	"encoding/json"
@@ -12,6 +12,8 @@ import (
 
 type stats struct {
 	Connected bool
+	Mode      string
+	Exit      string
 	PublicIP  string
 	UpBytes   uint64
 	DownBytes uint64
@@ -21,6 +23,7 @@ type stats struct {
 	Tier      string
 	PayTxes   []bdclient.PaymentTx
 	Expiry    time.Time
+	ExitCaps  []string
 	LogLines  []string
 
 	lock sync.Mutex
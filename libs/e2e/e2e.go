@@ -0,0 +1,341 @@
+// Package e2e starts a binder, an exit, a bridge and a client in one process on loopback, so that they can be tested against each other. The binder keeps its data in memory, GeoIP is stubbed out so the client thinks it is in China, and the bridge is only reachable through a lossy link.
+//
+// Every role keeps its state in package variables, so Start only ever builds one network per process.
+package e2e
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/binder"
+	"github.com/geph-official/geph2/libs/bridge"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/client"
+	"github.com/geph-official/geph2/libs/exit"
+	"github.com/xtaci/lossyconn"
+)
+
+// Loss and Delay describe the link between the bridge and everything else: the fraction of packets dropped in each direction, and the mean one-way delay in milliseconds. They must be set before Start.
+var Loss = 0.02
+var Delay = 10
+
+const (
+	exitName     = "exit.e2e"
+	bridgeSecret = "e2e-bridge-key"
+)
+
+// Network is a running set of Geph roles.
+type Network struct {
+	// Store is the binder's storage.
+	Store *binder.MemStore
+	// BinderURL is where the binder API is served.
+	BinderURL string
+	// Username and Password are the credentials the client logs in with.
+	Username string
+	Password string
+
+	// ExitAddr is where the exit listens, over both TCP and UDP.
+	ExitAddr string
+	// ExitKey is the exit's long-term public key.
+	ExitKey ed25519.PublicKey
+	// ExitAdmin is the address of the exit's admin API.
+	ExitAdmin string
+
+	// BridgeHosts are the bridge's advertised endpoints. The first one stops working right after the bridge registers, so clients must race past it.
+	BridgeHosts []string
+
+	// SocksAddr, HTTPAddr and StatsAddr are the client's listeners.
+	SocksAddr string
+	HTTPAddr  string
+	StatsAddr string
+}
+
+var startOnce sync.Once
+var theNetwork *Network
+var startErr error
+
+// Start starts every role, returning once the bridge is registered and the client has been launched. Later calls return the same network.
+func Start() (*Network, error) {
+	startOnce.Do(func() {
+		theNetwork, startErr = start()
+	})
+	return theNetwork, startErr
+}
+
+func start() (*Network, error) {
+	nw := &Network{
+		Store:    binder.NewMemStore(),
+		Username: "e2e-user",
+		Password: "e2e-password",
+	}
+	tmpDir, err := ioutil.TempDir("", "geph-e2e")
+	if err != nil {
+		return nil, err
+	}
+
+	// binder
+	if err := nw.Store.CreateUser(nw.Username, nw.Password); err != nil {
+		return nil, err
+	}
+	nw.Store.AddBridgeKey(bridgeSecret)
+	binder.GeoIP = binder.LocatorFunc(func(net.IP) (binder.Location, error) {
+		return binder.Location{Country: "CN"}, nil
+	})
+	mpk, err := nw.Store.MasterIdentity()
+	if err != nil {
+		return nil, err
+	}
+	binderSrv := httptest.NewServer(binder.Handler(nw.Store))
+	nw.BinderURL = binderSrv.URL
+	binderHost := binderSrv.Listener.Addr().String()
+	mpkHex := hex.EncodeToString(mpk.Public().(ed25519.PublicKey))
+
+	// exit
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	keyfile := filepath.Join(tmpDir, "exit-key.bin")
+	if err := ioutil.WriteFile(keyfile, sk, 0600); err != nil {
+		return nil, err
+	}
+	nw.ExitKey = pk
+	nw.ExitAddr = freeAddr()
+	nw.ExitAdmin = freeAddr()
+	// enroll the exit, which fills in the rest when it registers
+	nw.Store.AddExit(bridgeauth.ExitEntry{Name: exitName, Addr: nw.ExitAddr, Key: pk})
+	go exit.Main([]string{
+		"-keyfile", keyfile,
+		"-name", exitName,
+		"-region", "e2e",
+		"-listen", nw.ExitAddr,
+		"-adminAddr", nw.ExitAdmin,
+		"-binderFront", nw.BinderURL,
+		"-binderReal", binderHost,
+		"-binderMPK", mpkHex,
+		"-metrics", "none",
+		"-publicIP", "127.0.0.1",
+		"-allowPrivate",
+	})
+	if err := waitTCP(nw.ExitAddr); err != nil {
+		return nil, fmt.Errorf("exit did not start: %w", err)
+	}
+
+	// bridge, behind a lossy link
+	wire, err := lossyconn.NewLossyConn(Loss, Delay)
+	if err != nil {
+		return nil, err
+	}
+	decoy, err := newLossyFront(wire.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	front, err := newLossyFront(wire.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	nw.BridgeHosts = []string{decoy.addr(), front.addr()}
+	bridge.Setup([]string{
+		"-cookieSeed", "e2e",
+		"-cookieRotation", "0",
+		"-allocGroup", "e2e",
+		"-binderFront", nw.BinderURL,
+		"-binderReal", binderHost,
+		"-binderMPK", mpkHex,
+		"-binderKey", bridgeSecret,
+		"-metrics", "none",
+	})
+	go bridge.Serve([]net.PacketConn{wire}, nw.BridgeHosts)
+	if err := nw.waitBridge(); err != nil {
+		return nil, fmt.Errorf("bridge did not register: %w", err)
+	}
+	decoy.kill()
+
+	// client
+	nw.SocksAddr = freeAddr()
+	nw.HTTPAddr = freeAddr()
+	nw.StatsAddr = freeAddr()
+	go client.Main([]string{
+		"-username", nw.Username,
+		"-password", nw.Password,
+		"-binderFront", nw.BinderURL,
+		"-binderHost", binderHost,
+		"-binderMPK", mpkHex,
+		"-socksAddr", nw.SocksAddr,
+		"-httpAddr", nw.HTTPAddr,
+		"-statsAddr", nw.StatsAddr,
+		"-dnsAddr", "",
+		"-modeCache", "",
+	})
+	return nw, nil
+}
+
+// Binder returns a client for the binder.
+func (nw *Network) Binder() *bdclient.Client {
+	u, _ := url.Parse(nw.BinderURL)
+	return bdclient.NewClient(nw.BinderURL, u.Host)
+}
+
+// waitBridge waits until the binder hands out the bridge.
+func (nw *Network) waitBridge() error {
+	bc := nw.Binder()
+	ubmsg, ubsig, _, err := bc.GetTicket(nw.Username, nw.Password)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		bridges, err := bc.GetBridges(ubmsg, ubsig)
+		if err == nil && len(bridges) > 0 {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	return errors.New("timed out")
+}
+
+// ClientStats is what the client reports on its stats listener.
+type ClientStats struct {
+	Connected bool
+	Mode      string
+	Exit      string
+	PublicIP  string
+	Username  string
+	Tier      string
+	UpBytes   uint64
+	DownBytes uint64
+}
+
+// ClientStats asks the client for its stats.
+func (nw *Network) ClientStats() (cs ClientStats, err error) {
+	resp, err := http.Get("http://" + nw.StatsAddr + "/")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&cs)
+	return
+}
+
+// WaitConnected waits until the client reports being connected to the exit.
+func (nw *Network) WaitConnected(timeout time.Duration) (cs ClientStats, err error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		cs, err = nw.ClientStats()
+		if err == nil && cs.Connected && cs.PublicIP != "" {
+			return
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	if err == nil {
+		err = errors.New("timed out")
+	}
+	return
+}
+
+// freeAddr returns a loopback address with a port that is currently free.
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitTCP(addr string) error {
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// lossyFront is a UDP socket on loopback that forwards to a lossy in-memory socket, giving every UDP peer its own lossy link.
+type lossyFront struct {
+	pub   net.PacketConn
+	back  net.Addr
+	links map[string]*lossyconn.LossyConn
+	dead  int32
+}
+
+func newLossyFront(back net.Addr) (*lossyFront, error) {
+	pub, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	lf := &lossyFront{
+		pub:   pub,
+		back:  back,
+		links: make(map[string]*lossyconn.LossyConn),
+	}
+	go lf.forward()
+	return lf, nil
+}
+
+func (lf *lossyFront) addr() string {
+	return lf.pub.LocalAddr().String()
+}
+
+// kill makes the front silently drop everything from now on.
+func (lf *lossyFront) kill() {
+	atomic.StoreInt32(&lf.dead, 1)
+}
+
+func (lf *lossyFront) isDead() bool {
+	return atomic.LoadInt32(&lf.dead) != 0
+}
+
+func (lf *lossyFront) forward() {
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := lf.pub.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if lf.isDead() {
+			continue
+		}
+		link, ok := lf.links[peer.String()]
+		if !ok {
+			link, err = lossyconn.NewLossyConn(Loss, Delay)
+			if err != nil {
+				panic(err)
+			}
+			lf.links[peer.String()] = link
+			go lf.backward(link, peer)
+		}
+		link.WriteTo(buf[:n], lf.back)
+	}
+}
+
+func (lf *lossyFront) backward(link *lossyconn.LossyConn, peer net.Addr) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := link.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if lf.isDead() {
+			continue
+		}
+		lf.pub.WriteTo(buf[:n], peer)
+	}
+}
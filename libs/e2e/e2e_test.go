@@ -0,0 +1,208 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/tinyss"
+	"golang.org/x/net/proxy"
+)
+
+const greeting = "hello from the other side"
+
+var target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(greeting))
+}))
+
+func network(t *testing.T) *Network {
+	if testing.Short() {
+		t.Skip("end-to-end tests are slow")
+	}
+	nw, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := nw.WaitConnected(time.Minute * 2)
+	if err != nil {
+		t.Fatal("client never connected:", err)
+	}
+	if cs.PublicIP != "127.0.0.1" {
+		t.Fatal("client got the wrong IP:", cs.PublicIP)
+	}
+	return nw
+}
+
+// fetch gets the target page through a proxy.
+func fetch(tr *http.Transport) error {
+	hc := &http.Client{Transport: tr, Timeout: time.Second * 30}
+	resp, err := hc.Get(target.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if string(body) != greeting {
+		return fmt.Errorf("got %q", body)
+	}
+	return nil
+}
+
+func socksTransport(nw *Network) *http.Transport {
+	sks, err := proxy.SOCKS5("tcp", nw.SocksAddr, nil, proxy.Direct)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Transport{Dial: sks.Dial, DisableKeepAlives: true}
+}
+
+func TestLogin(t *testing.T) {
+	nw := network(t)
+	cs, err := nw.ClientStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Username != nw.Username || cs.Tier != "free" {
+		t.Fatalf("logged in as %q with tier %q", cs.Username, cs.Tier)
+	}
+	// the binder says we are in China, so we must not have gone direct
+	if cs.Mode != "bridged" {
+		t.Fatalf("reached the exit in %q mode", cs.Mode)
+	}
+	// nobody told the client which exit to use
+	if cs.Exit != exitName {
+		t.Fatalf("picked exit %q", cs.Exit)
+	}
+}
+
+func TestBridgeRacing(t *testing.T) {
+	nw := network(t)
+	bc := nw.Binder()
+	ubmsg, ubsig, _, err := bc.GetTicket(nw.Username, nw.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridges, err := bc.GetBridges(ubmsg, ubsig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 1 {
+		t.Fatal("expected one bridge, got", len(bridges))
+	}
+	// the client only got through by giving up on the dead endpoint
+	if eps := bridges[0].AllEndpoints(); len(eps) != 2 || eps[0] != nw.BridgeHosts[0] {
+		t.Fatal("binder did not hand out the dead endpoint first:", eps)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	nw := network(t)
+	if err := fetch(socksTransport(nw)); err != nil {
+		t.Fatal("SOCKS5:", err)
+	}
+	httpProxy, _ := url.Parse("http://" + nw.HTTPAddr)
+	if err := fetch(&http.Transport{Proxy: http.ProxyURL(httpProxy), DisableKeepAlives: true}); err != nil {
+		t.Fatal("HTTP proxy:", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	nw := network(t)
+	if err := fetch(socksTransport(nw)); err != nil {
+		t.Fatal(err)
+	}
+	// kill every session at the exit
+	resp, err := http.Get("http://" + nw.ExitAdmin + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []struct{ ID string }
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) == 0 {
+		t.Fatal("exit has no sessions")
+	}
+	for _, sess := range sessions {
+		req, _ := http.NewRequest("DELETE", "http://"+nw.ExitAdmin+"/sessions/"+sess.ID, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// the client should get a new session by itself
+	deadline := time.Now().Add(time.Minute * 2)
+	for {
+		err := fetch(socksTransport(nw))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("never reconnected:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	nw := network(t)
+	if _, _, _, err := nw.Binder().GetTicket(nw.Username, "wrong"); err == nil {
+		t.Fatal("binder issued a ticket for a bad password")
+	}
+}
+
+func TestForgedTicket(t *testing.T) {
+	nw := network(t)
+	kcpConn, err := niaucchi4.Dial(nw.ExitAddr, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcpConn.Close()
+	kcpConn.SetDeadline(time.Now().Add(time.Second * 30))
+	reply, err := handshake(kcpConn, nw.ExitKey, exitproto.NewClientHello([]byte("forged"), []byte("forged"), exitproto.CapTier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.OK() {
+		t.Fatal("exit accepted a forged ticket")
+	}
+	if reason := reply.Reason; reason != exitproto.FailBadTicket {
+		t.Fatal("refused for the wrong reason:", reason)
+	}
+}
+
+// handshake talks to an exit the way the client does, returning whatever the exit replies.
+func handshake(rawConn net.Conn, pk ed25519.PublicKey, hello exitproto.ClientHello) (reply exitproto.ExitHello, err error) {
+	cryptConn, err := tinyss.Handshake(rawConn)
+	if err != nil {
+		return
+	}
+	var sssig []byte
+	if err = rlp.Decode(cryptConn, &sssig); err != nil {
+		return
+	}
+	if !ed25519.Verify(pk, cryptConn.SharedSec(), sssig) {
+		err = fmt.Errorf("bad exit signature")
+		return
+	}
+	if err = rlp.Encode(cryptConn, hello); err != nil {
+		return
+	}
+	return exitproto.ReadExitHello(cryptConn)
+}
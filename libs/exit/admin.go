@@ -0,0 +1,164 @@
+package exit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+var policyLock sync.RWMutex
+
+func isOnlyPaid() bool {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return onlyPaid
+}
+
+func setOnlyPaid(v bool) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	onlyPaid = v
+	select {
+	case registerNow <- true:
+	default:
+	}
+}
+
+// serveAdmin serves the admin API. It refuses to listen on anything but a loopback address.
+func serveAdmin(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin API must listen on loopback, not %v", addr)
+	}
+	log.Println("admin API on", addr)
+	return http.ListenAndServe(addr, adminRouter())
+}
+
+func adminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/sessions", handleListSessions).Methods("GET")
+	r.HandleFunc("/sessions/{id}", handleKillSession).Methods("DELETE")
+	r.HandleFunc("/limiters", handleLimiters).Methods("GET")
+	r.HandleFunc("/policy", handlePolicy).Methods("GET")
+	r.HandleFunc("/policy/only-paid", handleSetOnlyPaid).Methods("PUT", "POST")
+	return localOnly(r)
+}
+
+// localOnly rejects requests that do not come from loopback, in case the API is reached through a proxy or port forward.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() ||
+			r.Header.Get("X-Forwarded-For") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	toret := make([]sessionInfo, 0)
+	for _, sess := range listSessions() {
+		toret = append(toret, sess.info())
+	}
+	writeJSON(w, toret)
+}
+
+func handleKillSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := getSession(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Println("admin API killing session", sess.id)
+	sess.Kill()
+}
+
+type limiterInfo struct {
+	Session string
+	Tier    string
+	// Limit is in bytes per second; -1 means unlimited
+	Limit float64
+	Burst int
+}
+
+func handleLimiters(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Sessions []limiterInfo
+		Tiers    map[string]int
+	}
+	resp.Sessions = make([]limiterInfo, 0)
+	resp.Tiers = make(map[string]int)
+	for _, sess := range listSessions() {
+		limit := float64(sess.limiter.Limit())
+		if sess.limiter.Limit() == rate.Inf {
+			limit = -1
+		}
+		resp.Sessions = append(resp.Sessions, limiterInfo{
+			Session: sess.id,
+			Tier:    sess.tier,
+			Limit:   limit,
+			Burst:   sess.limiter.Burst(),
+		})
+		resp.Tiers[sess.tier]++
+	}
+	writeJSON(w, resp)
+}
+
+type policyInfo struct {
+	OnlyPaid       bool
+	FreeRate       float64
+	FreeBurst      int
+	PaidBurst      int
+	ResumeGrace    string
+	Capabilities   []string
+	PublicKey      string
+	KeyFingerprint string
+}
+
+func currentPolicy() policyInfo {
+	fp := sha256.Sum256(pubkey)
+	return policyInfo{
+		OnlyPaid:       isOnlyPaid(),
+		FreeRate:       freeRate,
+		FreeBurst:      freeBurst,
+		PaidBurst:      paidBurst,
+		ResumeGrace:    resumeGrace.String(),
+		Capabilities:   exitCaps(),
+		PublicKey:      hex.EncodeToString(pubkey),
+		KeyFingerprint: hex.EncodeToString(fp[:8]),
+	}
+}
+
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentPolicy())
+}
+
+func handleSetOnlyPaid(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.ParseBool(r.FormValue("value"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Println("admin API setting onlyPaid to", v)
+	setOnlyPaid(v)
+	writeJSON(w, currentPolicy())
+}
@@ -0,0 +1,367 @@
+package exit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/flowmux"
+	"github.com/geph-official/geph2/libs/tinyss"
+	"github.com/geph-official/geph2/libs/tiresias"
+	"github.com/xtaci/smux"
+)
+
+var exitAddr string
+var binderMSK ed25519.PrivateKey
+
+// the tickets the fake binder issues, by what tests call them
+var testTicketAttrs = map[string]tiresias.Attrs{
+	"free":      {Tier: "free", Class: "free"},
+	"paid":      {Tier: "paid", Class: "paid"},
+	"elsewhere": {Tier: "paid", Class: "paid", Group: "elsewhere"},
+	"turbo":     {Tier: "paid", Class: "turbo"},
+}
+
+// the fake binder's ticket keys, by attribute name
+var testTicketKeys = make(map[string]*rsa.PrivateKey)
+
+func TestMain(m *testing.M) {
+	for _, attrs := range testTicketAttrs {
+		testTicketKeys[attrs.Name()], _ = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	// fake binder that only hands out ticket keys
+	binder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("attrs")
+		if tier := r.FormValue("tier"); tier != "" {
+			name = tier
+		}
+		sk, ok := testTicketKeys[name]
+		if r.URL.Path != "/get-ticket-key" || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, attrs := range testTicketAttrs {
+			if attrs.Name() == name {
+				epoch := tiresias.DefaultSchedule.Epoch(time.Now())
+				json.NewEncoder(w).Encode([]tiresias.KeyInfo{tiresias.DefaultSchedule.Info(epoch, attrs, &sk.PublicKey)})
+				return
+			}
+		}
+	}))
+	defer binder.Close()
+	bclient = bdclient.NewClient(binder.URL, "binder.test")
+	resumeGrace = time.Second
+	pubkey, seckey, _ = ed25519.GenerateKey(nil)
+	binderMPK, binderMSK, _ = ed25519.GenerateKey(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	exitAddr = listener.Addr().String()
+	go func() {
+		for {
+			rawClient, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(rawClient)
+		}
+	}()
+	os.Exit(m.Run())
+}
+
+func dialTestExit(ticket string) (*smux.Session, exitproto.ExitHello, error) {
+	rawConn, err := net.Dial("tcp", exitAddr)
+	if err != nil {
+		return nil, exitproto.ExitHello{}, err
+	}
+	return handshakeTestExit(rawConn, ticket)
+}
+
+func handshakeTestExit(rawConn net.Conn, ticket string) (*smux.Session, exitproto.ExitHello, error) {
+	cryptConn, err := tinyss.Handshake(rawConn)
+	if err != nil {
+		return nil, exitproto.ExitHello{}, err
+	}
+	var sssig []byte
+	if err := rlp.Decode(cryptConn, &sssig); err != nil {
+		return nil, exitproto.ExitHello{}, err
+	}
+	if !ed25519.Verify(pubkey, cryptConn.SharedSec(), sssig) {
+		return nil, exitproto.ExitHello{}, errors.New("bad signature")
+	}
+	rlp.Encode(cryptConn, exitproto.NewClientHello(testTicket(ticket)))
+	reply, err := exitproto.ReadExitHello(cryptConn)
+	if err != nil {
+		return nil, reply, err
+	}
+	if err := reply.Err(); err != nil {
+		rawConn.Close()
+		return nil, reply, err
+	}
+	sess, err := smux.Client(cryptConn, nil)
+	return sess, reply, err
+}
+
+// testTicket issues a ticket the fake binder knows about, or makes up a bad one. "unclaimed-" followed by a tier gets a ticket from before tickets had claims.
+func testTicket(kind string) (ubmsg, ubsig []byte) {
+	if tier := strings.TrimPrefix(kind, "unclaimed-"); tier != kind {
+		ubmsg = make([]byte, 1536/8)
+		rand.Read(ubmsg)
+		ubmsg[0] = 0xff
+		ubsig, err := tiresias.Issue(testTicketKeys[tier], ubmsg)
+		if err != nil {
+			panic(err)
+		}
+		return ubmsg, ubsig
+	}
+	attrs, ok := testTicketAttrs[kind]
+	if !ok {
+		return []byte(kind), []byte("sig")
+	}
+	sk := testTicketKeys[attrs.Name()]
+	epoch := tiresias.DefaultSchedule.Epoch(time.Now())
+	req, err := tiresias.NewRequest(tiresias.DefaultSchedule.Info(epoch, attrs, &sk.PublicKey))
+	if err != nil {
+		panic(err)
+	}
+	blindSig, err := tiresias.Issue(sk, req.Blinded)
+	if err != nil {
+		panic(err)
+	}
+	ticket, err := req.Unblind(blindSig)
+	if err != nil {
+		panic(err)
+	}
+	return ticket.Msg, ticket.Sig
+}
+
+func adminGet(t *testing.T, srv *httptest.Server, path string, v interface{}) {
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %v: %v", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitSessions(t *testing.T, srv *httptest.Server, n int) []sessionInfo {
+	var sessions []sessionInfo
+	for i := 0; i < 100; i++ {
+		adminGet(t, srv, "/sessions", &sessions)
+		if len(sessions) == n {
+			return sessions
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("expected %v sessions, got %v", n, len(sessions))
+	return nil
+}
+
+func TestAdminSessions(t *testing.T) {
+	srv := httptest.NewServer(adminRouter())
+	defer srv.Close()
+	paid, reply, err := dialTestExit("paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer paid.Close()
+	if reply.Tier != "paid" {
+		t.Fatalf("expected paid, got %v", reply.Tier)
+	}
+	free, _, err := dialTestExit("free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Close()
+	sessions := waitSessions(t, srv, 2)
+	if sessions[0].Tier != "paid" || sessions[1].Tier != "free" {
+		t.Fatalf("wrong tiers: %v", sessions)
+	}
+	var limiters struct {
+		Sessions []limiterInfo
+		Tiers    map[string]int
+	}
+	adminGet(t, srv, "/limiters", &limiters)
+	if limiters.Tiers["paid"] != 1 || limiters.Tiers["free"] != 1 {
+		t.Fatalf("wrong tier counts: %v", limiters.Tiers)
+	}
+	for _, l := range limiters.Sessions {
+		if l.Tier == "free" && l.Limit != freeRate {
+			t.Fatalf("free session has limit %v", l.Limit)
+		}
+		if l.Tier == "paid" && l.Limit != -1 {
+			t.Fatalf("paid session has limit %v", l.Limit)
+		}
+	}
+	// kill the free session
+	req, _ := http.NewRequest("DELETE", srv.URL+"/sessions/"+sessions[1].ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("cannot kill session:", resp.Status)
+	}
+	sessions = waitSessions(t, srv, 1)
+	if sessions[0].Tier != "paid" {
+		t.Fatal("killed the wrong session")
+	}
+	if _, err := free.AcceptStream(); err == nil {
+		t.Fatal("killed session still alive")
+	}
+	req, _ = http.NewRequest("DELETE", srv.URL+"/sessions/nonexistent", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+}
+
+func TestAdminPolicy(t *testing.T) {
+	srv := httptest.NewServer(adminRouter())
+	defer srv.Close()
+	defer setOnlyPaid(false)
+	var policy policyInfo
+	adminGet(t, srv, "/policy", &policy)
+	if policy.OnlyPaid {
+		t.Fatal("onlyPaid should start off")
+	}
+	if len(policy.KeyFingerprint) != 16 {
+		t.Fatal("bad fingerprint", policy.KeyFingerprint)
+	}
+	resp, err := http.PostForm(srv.URL+"/policy/only-paid", url.Values{"value": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&policy)
+	resp.Body.Close()
+	if !policy.OnlyPaid {
+		t.Fatal("onlyPaid not toggled")
+	}
+	_, _, err = dialTestExit("free")
+	if err != (exitproto.RefusedError{Reason: exitproto.FailPaidOnly}) {
+		t.Fatal("expected paid-only refusal, got", err)
+	}
+	paid, _, err := dialTestExit("paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid.Close()
+	resp, err = http.PostForm(srv.URL+"/policy/only-paid", url.Values{"value": {"bogus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400, got", resp.Status)
+	}
+}
+
+func TestServeAdminLoopbackOnly(t *testing.T) {
+	if err := serveAdmin("0.0.0.0:0"); err == nil {
+		t.Fatal("admin API listened on a public address")
+	}
+}
+
+func TestAdminBridgedSession(t *testing.T) {
+	srv := httptest.NewServer(adminRouter())
+	defer srv.Close()
+	bpk, bsk, _ := ed25519.GenerateKey(nil)
+	cert := bridgeauth.NewBridgeCert(binderMSK, bpk, time.Hour)
+	rawConn, err := net.Dial("tcp", exitAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bridgeauth.Dial(rawConn, cert, bsk); err != nil {
+		t.Fatal(err)
+	}
+	bridged, _, err := handshakeTestExit(rawConn, "free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridged.Close()
+	sessions := waitSessions(t, srv, 1)
+	if sessions[0].Bridge != cert.Fingerprint() {
+		t.Fatalf("expected bridge %v, got %q", cert.Fingerprint(), sessions[0].Bridge)
+	}
+	// an uncertified bridge is turned away
+	_, othersk, _ := ed25519.GenerateKey(nil)
+	rawConn, err = net.Dial("tcp", exitAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bridgeauth.Dial(rawConn, bridgeauth.NewBridgeCert(othersk, bpk, time.Hour), bsk); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := handshakeTestExit(rawConn, "free"); err == nil {
+		t.Fatal("exit accepted an uncertified bridge")
+	}
+}
+
+func TestAdminPooledBridge(t *testing.T) {
+	srv := httptest.NewServer(adminRouter())
+	defer srv.Close()
+	bpk, bsk, _ := ed25519.GenerateKey(nil)
+	cert := bridgeauth.NewBridgeCert(binderMSK, bpk, time.Hour)
+	rawConn, err := net.Dial("tcp", exitAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bridgeauth.DialMux(rawConn, cert, bsk); err != nil {
+		t.Fatal(err)
+	}
+	pool := flowmux.Client(rawConn)
+	defer pool.Close()
+	for _, clientAddr := range []string{"10.0.0.1:1111", "10.0.0.2:2222"} {
+		flow, err := pool.Open(clientAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, _, err := handshakeTestExit(flow, "free")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+	}
+	sessions := waitSessions(t, srv, 2)
+	for i, clientAddr := range []string{"10.0.0.1:1111", "10.0.0.2:2222"} {
+		if sessions[i].RemoteAddr != clientAddr || sessions[i].Bridge != cert.Fingerprint() {
+			t.Fatalf("session %v wrong: %+v", i, sessions[i])
+		}
+	}
+	// killing one session leaves the pooled connection and the other session alone
+	req, _ := http.NewRequest("DELETE", srv.URL+"/sessions/"+sessions[0].ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitSessions(t, srv, 1)
+	if pool.IsClosed() {
+		t.Fatal("killing a session killed the pooled connection")
+	}
+}
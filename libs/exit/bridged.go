@@ -0,0 +1,23 @@
+package exit
+
+import (
+	"log"
+	"net"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/flowmux"
+)
+
+// serveBridgeMux serves a pooled connection from a bridge, handling every flow in it as a separate client.
+func serveBridgeMux(conn net.Conn, bridge *bridgeauth.Bridge) {
+	sess := flowmux.Server(conn)
+	defer sess.Close()
+	for {
+		flow, err := sess.Accept()
+		if err != nil {
+			log.Printf("bridge %v pool connection died: %v", bridge.Cert.Fingerprint(), err)
+			return
+		}
+		go handleClient(flow, flow, bridge)
+	}
+}
@@ -0,0 +1,174 @@
+// Package exit implements geph-exit, which proxies traffic for clients holding tickets from the binder. The exit keeps its state in package variables, so only one can run per process.
+package exit
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/metrics"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/patrickmn/go-cache"
+)
+
+var keyfile string
+var pubkey ed25519.PublicKey
+var seckey ed25519.PrivateKey
+var onlyPaid bool
+var exitGroup string
+var exitName string
+var exitRegion string
+var exitSecret string
+var capacity int
+
+var binderFront string
+var binderReal string
+var binderMPKHex string
+var binderMPK ed25519.PublicKey
+var bclient *bdclient.Client
+var hostname string
+var statsdAddr string
+var metricsBackend string
+var prometheusAddr string
+var resumeGrace time.Duration
+var adminAddr string
+var listenAddr string
+var publicIP string
+var allowPrivate bool
+
+var metricSink = metrics.Nop
+var countBytes = func(int64) {}
+
+var ipcache = cache.New(time.Hour, time.Hour)
+
+// Main runs the exit with the given command-line arguments. It never returns.
+func Main(args []string) {
+	flags := flag.NewFlagSet("geph-exit", flag.ExitOnError)
+	flags.StringVar(&keyfile, "keyfile", "keyfile.bin", "location of key file")
+	flags.StringVar(&binderFront, "binderFront", "http://binder.geph.io:9080", "binder domain-fronting host")
+	flags.StringVar(&binderReal, "binderReal", "binder.geph.io", "real hostname of the binder")
+	flags.StringVar(&binderMPKHex, "binderMPK", bdclient.DefaultMPK, "hex-encoded binder master public key, used to check bridges; defaults to the key this build trusts")
+	flags.StringVar(&metricsBackend, "metrics", "statsd", "metrics backend: statsd, prometheus or none")
+	flags.StringVar(&statsdAddr, "statsdAddr", "c2.geph.io:8125", "address of StatsD for gathering statistics")
+	flags.StringVar(&prometheusAddr, "prometheusAddr", ":9100", "address to serve Prometheus metrics on")
+	flags.BoolVar(&onlyPaid, "onlyPaid", false, "only allow paying users")
+	flags.StringVar(&exitGroup, "group", "", "exit group this exit belongs to, such as a region; tickets restricted to other groups are refused")
+	flags.StringVar(&exitName, "name", "", "hostname clients and bridges know this exit by; defaults to the machine's hostname")
+	flags.StringVar(&exitRegion, "region", "", "region the exit is in, such as us-sfo, for clients choosing an exit")
+	flags.StringVar(&exitSecret, "exitSecret", "", "secret the binder wants the first time this exit registers its key or name")
+	flags.IntVar(&capacity, "capacity", 1000, "how many sessions the exit can carry, for the load it reports to the binder")
+	flags.StringVar(&adminAddr, "adminAddr", "127.0.0.1:9089", "local address for the admin API; empty to disable")
+	flags.DurationVar(&resumeGrace, "resumeGrace", time.Minute*5, "how long to keep sessions around for resumption after their transport dies")
+	flags.StringVar(&listenAddr, "listen", ":2389", "address to listen on, over both TCP and UDP")
+	flags.StringVar(&publicIP, "publicIP", "", "public IP address reported to clients; looked up if empty")
+	flags.BoolVar(&allowPrivate, "allowPrivate", false, "let clients reach private and loopback addresses, for testing")
+	flags.Parse(args)
+	if capacity < 1 {
+		log.Fatal("capacity must be positive")
+	}
+	if binderMPKHex == "" {
+		log.Fatal("this build has no binder master key, so -binderMPK is needed to check bridges")
+	}
+	mpk, err := bdclient.ParseMasterKey(binderMPKHex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	binderMPK = mpk
+
+	hostname, err = os.Hostname()
+	if err != nil {
+		statsdAddr = ""
+	} else {
+		log.Println(hostname)
+	}
+	if exitName == "" {
+		exitName = hostname
+	}
+	setupMetrics()
+	bclient = bdclient.NewClient(binderFront, binderReal)
+
+	// load the key
+	loadKey()
+	log.Printf("Loaded PK = %x", pubkey)
+	go registerLoop()
+	if adminAddr != "" {
+		go func() {
+			if err := serveAdmin(adminAddr); err != nil {
+				log.Println("cannot start admin API:", err)
+			}
+		}()
+	}
+	// listen
+	go func() {
+		tcpListener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Started MUX on TinySS on", listenAddr)
+		for {
+			rawClient, err := tcpListener.Accept()
+			if err != nil {
+				panic(err)
+			}
+			go handle(rawClient)
+		}
+	}()
+	udpsock, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		panic(err)
+	}
+	udpsock.(*net.UDPConn).SetWriteBuffer(10 * 1024 * 1024)
+	obfs := niaucchi4.ObfsListen(make([]byte, 32), udpsock)
+	if err != nil {
+		panic(err)
+	}
+	kcpListener := niaucchi4.Listen(obfs)
+	for {
+		rc, err := kcpListener.Accept()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("GOT KCP!")
+		go handle(rc)
+	}
+}
+
+func setupMetrics() {
+	var err error
+	switch metricsBackend {
+	case "statsd":
+		metricSink, err = metrics.Open(metricsBackend, statsdAddr, hostname)
+	case "prometheus":
+		metricSink, err = metrics.Open(metricsBackend, prometheusAddr, "geph_exit")
+	default:
+		metricSink, err = metrics.Open(metricsBackend, "", "")
+	}
+	if err != nil {
+		log.Fatalln("cannot set up metrics:", err)
+	}
+	countBytes = metrics.Accumulate(metricSink, metrics.Bytes, time.Second*10)
+	go metrics.ReportKCP(metricSink, time.Second*10)
+}
+
+// loadKey loads our long-term key, generating one the first time we run. Clients and bridges know us by its public half, which we register with the binder.
+func loadKey() {
+	bts, err := ioutil.ReadFile(keyfile)
+	if os.IsNotExist(err) {
+		log.Println("no key in", keyfile+", generating a new one")
+		_, bts, _ = ed25519.GenerateKey(nil)
+		err = ioutil.WriteFile(keyfile, bts, 0600)
+	}
+	if err != nil {
+		log.Fatal("cannot load key:", err)
+	}
+	if len(bts) != ed25519.PrivateKeySize {
+		log.Fatal("bad key in ", keyfile)
+	}
+	seckey = bts
+	pubkey = seckey.Public().(ed25519.PublicKey)
+}
@@ -0,0 +1,262 @@
+package exit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/cwl"
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/metrics"
+	"github.com/geph-official/geph2/libs/resconn"
+	"github.com/geph-official/geph2/libs/tinyss"
+	"github.com/xtaci/smux"
+	"golang.org/x/time/rate"
+)
+
+// blacklist of local networks
+var cidrBlacklist []*net.IPNet
+
+func init() {
+	for _, s := range []string{
+		"127.0.0.1/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		cidrBlacklist = append(cidrBlacklist, n)
+	}
+}
+
+func isBlack(addr *net.TCPAddr) bool {
+	for _, n := range cidrBlacklist {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// rate limits in bytes per second and bytes
+const (
+	freeRate  = 100 * 1000
+	freeBurst = 5 * 1000 * 1000
+	paidBurst = 10 * 1000 * 1000
+)
+
+// classLimiter returns a fresh rate limiter for a bandwidth class, or nil if we don't know the class.
+func classLimiter(class string) *rate.Limiter {
+	switch class {
+	case "free":
+		limiter := rate.NewLimiter(freeRate, freeBurst)
+		limiter.WaitN(context.Background(), freeBurst-500)
+		return limiter
+	case "paid":
+		return rate.NewLimiter(rate.Inf, paidBurst)
+	}
+	return nil
+}
+
+// exitCaps returns the capabilities this exit advertises to clients.
+func exitCaps() []string {
+	return []string{exitproto.CapTier, exitproto.CapResume, exitproto.CapMultipath}
+}
+
+func handle(rawClient net.Conn) {
+	log.Printf("C<%p> accept", rawClient)
+	defer log.Printf("C<%p> close", rawClient)
+	defer rawClient.Close()
+	rawClient.SetDeadline(time.Now().Add(time.Second * 30))
+	plainClient, bridge, err := bridgeauth.Accept(rawClient, binderMPK)
+	if err != nil {
+		log.Println("Error authenticating bridge", rawClient.RemoteAddr(), err)
+		return
+	}
+	if bridge != nil {
+		log.Printf("C<%p> bridged by %v (multiplexed: %v)", rawClient, bridge.Cert.Fingerprint(), bridge.Multiplexed)
+		if bridge.Multiplexed {
+			rawClient.SetDeadline(time.Time{})
+			serveBridgeMux(rawClient, bridge)
+			return
+		}
+	}
+	handleClient(rawClient, plainClient, bridge)
+}
+
+// handleClient serves one client session. rawClient is what the client's transport is, for stats and killing; plainClient is where its bytes come from.
+func handleClient(rawClient net.Conn, plainClient net.Conn, bridge *bridgeauth.Bridge) {
+	defer rawClient.Close()
+	rawClient.SetDeadline(time.Now().Add(time.Second * 30))
+	tssClient, err := tinyss.Handshake(plainClient)
+	if err != nil {
+		log.Println("Error doing TinySS from", rawClient.RemoteAddr(), err)
+		return
+	}
+	defer tssClient.Close()
+	// sign the shared secret
+	ssSignature := ed25519.Sign(seckey, tssClient.SharedSec())
+	rlp.Encode(tssClient, &ssSignature)
+	// authenticate the client
+	greeting, err := exitproto.ReadClientHello(tssClient)
+	if err != nil {
+		log.Println("Error decoding greeting from", rawClient.RemoteAddr(), err)
+		exitproto.ExitHello{Version: exitproto.Version, Status: "FAIL",
+			Reason: exitproto.FailBadGreeting}.Encode(tssClient, exitproto.Version)
+		return
+	}
+	reply := exitproto.ExitHello{
+		Version: exitproto.Version,
+		Status:  "FAIL",
+		Caps:    exitCaps(),
+	}
+	if token := greeting.Option(exitproto.OptResume); token != nil {
+		resumeSession(rawClient, tssClient, greeting, reply)
+		return
+	}
+	attrs, err := checkTicket(greeting.Ubmsg, greeting.Ubsig)
+	if err != nil {
+		log.Printf("%v has a bad ticket", rawClient.RemoteAddr())
+		metricSink.Count(metrics.TicketBad, 1)
+		reply.Reason = exitproto.FailBadTicket
+		reply.Encode(tssClient, greeting.Version)
+		return
+	}
+	if attrs.Tier != "paid" && isOnlyPaid() {
+		log.Printf("%v isn't paid and we only accept paid. Failing!", rawClient.RemoteAddr())
+		metricSink.Count(metrics.TicketBad, 1)
+		reply.Reason = exitproto.FailPaidOnly
+		reply.Encode(tssClient, greeting.Version)
+		return
+	}
+	if attrs.Group != "" && attrs.Group != exitGroup {
+		log.Printf("%v has a ticket for exit group %q, not ours", rawClient.RemoteAddr(), attrs.Group)
+		metricSink.Count(metrics.TicketBad, 1)
+		reply.Reason = exitproto.FailWrongGroup
+		reply.Encode(tssClient, greeting.Version)
+		return
+	}
+	limiter := classLimiter(attrs.Class)
+	if limiter == nil {
+		log.Printf("%v has a ticket with unknown bandwidth class %q", rawClient.RemoteAddr(), attrs.Class)
+		metricSink.Count(metrics.TicketBad, 1)
+		reply.Reason = exitproto.FailBadTicket
+		reply.Encode(tssClient, greeting.Version)
+		return
+	}
+	if attrs.Tier == "paid" {
+		metricSink.Count(metrics.TicketPaid, 1)
+	} else {
+		metricSink.Count(metrics.TicketFree, 1)
+	}
+	reply.Tier = attrs.Tier
+	log.Printf("%v is %v (greeting v%v, caps %v)", rawClient.RemoteAddr(), reply.Tier, greeting.Version, greeting.Caps)
+	// resumable sessions run smux over a resconn that outlives this transport
+	var wire net.Conn = tssClient
+	var rc *resconn.Conn
+	if greeting.HasCap(exitproto.CapResume) {
+		var token []byte
+		token, rc = newResumable()
+		defer forgetResumable(token)
+		defer rc.Close()
+		reply.Options = exitproto.SetOption(reply.Options, exitproto.OptResumeToken, token)
+		wire = rc
+	}
+	reply.Status = "OK"
+	reply.Encode(tssClient, greeting.Version)
+	rawClient.SetDeadline(time.Time{})
+	if rc != nil {
+		go func() {
+			err := attachTransport(rc, rawClient, tssClient, greeting)
+			log.Printf("C<%p> transport detached: %v", rawClient, err)
+		}()
+	}
+	// create smux context
+	muxSrv, err := smux.Server(wire, &smux.Config{
+		KeepAliveInterval: time.Minute * 30,
+		KeepAliveTimeout:  time.Minute * 32,
+		MaxFrameSize:      32768,
+		MaxReceiveBuffer:  10 * 1024 * 1024,
+	})
+	if err != nil {
+		log.Println("Error negotiating smux from", rawClient.RemoteAddr(), err)
+		return
+	}
+	defer muxSrv.Close()
+	sess := newSession(rawClient, bridge, reply.Tier, limiter, rc != nil, func() {
+		log.Printf("C<%p> killed", rawClient)
+		muxSrv.Close()
+		if rc != nil {
+			rc.Close()
+		}
+		rawClient.Close()
+	})
+	defer sess.remove()
+	for {
+		soxclient, err := muxSrv.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer soxclient.Close()
+			sess.addStream(1)
+			defer sess.addStream(-1)
+			var command []string
+			err = rlp.Decode(&io.LimitedReader{R: soxclient, N: 1000}, &command)
+			if err != nil {
+				return
+			}
+			if len(command) == 0 {
+				return
+			}
+			// match command
+			switch command[0] {
+			case "proxy":
+				if len(command) < 1 {
+					return
+				}
+				rlp.Encode(soxclient, true)
+				dialStart := time.Now()
+				host := command[1]
+				tcpAddr, err := net.ResolveTCPAddr("tcp4", host)
+				if err != nil || (!allowPrivate && isBlack(tcpAddr)) {
+					return
+				}
+				remote, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second*30)
+				if err != nil {
+					return
+				}
+				// measure dial latency
+				dialLatency := time.Since(dialStart)
+				log.Printf("dialed %v in %.1fms", host, dialLatency.Seconds()*1000)
+				metricSink.Timing(metrics.DialLatency, dialLatency)
+
+				remote.SetDeadline(time.Now().Add(time.Hour))
+				defer remote.Close()
+				onPacket := func(l int) {
+					atomic.AddUint64(&sess.bytes, uint64(l))
+					countBytes(int64(l))
+				}
+				go func() {
+					defer remote.Close()
+					defer soxclient.Close()
+					cwl.CopyWithLimit(remote, soxclient, limiter, onPacket)
+				}()
+				cwl.CopyWithLimit(soxclient, remote, limiter, onPacket)
+			case "ip":
+				ip, err := lookupPublicIP()
+				if err != nil {
+					return
+				}
+				rlp.Encode(soxclient, true)
+				rlp.Encode(soxclient, ip)
+			}
+		}()
+	}
+}
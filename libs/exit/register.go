@@ -0,0 +1,100 @@
+package exit
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+)
+
+// registerInterval is how often we register with the binder. Every registration reports our load.
+var registerInterval = time.Minute * 2
+
+// registerNow makes the registration loop register right away, for instance when our policy changes
+var registerNow = make(chan bool, 1)
+
+// lookupPublicIP returns the address clients see us at, asking a lookup service if it wasn't given on the command line.
+func lookupPublicIP() (string, error) {
+	if publicIP != "" {
+		return publicIP, nil
+	}
+	if ipi, ok := ipcache.Get("ip"); ok {
+		return ipi.(string), nil
+	}
+	resp, err := http.Get("http://checkip.amazonaws.com")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	ipb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(ipb))
+	if net.ParseIP(ip) == nil {
+		return "", errors.New("lookup service gave a bad IP")
+	}
+	ipcache.SetDefault("ip", ip)
+	return ip, nil
+}
+
+// currentEntry describes us as the binder should list us.
+func currentEntry() (bridgeauth.ExitEntry, error) {
+	ip, err := lookupPublicIP()
+	if err != nil {
+		return bridgeauth.ExitEntry{}, err
+	}
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return bridgeauth.ExitEntry{}, err
+	}
+	tiers := []string{"free", "paid"}
+	if isOnlyPaid() {
+		tiers = []string{"paid"}
+	}
+	sessionsLock.Lock()
+	load := uint64(len(sessions)) * 100 / uint64(capacity)
+	sessionsLock.Unlock()
+	if load > 100 {
+		load = 100
+	}
+	return bridgeauth.ExitEntry{
+		Name:   exitName,
+		Addr:   net.JoinHostPort(ip, port),
+		Region: exitRegion,
+		Tiers:  tiers,
+		Load:   load,
+		Caps:   exitCaps(),
+	}, nil
+}
+
+// register sends a signed descriptor to the binder.
+func register() error {
+	entry, err := currentEntry()
+	if err != nil {
+		return err
+	}
+	desc := bridgeauth.ExitDescriptor{Exit: entry}
+	desc.Sign(seckey)
+	return bclient.AddExit(exitSecret, desc)
+}
+
+// registerLoop registers with the binder forever, retrying sooner when registration fails.
+func registerLoop() {
+	for {
+		interval := registerInterval
+		if err := register(); err != nil {
+			log.Println("error registering with binder:", err)
+			interval = registerInterval / 10
+		}
+		select {
+		case <-time.After(interval):
+		case <-registerNow:
+		}
+	}
+}
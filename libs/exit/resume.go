@@ -0,0 +1,58 @@
+package exit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	"github.com/geph-official/geph2/libs/exitproto"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/resconn"
+	"github.com/patrickmn/go-cache"
+)
+
+// resumable sessions by hex token. string => *resconn.Conn
+//
+// Entries don't expire, since a session may live for as long as it likes. Detached sessions close themselves after resumeGrace, which ends their handler, which forgets them.
+var resumeTable = cache.New(cache.NoExpiration, 0)
+
+func newResumable() (token []byte, rc *resconn.Conn) {
+	token = make([]byte, 32)
+	rand.Read(token)
+	rc = resconn.New(resumeGrace)
+	resumeTable.SetDefault(hex.EncodeToString(token), rc)
+	return
+}
+
+func forgetResumable(token []byte) {
+	resumeTable.Delete(hex.EncodeToString(token))
+}
+
+// attachTransport attaches a transport to a session, alongside the existing ones if the client does multipath.
+func attachTransport(rc *resconn.Conn, rawClient net.Conn, tssClient net.Conn, greeting exitproto.ClientHello) error {
+	if greeting.HasCap(exitproto.CapMultipath) {
+		return rc.AddPath(tssClient, niaucchi4.BandwidthLatency(rawClient))
+	}
+	return rc.Attach(tssClient)
+}
+
+// resumeSession attaches a new transport to an existing session and services it until it dies.
+func resumeSession(rawClient net.Conn, tssClient net.Conn, greeting exitproto.ClientHello, reply exitproto.ExitHello) {
+	token := greeting.Option(exitproto.OptResume)
+	rci, ok := resumeTable.Get(hex.EncodeToString(token))
+	if !ok || rci.(*resconn.Conn).Closed() {
+		log.Printf("C<%p> tried to resume unknown session", rawClient)
+		reply.Reason = exitproto.FailBadResume
+		reply.Encode(tssClient, exitproto.Version)
+		return
+	}
+	rc := rci.(*resconn.Conn)
+	reply.Status = "OK"
+	reply.Encode(tssClient, exitproto.Version)
+	rawClient.SetDeadline(time.Time{})
+	log.Printf("C<%p> joining session (caps %v)", rawClient, greeting.Caps)
+	err := attachTransport(rc, rawClient, tssClient, greeting)
+	log.Printf("C<%p> joined transport detached: %v", rawClient, err)
+}
@@ -0,0 +1,135 @@
+package exit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bridgeauth"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/metrics"
+	"golang.org/x/time/rate"
+)
+
+// session is an active client session, as seen by the admin API.
+type session struct {
+	id        string
+	tier      string
+	rawClient net.Conn
+	bridge    *bridgeauth.Bridge
+	started   time.Time
+	limiter   *rate.Limiter
+	resumable bool
+	bytes     uint64
+	streams   int64
+
+	killOnce sync.Once
+	kill     func()
+}
+
+var sessionsLock sync.Mutex
+var sessions = make(map[string]*session)
+
+func newSession(rawClient net.Conn, bridge *bridgeauth.Bridge, tier string, limiter *rate.Limiter, resumable bool, kill func()) *session {
+	idb := make([]byte, 8)
+	rand.Read(idb)
+	sess := &session{
+		id:        hex.EncodeToString(idb),
+		tier:      tier,
+		rawClient: rawClient,
+		bridge:    bridge,
+		started:   time.Now(),
+		limiter:   limiter,
+		resumable: resumable,
+		kill:      kill,
+	}
+	sessionsLock.Lock()
+	sessions[sess.id] = sess
+	metricSink.Gauge(metrics.Sessions, float64(len(sessions)))
+	sessionsLock.Unlock()
+	metricSink.Count(metrics.SessionsTotal, 1)
+	return sess
+}
+
+func (sess *session) remove() {
+	sessionsLock.Lock()
+	delete(sessions, sess.id)
+	metricSink.Gauge(metrics.Sessions, float64(len(sessions)))
+	sessionsLock.Unlock()
+}
+
+// streams across all sessions
+var totalStreams int64
+
+func (sess *session) addStream(delta int64) {
+	atomic.AddInt64(&sess.streams, delta)
+	metricSink.Gauge(metrics.Streams, float64(atomic.AddInt64(&totalStreams, delta)))
+}
+
+// Kill forcibly ends the session.
+func (sess *session) Kill() {
+	sess.killOnce.Do(sess.kill)
+}
+
+type flowStats struct {
+	BtlBw   float64
+	Latency float64
+	Loss    float64
+}
+
+type sessionInfo struct {
+	ID         string
+	Tier       string
+	RemoteAddr string
+	// Bridge is the fingerprint of the bridge the session came through, if any
+	Bridge    string `json:",omitempty"`
+	Started   time.Time
+	Resumable bool
+	Bytes     uint64
+	Streams   int64
+	FlowStats *flowStats `json:",omitempty"`
+}
+
+func (sess *session) info() sessionInfo {
+	nfo := sessionInfo{
+		ID:         sess.id,
+		Tier:       sess.tier,
+		RemoteAddr: sess.rawClient.RemoteAddr().String(),
+		Started:    sess.started,
+		Resumable:  sess.resumable,
+		Bytes:      atomic.LoadUint64(&sess.bytes),
+		Streams:    atomic.LoadInt64(&sess.streams),
+	}
+	if sess.bridge != nil {
+		nfo.Bridge = sess.bridge.Cert.Fingerprint()
+	}
+	if kc, ok := sess.rawClient.(*kcp.UDPSession); ok {
+		btlBw, latency, loss := kc.FlowStats()
+		nfo.FlowStats = &flowStats{btlBw, latency, loss}
+	}
+	return nfo
+}
+
+func listSessions() []*session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	var toret []*session
+	for _, sess := range sessions {
+		toret = append(toret, sess)
+	}
+	sort.Slice(toret, func(i, j int) bool {
+		return toret[i].started.Before(toret[j].started)
+	})
+	return toret
+}
+
+func getSession(id string) (*session, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sess, ok := sessions[id]
+	return sess, ok
+}
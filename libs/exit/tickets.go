@@ -0,0 +1,41 @@
+package exit
+
+import (
+	"time"
+
+	"github.com/geph-official/geph2/libs/tiresias"
+	"github.com/patrickmn/go-cache"
+)
+
+// ticketKeys caches the binder's ticket keys, so that we don't ask the binder about every client
+var ticketKeys = cache.New(time.Minute, time.Minute*10)
+
+// cachedTicketKeys returns cached keys, fetching them if needed. Failures are remembered for a little while too, so that tickets claiming made-up attributes can't make us hammer the binder.
+func cachedTicketKeys(key string, fetch func() ([]tiresias.KeyInfo, error)) []tiresias.KeyInfo {
+	if keys, ok := ticketKeys.Get(key); ok {
+		return keys.([]tiresias.KeyInfo)
+	}
+	keys, err := fetch()
+	if err != nil {
+		ticketKeys.Set(key, []tiresias.KeyInfo(nil), time.Second*10)
+		return nil
+	}
+	ticketKeys.SetDefault(key, keys)
+	return keys
+}
+
+// checkTicket checks a ticket against the keys of the attributes it claims, returning the attributes it is good for. Tickets that claim nothing are only good for the free tier, since nothing but the signature ties them to a key.
+func checkTicket(ubmsg, ubsig []byte) (tiresias.Attrs, error) {
+	tkt := tiresias.Ticket{Msg: ubmsg, Sig: ubsig}
+	var keys []tiresias.KeyInfo
+	if claims, ok := tkt.Claims(); ok {
+		keys = cachedTicketKeys("attrs:"+claims.Attrs.Name(), func() ([]tiresias.KeyInfo, error) {
+			return bclient.GetTicketKeysFor(claims.Attrs)
+		})
+	} else {
+		keys = cachedTicketKeys("tier:free", func() ([]tiresias.KeyInfo, error) {
+			return bclient.GetTicketKeys("free")
+		})
+	}
+	return tkt.VerifyKeys(keys, time.Now())
+}
@@ -0,0 +1,40 @@
+package exit
+
+import (
+	"testing"
+
+	"github.com/geph-official/geph2/libs/exitproto"
+)
+
+func TestTicketAttrs(t *testing.T) {
+	for kind, reason := range map[string]string{
+		"forged":    exitproto.FailBadTicket,
+		"elsewhere": exitproto.FailWrongGroup,
+		"turbo":     exitproto.FailBadTicket,
+		// tickets without claims can't prove they are paid
+		"unclaimed-paid": exitproto.FailBadTicket,
+	} {
+		_, _, err := dialTestExit(kind)
+		if err != (exitproto.RefusedError{Reason: reason}) {
+			t.Errorf("%v ticket: expected %v, got %v", kind, reason, err)
+		}
+	}
+	exitGroup = "elsewhere"
+	defer func() { exitGroup = "" }()
+	sess, reply, err := dialTestExit("elsewhere")
+	if err != nil {
+		t.Fatal("refused a ticket for our group:", err)
+	}
+	sess.Close()
+	if reply.Tier != "paid" {
+		t.Fatal("wrong tier", reply.Tier)
+	}
+	sess, reply, err = dialTestExit("unclaimed-free")
+	if err != nil {
+		t.Fatal("refused a free ticket without claims:", err)
+	}
+	sess.Close()
+	if reply.Tier != "free" {
+		t.Fatal("wrong tier", reply.Tier)
+	}
+}
@@ -0,0 +1,206 @@
+// Package exitproto implements the versioned greeting that clients and exits exchange right after the TinySS handshake.
+package exitproto
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Version is the greeting version implemented by this package. Legacy peers that send a bare [ubmsg, ubsig] greeting are version 0.
+const Version = 1
+
+// Capabilities that exits and clients may advertise.
+const (
+	CapTier        = "tier"
+	CapUDPRelay    = "udp-relay"
+	CapCompression = "compression"
+	CapMultipath   = "multipath"
+	CapResume      = "resume"
+)
+
+// Well-known options.
+const (
+	// OptResumeToken is set by the exit to the token that resumes the session.
+	OptResumeToken = "resume-token"
+	// OptResume is set by the client to resume an existing session instead of starting a new one.
+	OptResume = "resume"
+)
+
+// Reasons an exit may refuse a session.
+const (
+	FailBadGreeting = "bad-greeting"
+	FailBadTicket   = "bad-ticket"
+	FailPaidOnly    = "paid-only"
+	FailWrongGroup  = "wrong-group"
+	FailBadResume   = "bad-resume"
+	FailInternal    = "internal"
+)
+
+// Option is an extension field. Unknown options must be ignored, so new features can be added without bumping the version.
+type Option struct {
+	Key   string
+	Value []byte
+}
+
+// ClientHello is sent by the client after verifying the exit's signature.
+type ClientHello struct {
+	Version uint
+	Ubmsg   []byte
+	Ubsig   []byte
+	Caps    []string
+	Options []Option
+}
+
+// ExitHello is the exit's response to a ClientHello.
+type ExitHello struct {
+	Version uint
+	Status  string
+	Reason  string
+	Tier    string
+	Caps    []string
+	Options []Option
+}
+
+// NewClientHello creates a ClientHello for the given ticket.
+func NewClientHello(ubmsg, ubsig []byte, caps ...string) ClientHello {
+	return ClientHello{
+		Version: Version,
+		Ubmsg:   ubmsg,
+		Ubsig:   ubsig,
+		Caps:    caps,
+	}
+}
+
+// Encode writes out the ClientHello. A version 0 hello is written as the bare [ubmsg, ubsig] greeting that legacy exits expect, dropping everything else.
+func (ch ClientHello) Encode(w io.Writer) error {
+	if ch.Version == 0 {
+		return rlp.Encode(w, [2][]byte{ch.Ubmsg, ch.Ubsig})
+	}
+	return rlp.Encode(w, ch)
+}
+
+// HasCap returns whether the client advertised a capability.
+func (ch ClientHello) HasCap(c string) bool {
+	return hasCap(ch.Caps, c)
+}
+
+// Option returns the value of an option, or nil.
+func (ch ClientHello) Option(key string) []byte {
+	return getOption(ch.Options, key)
+}
+
+// HasCap returns whether the exit advertised a capability.
+func (eh ExitHello) HasCap(c string) bool {
+	return hasCap(eh.Caps, c)
+}
+
+// Option returns the value of an option, or nil.
+func (eh ExitHello) Option(key string) []byte {
+	return getOption(eh.Options, key)
+}
+
+// OK returns whether the exit accepted the session.
+func (eh ExitHello) OK() bool {
+	return eh.Status == "OK"
+}
+
+// Err returns a RefusedError if the exit refused the session.
+func (eh ExitHello) Err() error {
+	if eh.OK() {
+		return nil
+	}
+	return RefusedError{Reason: eh.Reason}
+}
+
+// Encode writes out the ExitHello in the format understood by a client of the given version.
+func (eh ExitHello) Encode(w io.Writer, clientVersion uint) error {
+	if clientVersion == 0 {
+		status := "FAIL"
+		if eh.OK() {
+			status = "OK"
+		}
+		return rlp.Encode(w, status)
+	}
+	return rlp.Encode(w, eh)
+}
+
+// RefusedError is returned when the exit refuses a session.
+type RefusedError struct {
+	Reason string
+}
+
+func (e RefusedError) Error() string {
+	if e.Reason == "" {
+		return "exit refused session"
+	}
+	return "exit refused session: " + e.Reason
+}
+
+// ReadClientHello reads a greeting, accepting both versioned and legacy formats.
+func ReadClientHello(r io.Reader) (ch ClientHello, err error) {
+	var raw rlp.RawValue
+	err = rlp.Decode(r, &raw)
+	if err != nil {
+		return
+	}
+	if e := rlp.DecodeBytes(raw, &ch); e == nil {
+		if ch.Version == 0 {
+			err = errors.New("versioned greeting with version 0")
+		}
+		return
+	}
+	var legacy [2][]byte
+	err = rlp.DecodeBytes(raw, &legacy)
+	if err != nil {
+		return
+	}
+	ch = ClientHello{Ubmsg: legacy[0], Ubsig: legacy[1]}
+	return
+}
+
+// ReadExitHello reads the exit's response, accepting both versioned and legacy formats.
+func ReadExitHello(r io.Reader) (eh ExitHello, err error) {
+	var raw rlp.RawValue
+	err = rlp.Decode(r, &raw)
+	if err != nil {
+		return
+	}
+	var legacy string
+	if e := rlp.DecodeBytes(raw, &legacy); e == nil {
+		eh = ExitHello{Status: legacy}
+		return
+	}
+	err = rlp.DecodeBytes(raw, &eh)
+	return
+}
+
+func hasCap(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+func getOption(opts []Option, key string) []byte {
+	for _, o := range opts {
+		if o.Key == key {
+			return o.Value
+		}
+	}
+	return nil
+}
+
+// SetOption sets an option in a list of options.
+func SetOption(opts []Option, key string, value []byte) []Option {
+	for i, o := range opts {
+		if o.Key == key {
+			opts[i].Value = value
+			return opts
+		}
+	}
+	return append(opts, Option{Key: key, Value: value})
+}
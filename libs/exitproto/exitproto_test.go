@@ -0,0 +1,58 @@
+package exitproto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestLegacyClientHello(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rlp.Encode(buf, [2][]byte{make([]byte, 192), []byte("sig")})
+	ch, err := ReadClientHello(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Version != 0 || len(ch.Ubmsg) != 192 || string(ch.Ubsig) != "sig" {
+		t.Fatal("bad legacy decode", ch)
+	}
+	// and a version 0 hello goes out the way legacy exits read it
+	buf.Reset()
+	ClientHello{Ubmsg: make([]byte, 192), Ubsig: []byte("sig"), Caps: []string{CapTier}}.Encode(buf)
+	var legacy [2][]byte
+	if err := rlp.Decode(buf, &legacy); err != nil || len(legacy[0]) != 192 || string(legacy[1]) != "sig" {
+		t.Fatal("bad legacy encode", err)
+	}
+}
+
+func TestClientHello(t *testing.T) {
+	buf := new(bytes.Buffer)
+	hello := NewClientHello(make([]byte, 192), []byte("sig"), CapMultipath)
+	hello.Options = SetOption(hello.Options, "foo", []byte("bar"))
+	rlp.Encode(buf, hello)
+	ch, err := ReadClientHello(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Version != Version || !ch.HasCap(CapMultipath) || string(ch.Option("foo")) != "bar" {
+		t.Fatal("bad decode", ch)
+	}
+}
+
+func TestExitHello(t *testing.T) {
+	for _, ver := range []uint{0, Version} {
+		buf := new(bytes.Buffer)
+		ExitHello{Version: Version, Status: "FAIL", Reason: FailPaidOnly}.Encode(buf, ver)
+		eh, err := ReadExitHello(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eh.OK() {
+			t.Fatal("should not be OK")
+		}
+		if ver > 0 && eh.Reason != FailPaidOnly {
+			t.Fatal("lost reason", eh)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package flowmux multiplexes many flows over one reliable connection. Unlike smux, every flow has its own credit-based window, so a flow whose reader is slow only stalls itself and never the other flows sharing the connection.
+package flowmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// frame types
+const (
+	frmOpen   = 0
+	frmData   = 1
+	frmCredit = 2
+	frmClose  = 3
+)
+
+const (
+	headerSize = 7
+	// maxFrame is the largest data payload in one frame
+	maxFrame = 16384
+	// window is how many bytes may be in flight, unread, per flow
+	window = 256 * 1024
+	// acceptBacklog is how many opened flows may wait for Accept
+	acceptBacklog = 1024
+)
+
+// ErrClosed is returned when using a closed flow or session.
+var ErrClosed = errors.New("flowmux: closed")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "flowmux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session is one end of a multiplexed connection.
+type Session struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	flows  map[uint32]*Flow
+	nextID uint32
+
+	accept  chan *Flow
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client creates the dialing end of a session over conn.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server creates the accepting end of a session over conn.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:   conn,
+		flows:  make(map[uint32]*Flow),
+		nextID: firstID,
+		accept: make(chan *Flow, acceptBacklog),
+		die:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new flow. meta is delivered to the other end, which sees it as the flow's remote address.
+func (s *Session) Open(meta string) (*Flow, error) {
+	if len(meta) > maxFrame {
+		return nil, errors.New("flowmux: metadata too long")
+	}
+	s.lock.Lock()
+	select {
+	case <-s.die:
+		s.lock.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	f := newFlow(s, id, meta)
+	s.flows[id] = f
+	s.lock.Unlock()
+	if err := s.writeFrame(frmOpen, id, []byte(meta)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Accept waits for the other end to open a flow.
+func (s *Session) Accept() (*Flow, error) {
+	select {
+	case f := <-s.accept:
+		return f, nil
+	case <-s.die:
+		return nil, s.dieErr
+	}
+}
+
+// NumFlows returns the number of open flows.
+func (s *Session) NumFlows() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.flows)
+}
+
+// IsClosed returns whether the session is dead.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session and every flow in it.
+func (s *Session) Close() error {
+	s.kill(ErrClosed)
+	return nil
+}
+
+func (s *Session) kill(err error) {
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(payload)))
+	copy(buf[headerSize:], payload)
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	select {
+	case <-s.die:
+		return ErrClosed
+	default:
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.kill(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) getFlow(id uint32) *Flow {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flows[id]
+}
+
+func (s *Session) removeFlow(id uint32) {
+	s.lock.Lock()
+	delete(s.flows, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.kill(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(header[1:5])
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:7]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.kill(err)
+			return
+		}
+		switch header[0] {
+		case frmOpen:
+			s.lock.Lock()
+			if _, ok := s.flows[id]; ok || id%2 == s.nextID%2 {
+				s.lock.Unlock()
+				s.kill(errors.New("flowmux: bad flow id"))
+				return
+			}
+			f := newFlow(s, id, string(payload))
+			s.flows[id] = f
+			s.lock.Unlock()
+			select {
+			case s.accept <- f:
+			case <-s.die:
+				return
+			}
+		case frmData:
+			if f := s.getFlow(id); f != nil {
+				if !f.pushData(payload) {
+					s.kill(errors.New("flowmux: peer overran window"))
+					return
+				}
+			}
+		case frmCredit:
+			if len(payload) != 4 {
+				s.kill(errors.New("flowmux: bad credit frame"))
+				return
+			}
+			if f := s.getFlow(id); f != nil {
+				f.addCredit(int(binary.BigEndian.Uint32(payload)))
+			}
+		case frmClose:
+			if f := s.getFlow(id); f != nil {
+				f.remoteClose()
+			}
+		default:
+			s.kill(errors.New("flowmux: bad frame type"))
+			return
+		}
+	}
+}
+
+// Flow is one multiplexed flow. It implements net.Conn.
+type Flow struct {
+	sess *Session
+	id   uint32
+	meta string
+
+	lock       sync.Mutex
+	rbuf       []byte
+	consumed   int
+	credit     int
+	remoteDone bool
+	rdeadline  time.Time
+	wdeadline  time.Time
+	// changed is closed and replaced whenever anything above changes
+	changed chan struct{}
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newFlow(s *Session, id uint32, meta string) *Flow {
+	return &Flow{
+		sess:    s,
+		id:      id,
+		meta:    meta,
+		credit:  window,
+		changed: make(chan struct{}),
+		die:     make(chan struct{}),
+	}
+}
+
+// broadcast wakes up everybody waiting on the flow. The lock must be held.
+func (f *Flow) broadcast() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *Flow) pushData(b []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.rbuf)+len(b) > window {
+		return false
+	}
+	f.rbuf = append(f.rbuf, b...)
+	f.broadcast()
+	return true
+}
+
+func (f *Flow) addCredit(n int) {
+	f.lock.Lock()
+	f.credit += n
+	f.broadcast()
+	f.lock.Unlock()
+}
+
+func (f *Flow) remoteClose() {
+	f.lock.Lock()
+	f.remoteDone = true
+	f.broadcast()
+	f.lock.Unlock()
+}
+
+// wait blocks until changed is closed, the deadline passes, or the flow dies.
+func (f *Flow) wait(changed chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	case <-f.die:
+		return ErrClosed
+	case <-f.sess.die:
+		return f.sess.dieErr
+	}
+}
+
+// Read implements net.Conn.
+func (f *Flow) Read(p []byte) (int, error) {
+	for {
+		f.lock.Lock()
+		if len(f.rbuf) > 0 {
+			n := copy(p, f.rbuf)
+			f.rbuf = f.rbuf[n:]
+			f.consumed += n
+			var grant int
+			if f.consumed >= window/4 {
+				grant = f.consumed
+				f.consumed = 0
+			}
+			f.lock.Unlock()
+			if grant > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(grant))
+				f.sess.writeFrame(frmCredit, f.id, b[:])
+			}
+			return n, nil
+		}
+		if f.remoteDone {
+			f.lock.Unlock()
+			return 0, io.EOF
+		}
+		changed, deadline := f.changed, f.rdeadline
+		f.lock.Unlock()
+		if err := f.wait(changed, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (f *Flow) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		f.lock.Lock()
+		if f.remoteDone {
+			f.lock.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if f.credit > 0 {
+			n := len(p) - written
+			if n > f.credit {
+				n = f.credit
+			}
+			if n > maxFrame {
+				n = maxFrame
+			}
+			f.credit -= n
+			f.lock.Unlock()
+			select {
+			case <-f.die:
+				return written, ErrClosed
+			default:
+			}
+			if err := f.sess.writeFrame(frmData, f.id, p[written:written+n]); err != nil {
+				return written, err
+			}
+			written += n
+			continue
+		}
+		changed, deadline := f.changed, f.wdeadline
+		f.lock.Unlock()
+		if err := f.wait(changed, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the flow in both directions.
+func (f *Flow) Close() error {
+	f.dieOnce.Do(func() {
+		close(f.die)
+		f.sess.removeFlow(f.id)
+		f.sess.writeFrame(frmClose, f.id, nil)
+	})
+	return nil
+}
+
+// SetDeadline implements net.Conn.
+func (f *Flow) SetDeadline(t time.Time) error {
+	f.lock.Lock()
+	f.rdeadline = t
+	f.wdeadline = t
+	f.broadcast()
+	f.lock.Unlock()
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (f *Flow) SetReadDeadline(t time.Time) error {
+	f.lock.Lock()
+	f.rdeadline = t
+	f.broadcast()
+	f.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (f *Flow) SetWriteDeadline(t time.Time) error {
+	f.lock.Lock()
+	f.wdeadline = t
+	f.broadcast()
+	f.lock.Unlock()
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (f *Flow) LocalAddr() net.Addr {
+	return f.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the metadata the flow was opened with, or the underlying connection's remote address if there was none.
+func (f *Flow) RemoteAddr() net.Addr {
+	if f.meta == "" {
+		return f.sess.conn.RemoteAddr()
+	}
+	return flowAddr(f.meta)
+}
+
+type flowAddr string
+
+func (fa flowAddr) Network() string { return "flowmux" }
+func (fa flowAddr) String() string  { return string(fa) }
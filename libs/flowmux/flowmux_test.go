@@ -0,0 +1,172 @@
+package flowmux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tcpPair(t *testing.T) (*Session, *Session) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := listener.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Client(dialed), Server(<-accepted)
+}
+
+func echo(s *Session) {
+	for {
+		f, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer f.Close()
+			io.Copy(f, f)
+		}()
+	}
+}
+
+func TestEcho(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	go echo(server)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := client.Open("1.2.3.4:5678")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			data := make([]byte, 1024*1024)
+			rand.Read(data)
+			go f.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(f, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(data, got) {
+				t.Error("echoed data differs")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMeta(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	if _, err := client.Open("1.2.3.4:5678"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.RemoteAddr().String() != "1.2.3.4:5678" {
+		t.Fatal("wrong remote address", f.RemoteAddr())
+	}
+}
+
+// TestBackpressure checks that a flow nobody reads from doesn't hold up other flows.
+func TestBackpressure(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	stuck, _ := client.Open("stuck")
+	server.Accept()
+	// fill up the stuck flow's window and then some
+	blocked := make(chan int)
+	go func() {
+		n, _ := stuck.Write(make([]byte, window*4))
+		blocked <- n
+	}()
+	time.Sleep(time.Millisecond * 100)
+	go echo(server)
+	f, err := client.Open("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, window*4)
+	go f.Write(data)
+	f.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(f, data); err != nil {
+		t.Fatal("other flow stalled:", err)
+	}
+	select {
+	case n := <-blocked:
+		t.Fatal("stuck flow wrote", n, "bytes without anybody reading")
+	default:
+	}
+	stuck.SetWriteDeadline(time.Now())
+	if n := <-blocked; n != window {
+		t.Fatal("stuck flow wrote", n, "bytes, window is", window)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	f, _ := client.Open("")
+	f.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	start := time.Now()
+	_, err := f.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("deadline took too long")
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	f, _ := client.Open("")
+	sf, _ := server.Accept()
+	f.Write([]byte("hello"))
+	f.Close()
+	got, err := ioutil.ReadAll(sf)
+	if err != nil || string(got) != "hello" {
+		t.Fatal("expected hello then EOF, got", string(got), err)
+	}
+	if _, err := sf.Write([]byte("x")); err == nil {
+		t.Fatal("write to closed flow succeeded")
+	}
+	if client.NumFlows() != 0 {
+		t.Fatal("closed flow still counted")
+	}
+	// closing the session kills everything
+	f, _ = client.Open("")
+	sf, _ = server.Accept()
+	server.Close()
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded on dead session")
+	}
+	if _, err := client.Open(""); err == nil {
+		t.Fatal("open succeeded on dead session")
+	}
+}
@@ -205,6 +205,8 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 
 // FlowStats summarizes flow statistics
 func (s *UDPSession) FlowStats() (btlBw float64, latency float64, lossFrac float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.kcp.DRE.maxAckRate, s.kcp.DRE.minRtt, float64(s.kcp.retrans) / float64(s.kcp.trans)
 }
 
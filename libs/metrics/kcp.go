@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+// ReportKCP reports the KCP retransmission ratio from kcp.DefaultSnmp every interval. It never returns.
+func ReportKCP(sink Sink, interval time.Duration) {
+	lastTotal := uint64(0)
+	lastRetrans := uint64(0)
+	for {
+		time.Sleep(interval)
+		s := kcp.DefaultSnmp.Copy()
+		deltaTotal := float64(s.OutSegs - lastTotal)
+		lastTotal = s.OutSegs
+		deltaRetrans := float64(s.RetransSegs - lastRetrans)
+		lastRetrans = s.RetransSegs
+		if deltaTotal+deltaRetrans == 0 {
+			continue
+		}
+		sink.Gauge(KCPLoss, deltaRetrans/(deltaRetrans+deltaTotal))
+	}
+}
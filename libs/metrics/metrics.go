@@ -0,0 +1,84 @@
+// Package metrics is a small metrics interface shared by the exit and the bridge, with statsd, Prometheus and no-op backends.
+package metrics
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Metric names that both the exit and the bridge report. Backends may rewrite the separators.
+const (
+	// Sessions is a gauge of active client sessions.
+	Sessions = "sessions"
+	// SessionsTotal counts sessions ever accepted.
+	SessionsTotal = "sessions.total"
+	// Streams is a gauge of active streams (proxied connections on the exit, relayed connections on the bridge).
+	Streams = "streams"
+	// Bytes counts bytes relayed in both directions.
+	Bytes = "bytes"
+	// DialLatency times dialing upstream (destinations on the exit, exits on the bridge).
+	DialLatency = "dial.latency"
+	// KCPLoss is a gauge of the KCP retransmission ratio.
+	KCPLoss = "kcp.loss"
+	// TicketPaid, TicketFree and TicketBad count ticket redemption results.
+	TicketPaid = "ticket.paid"
+	TicketFree = "ticket.free"
+	TicketBad  = "ticket.bad"
+)
+
+// Sink receives metrics. Implementations must be safe for concurrent use.
+type Sink interface {
+	// Count adds delta to a counter.
+	Count(name string, delta int64)
+	// Gauge sets a gauge.
+	Gauge(name string, value float64)
+	// Timing records a duration.
+	Timing(name string, d time.Duration)
+}
+
+// Nop is a Sink that discards everything.
+var Nop Sink = nop{}
+
+type nop struct{}
+
+func (nop) Count(string, int64)          {}
+func (nop) Gauge(string, float64)        {}
+func (nop) Timing(string, time.Duration) {}
+
+// Open creates a Sink given a backend name ("statsd", "prometheus" or "none") and the backend's address. For statsd, addr is where to send to and prefix is prepended to every name; for Prometheus, addr is where to serve /metrics and prefix becomes the namespace.
+func Open(backend, addr, prefix string) (Sink, error) {
+	switch backend {
+	case "none", "":
+		return Nop, nil
+	case "statsd":
+		if addr == "" {
+			return Nop, nil
+		}
+		return NewStatsd(addr, prefix)
+	case "prometheus":
+		prom := NewPrometheus(prefix)
+		if addr != "" {
+			go prom.ListenAndServe(addr)
+		}
+		return prom, nil
+	default:
+		return nil, fmt.Errorf("unknown metrics backend %q", backend)
+	}
+}
+
+// Accumulate returns a function that adds to a counter cheaply, flushing the total to the sink every interval. It is meant for counters like Bytes that are bumped on every packet.
+func Accumulate(sink Sink, name string, interval time.Duration) func(delta int64) {
+	var n int64
+	go func() {
+		for {
+			time.Sleep(interval)
+			if delta := atomic.SwapInt64(&n, 0); delta != 0 {
+				sink.Count(name, delta)
+			}
+		}
+	}()
+	return func(delta int64) {
+		atomic.AddInt64(&n, delta)
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus("geph_exit")
+	p.Count(Bytes, 100)
+	p.Count(Bytes, 23)
+	p.Gauge(Sessions, 2)
+	p.Gauge(Sessions, 3)
+	p.Timing(DialLatency, time.Millisecond*500)
+	p.Timing(DialLatency, time.Millisecond*1500)
+	buf := new(bytes.Buffer)
+	p.WriteTo(buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE geph_exit_bytes_total counter\ngeph_exit_bytes_total 123\n",
+		"# TYPE geph_exit_sessions gauge\ngeph_exit_sessions 3\n",
+		"geph_exit_dial_latency_seconds_sum 2\n",
+		"geph_exit_dial_latency_seconds_count 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%v", want, out)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, backend := range []string{"", "none", "statsd"} {
+		sink, err := Open(backend, "", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sink != Nop {
+			t.Errorf("backend %q without an address should be a no-op", backend)
+		}
+	}
+	sink, err := Open("statsd", "127.0.0.1:8125", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Count(Bytes, 1)
+	if _, err := Open("carrier-pigeon", "", ""); err == nil {
+		t.Error("unknown backend accepted")
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	p := NewPrometheus("")
+	add := Accumulate(p, Bytes, time.Millisecond*10)
+	for i := 0; i < 100; i++ {
+		add(10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.counters[Bytes] != 1000 {
+		t.Fatal("expected 1000 bytes, got", p.counters[Bytes])
+	}
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus keeps metrics in memory and serves them in the Prometheus text format. Timings are exposed as summaries in seconds, without quantiles.
+type Prometheus struct {
+	namespace string
+
+	lock     sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	timings  map[string]*summary
+}
+
+type summary struct {
+	count uint64
+	sum   float64
+}
+
+// NewPrometheus creates a Prometheus sink. Every name is prefixed with namespace.
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		namespace: namespace,
+		counters:  make(map[string]int64),
+		gauges:    make(map[string]float64),
+		timings:   make(map[string]*summary),
+	}
+}
+
+// Count implements Sink.
+func (p *Prometheus) Count(name string, delta int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters[name] += delta
+}
+
+// Gauge implements Sink.
+func (p *Prometheus) Gauge(name string, value float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gauges[name] = value
+}
+
+// Timing implements Sink.
+func (p *Prometheus) Timing(name string, d time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.timings[name]
+	if !ok {
+		s = new(summary)
+		p.timings[name] = s
+	}
+	s.count++
+	s.sum += d.Seconds()
+}
+
+func (p *Prometheus) promName(name string) string {
+	if p.namespace != "" {
+		name = p.namespace + "_" + name
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// WriteTo writes out all metrics in the Prometheus text format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.lock.Lock()
+	var lines []string
+	for name, v := range p.counters {
+		n := p.promName(name) + "_total"
+		lines = append(lines, fmt.Sprintf("# TYPE %v counter\n%v %v\n", n, n, v))
+	}
+	for name, v := range p.gauges {
+		n := p.promName(name)
+		lines = append(lines, fmt.Sprintf("# TYPE %v gauge\n%v %v\n", n, n, v))
+	}
+	for name, s := range p.timings {
+		n := p.promName(name) + "_seconds"
+		lines = append(lines, fmt.Sprintf("# TYPE %v summary\n%v_sum %v\n%v_count %v\n", n, n, s.sum, n, s.count))
+	}
+	p.lock.Unlock()
+	sort.Strings(lines)
+	var total int64
+	for _, l := range lines {
+		n, err := io.WriteString(w, l)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+// ListenAndServe serves /metrics on the given address.
+func (p *Prometheus) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	return http.ListenAndServe(addr, mux)
+}
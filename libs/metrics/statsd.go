@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"net"
+	"time"
+
+	statsd "github.com/etsy/statsd/examples/go"
+)
+
+// Statsd sends metrics to a statsd server. Gauges are sent as timings in thousandths, since the underlying client has no gauge support.
+type Statsd struct {
+	client *statsd.StatsdClient
+	prefix string
+}
+
+// NewStatsd creates a Statsd sink. Every name is prefixed with prefix and a dot.
+func NewStatsd(addr, prefix string) (*Statsd, error) {
+	z, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	return &Statsd{
+		client: statsd.New(z.IP.String(), z.Port),
+		prefix: prefix,
+	}, nil
+}
+
+// Count implements Sink.
+func (s *Statsd) Count(name string, delta int64) {
+	s.client.IncrementByValue(s.prefix+name, int(delta))
+}
+
+// Gauge implements Sink.
+func (s *Statsd) Gauge(name string, value float64) {
+	s.client.Timing(s.prefix+name, int64(value*1000))
+}
+
+// Timing implements Sink.
+func (s *Statsd) Timing(name string, d time.Duration) {
+	s.client.Timing(s.prefix+name, d.Milliseconds())
+}
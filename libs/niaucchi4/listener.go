@@ -63,3 +63,15 @@ func (l *Listener) Accept() (c *kcp.UDPSession, err error) {
 	c = kc
 	return
 }
+
+// BandwidthLatency returns a function that reports the bottleneck bandwidth and latency of conn, or nil if conn is not a KCP session.
+func BandwidthLatency(conn net.Conn) func() (float64, float64) {
+	kc, ok := conn.(*kcp.UDPSession)
+	if !ok {
+		return nil
+	}
+	return func() (float64, float64) {
+		btlBw, latency, _ := kc.FlowStats()
+		return btlBw, latency
+	}
+}
@@ -29,13 +29,16 @@ func (sa oAddr) String() string {
 
 // ObfsSocket represents an obfuscated PacketConn.
 type ObfsSocket struct {
-	cookie  []byte
-	sscache *cache.Cache
-	tunnels *cache.Cache
-	pending *cache.Cache
-	wire    net.PacketConn
-	wlock   sync.Mutex
-	rdbuf   [65536]byte
+	cookie     []byte
+	oldCookies []oldCookie
+	cookieLock sync.Mutex
+	sscache    *cache.Cache
+	tunnels    *cache.Cache
+	pending    *cache.Cache
+	replies    *cache.Cache
+	wire       net.PacketConn
+	wlock      sync.Mutex
+	rdbuf      [65536]byte
 }
 
 // ObfsListen opens a new obfuscated PacketConn.
@@ -45,10 +48,48 @@ func ObfsListen(cookie []byte, wire net.PacketConn) *ObfsSocket {
 		sscache: cache.New(time.Hour*24, time.Hour),
 		tunnels: cache.New(time.Hour*24, time.Hour),
 		pending: cache.New(time.Second, time.Hour),
+		replies: cache.New(time.Minute, time.Hour),
 		wire:    wire,
 	}
 }
 
+type oldCookie struct {
+	cookie []byte
+	until  time.Time
+}
+
+// SetCookie changes the cookie used for new sessions. Hellos using the previous cookie are still accepted for the overlap period, so that peers who haven't learned the new cookie yet can still connect. Established sessions are unaffected.
+func (os *ObfsSocket) SetCookie(cookie []byte, overlap time.Duration) {
+	os.cookieLock.Lock()
+	defer os.cookieLock.Unlock()
+	now := time.Now()
+	var stillOK []oldCookie
+	for _, oc := range os.oldCookies {
+		if now.Before(oc.until) {
+			stillOK = append(stillOK, oc)
+		}
+	}
+	if overlap > 0 {
+		stillOK = append(stillOK, oldCookie{os.cookie, now.Add(overlap)})
+	}
+	os.cookie = cookie
+	os.oldCookies = stillOK
+}
+
+// acceptedCookies returns the current cookie, followed by previous cookies still within their overlap period.
+func (os *ObfsSocket) acceptedCookies() [][]byte {
+	os.cookieLock.Lock()
+	defer os.cookieLock.Unlock()
+	toret := [][]byte{os.cookie}
+	now := time.Now()
+	for _, oc := range os.oldCookies {
+		if now.Before(oc.until) {
+			toret = append(toret, oc.cookie)
+		}
+	}
+	return toret
+}
+
 func (os *ObfsSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
 	switch addr.(type) {
 	case oAddr:
@@ -76,7 +117,7 @@ func (os *ObfsSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
 		return len(b), nil
 	}
 	// establish a conn
-	pt, hello := newproto(os.cookie)
+	pt, hello := newproto(os.acceptedCookies()[0])
 	if doLogging {
 		log.Println("N4: establishing to", addr.String())
 	}
@@ -103,6 +144,12 @@ RESTART:
 		//log.Println("got packet of known tunnel from", addr.String())
 		plain, e := tun.Decrypt(os.rdbuf[:readBytes])
 		if e != nil {
+			// the peer may be resending its hello because our reply got lost
+			if myhello, ok := os.replies.Get(string(os.rdbuf[:readBytes])); ok {
+				os.wlock.Lock()
+				os.wire.WriteTo(myhello.([]byte), addr)
+				os.wlock.Unlock()
+			}
 			goto RESTART
 		}
 		os.tunnels.SetDefault(addr.String(), tun)
@@ -148,12 +195,21 @@ RESTART:
 			return
 		}
 	}
-	// otherwise it has to be some sort of tunnel opener
+	// otherwise it has to be some sort of tunnel opener, answered with whichever cookie it used
 	//log.Println("got suspected hello")
-	pt, myhello := newproto(os.cookie)
-	ts, e := pt.realize(os.rdbuf[:readBytes], true)
-	if e != nil {
-		// log.Println("got bad hello", e)
+	var ts *tunstate
+	var myhello []byte
+	for _, cookie := range os.acceptedCookies() {
+		var pt *prototun
+		var e error
+		pt, myhello = newproto(cookie)
+		ts, e = pt.realize(os.rdbuf[:readBytes], true)
+		if e == nil {
+			break
+		}
+	}
+	if ts == nil {
+		// log.Println("got bad hello")
 		goto RESTART
 	}
 	os.wlock.Lock()
@@ -164,6 +220,7 @@ RESTART:
 	os.wlock.Unlock()
 	os.tunnels.SetDefault(addr.String(), ts)
 	os.sscache.SetDefault(string(ts.ss), addr)
+	os.replies.SetDefault(string(os.rdbuf[:readBytes]), myhello)
 	goto RESTART
 }
 
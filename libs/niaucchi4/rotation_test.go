@@ -0,0 +1,135 @@
+package niaucchi4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestObfs(t *testing.T, cookie []byte) *ObfsSocket {
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ObfsListen(cookie, sock)
+}
+
+// roundTrip sends a message from client to server and waits for the server to echo it.
+func roundTrip(client, server *ObfsSocket) bool {
+	msg := make([]byte, 16)
+	rand.Read(msg)
+	// the first writes only send hellos, so keep writing until something comes back
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			client.WriteTo(msg, server.LocalAddr())
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 20):
+			}
+		}
+	}()
+	buf := make([]byte, 1000)
+	client.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	for {
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(buf[:n], msg) {
+			return true
+		}
+	}
+}
+
+func TestCookieRotation(t *testing.T) {
+	oldCookie := make([]byte, 32)
+	newCookie := make([]byte, 32)
+	rand.Read(oldCookie)
+	rand.Read(newCookie)
+	server := newTestObfs(t, oldCookie)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+	established := newTestObfs(t, oldCookie)
+	defer established.Close()
+	if !roundTrip(established, server) {
+		t.Fatal("could not connect with the original cookie")
+	}
+	server.SetCookie(newCookie, time.Second)
+	// during the overlap, both cookies work
+	for _, cookie := range [][]byte{oldCookie, newCookie} {
+		client := newTestObfs(t, cookie)
+		defer client.Close()
+		if !roundTrip(client, server) {
+			t.Fatalf("cookie %x refused during overlap", cookie[:4])
+		}
+	}
+	time.Sleep(time.Second)
+	// afterwards, only the new cookie opens sessions, but established sessions live on
+	stale := newTestObfs(t, oldCookie)
+	defer stale.Close()
+	if roundTrip(stale, server) {
+		t.Fatal("old cookie still accepted after the overlap")
+	}
+	fresh := newTestObfs(t, newCookie)
+	defer fresh.Close()
+	if !roundTrip(fresh, server) {
+		t.Fatal("new cookie refused")
+	}
+	if !roundTrip(established, server) {
+		t.Fatal("established session broken by rotation")
+	}
+}
+
+// dropFirstWrite is a PacketConn that loses the first packet it sends.
+type dropFirstWrite struct {
+	net.PacketConn
+	dropped bool
+}
+
+func (d *dropFirstWrite) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !d.dropped {
+		d.dropped = true
+		return len(b), nil
+	}
+	return d.PacketConn.WriteTo(b, addr)
+}
+
+func TestLostHelloReply(t *testing.T) {
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ObfsListen(cookie, &dropFirstWrite{PacketConn: sock})
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+	client := newTestObfs(t, cookie)
+	defer client.Close()
+	if !roundTrip(client, server) {
+		t.Fatal("lost reply to the hello was never resent")
+	}
+}
@@ -129,12 +129,12 @@ func newproto(cookie []byte) (pt *prototun, hello []byte) {
 	padd := make([]byte, mrand.Int()%1000)
 	buf.Write(padd)
 	// return
+	hello = buf.Bytes()
 	pt = &prototun{
 		mySK:   sk,
 		cookie: cookie,
 		hello:  hello,
 	}
-	hello = buf.Bytes()
 	return
 }
 
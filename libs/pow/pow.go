@@ -0,0 +1,50 @@
+// Package pow implements the hashcash-style proof of work that the binder asks of clients that register without solving a captcha.
+package pow
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"time"
+)
+
+func hash(challenge []byte, nonce uint64) [32]byte {
+	buf := make([]byte, len(challenge)+8)
+	copy(buf, challenge)
+	binary.BigEndian.PutUint64(buf[len(challenge):], nonce)
+	return sha256.Sum256(buf)
+}
+
+// zeroBits counts the leading zero bits of a hash.
+func zeroBits(h [32]byte) int {
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Check says whether the SHA-256 hash of the challenge followed by the big-endian nonce starts with at least difficulty zero bits.
+func Check(challenge []byte, difficulty int, nonce uint64) bool {
+	return zeroBits(hash(challenge, nonce)) >= difficulty
+}
+
+// ErrDeadline is returned by Solve when it runs out of time.
+var ErrDeadline = errors.New("proof of work not done in time")
+
+// Solve finds a nonce that passes Check, giving up at the deadline. It takes about 2^difficulty hashes.
+func Solve(challenge []byte, difficulty int, deadline time.Time) (uint64, error) {
+	for nonce := uint64(0); ; nonce++ {
+		// looking at the clock costs about as much as hashing, so don't do it every time
+		if nonce%1024 == 0 && time.Now().After(deadline) {
+			return 0, ErrDeadline
+		}
+		if Check(challenge, difficulty, nonce) {
+			return nonce, nil
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package pow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoW(t *testing.T) {
+	challenge := []byte("geph pow test")
+	nonce, err := Solve(challenge, 12, time.Now().Add(time.Minute))
+	if err != nil || !Check(challenge, 12, nonce) {
+		t.Fatal("solution doesn't check")
+	}
+	if Check([]byte("another challenge"), 12, nonce) && Check(challenge, 12, nonce+1) {
+		t.Fatal("everything passes")
+	}
+	if !Check(challenge, 0, 12345) {
+		t.Fatal("difficulty 0 needs work")
+	}
+	if _, err := Solve(challenge, 200, time.Now().Add(time.Millisecond*100)); err != ErrDeadline {
+		t.Fatal("solved an impossible challenge:", err)
+	}
+	var h [32]byte
+	h[1] = 0x10
+	if zeroBits(h) != 11 {
+		t.Fatal("miscounted zero bits:", zeroBits(h))
+	}
+}
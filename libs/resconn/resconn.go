@@ -0,0 +1,558 @@
+// Package resconn implements a reliable net.Conn whose underlying transports can be replaced, or used several at a time, without losing data.
+//
+// Both ends keep every byte they send until the other side acknowledges it. Data frames carry their sequence numbers, so the receiver can reassemble frames that arrive out of order over different transports. When a transport dies, everything unacknowledged is sent again over the remaining ones.
+//
+// Acknowledgements also carry a receive window, which says how far the sender may go. The window only opens as the application reads, so a peer can't make us buffer more than maxRecvBuf bytes that nobody reads.
+package resconn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when the Conn has been closed, either explicitly or because no transport was attached within the grace period.
+var ErrClosed = errors.New("resconn closed")
+
+var errSuperseded = errors.New("superseded by another transport")
+
+const (
+	frameData = 0
+	frameAck  = 1
+
+	maxChunk    = 16384
+	maxUnacked  = 8 * 1024 * 1024
+	maxRecvBuf  = 4 * 1024 * 1024
+	minBudget   = 64 * 1024
+	ackEvery    = 16 * 1024
+	pingEvery   = time.Second * 5
+	wireTimeout = time.Second * 30
+)
+
+// StatsFunc reports the bottleneck bandwidth (bytes per second) and latency (milliseconds) of a transport, like kcp.UDPSession.FlowStats.
+type StatsFunc func() (btlBw float64, latency float64)
+
+type path struct {
+	wire    net.Conn
+	stats   StatsFunc
+	pingDue bool
+	// ends and sizes of the data frames sent over this path and not yet acknowledged
+	inflight []uint64
+	sizes    []uint64
+}
+
+func (p *path) inflightBytes() (n uint64) {
+	for _, s := range p.sizes {
+		n += s
+	}
+	return
+}
+
+func (p *path) budget() uint64 {
+	if p.stats == nil {
+		return maxUnacked
+	}
+	btlBw, latency := p.stats()
+	bdp := uint64(2 * (latency + 20) * 0.001 * btlBw)
+	if bdp < minBudget {
+		return minBudget
+	}
+	return bdp
+}
+
+func (p *path) latency() float64 {
+	if p.stats == nil {
+		return -1
+	}
+	_, latency := p.stats()
+	return latency
+}
+
+// Conn is a resumable, possibly multipath, connection.
+type Conn struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	paths   map[uint64]*path
+	pathCtr uint64
+	grace   time.Duration
+	dead    *time.Timer
+	closed  bool
+
+	// send side; sendBuf[0] has sequence number ackedSeq, and the peer's window ends at peerLimit
+	sendBuf   []byte
+	ackedSeq  uint64
+	sentSeq   uint64
+	peerLimit uint64
+
+	// receive side; recvBuf ends at recvSeq, and the window we last told the peer about ends at ackLimit
+	recvBuf  []byte
+	recvSeq  uint64
+	reorder  map[uint64][]byte
+	ackSeq   uint64
+	ackLimit uint64
+}
+
+// New creates a Conn with no transport attached. If no transport is attached for longer than grace, the Conn closes itself.
+func New(grace time.Duration) *Conn {
+	c := &Conn{
+		grace:   grace,
+		paths:   make(map[uint64]*path),
+		reorder: make(map[uint64][]byte),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	c.lock.Lock()
+	c.startGrace()
+	c.lock.Unlock()
+	go c.pingLoop()
+	return c
+}
+
+func (c *Conn) startGrace() {
+	ctr := c.pathCtr
+	c.dead = time.AfterFunc(c.grace, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if len(c.paths) == 0 && c.pathCtr == ctr {
+			c.closeLocked()
+		}
+	})
+}
+
+// Attach attaches a new transport, replacing all existing ones, then services it until it fails. The returned error is ErrClosed if the Conn itself is closed.
+func (c *Conn) Attach(wire net.Conn) error {
+	return c.attach(wire, nil, true)
+}
+
+// AddPath attaches an additional transport alongside the existing ones, then services it until it fails. Data is striped across transports, preferring the lowest-latency one that still has room according to stats, which may be nil.
+func (c *Conn) AddPath(wire net.Conn, stats StatsFunc) error {
+	return c.attach(wire, stats, false)
+}
+
+func (c *Conn) attach(wire net.Conn, stats StatsFunc, replace bool) (err error) {
+	defer wire.Close()
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return ErrClosed
+	}
+	if replace {
+		for id, p := range c.paths {
+			p.wire.Close()
+			delete(c.paths, id)
+		}
+	}
+	c.pathCtr++
+	id := c.pathCtr
+	ourSeq, ourLimit := c.recvSeq, c.limitLocked()
+	if c.dead != nil {
+		c.dead.Stop()
+	}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.dropPath(id)
+		if c.closed {
+			err = ErrClosed
+		}
+	}()
+	// exchange receive counters and windows
+	wire.SetDeadline(time.Now().Add(wireTimeout))
+	written := make(chan error, 1)
+	go func() {
+		b := make([]byte, 16)
+		binary.BigEndian.PutUint64(b, ourSeq)
+		binary.BigEndian.PutUint64(b[8:], ourLimit)
+		_, err := wire.Write(b)
+		written <- err
+	}()
+	b := make([]byte, 16)
+	if _, err = io.ReadFull(wire, b); err != nil {
+		return
+	}
+	if err = <-written; err != nil {
+		return
+	}
+	wire.SetDeadline(time.Time{})
+	theirSeq := binary.BigEndian.Uint64(b)
+	theirLimit := binary.BigEndian.Uint64(b[8:])
+	c.lock.Lock()
+	if c.closed || replace && c.pathCtr != id {
+		c.lock.Unlock()
+		return errSuperseded
+	}
+	if theirSeq > c.ackedSeq+uint64(len(c.sendBuf)) {
+		c.closeLocked()
+		c.lock.Unlock()
+		return errors.New("peer has impossible receive counter")
+	}
+	c.ackLocked(theirSeq, theirLimit)
+	if c.ackLimit < ourLimit {
+		c.ackLimit = ourLimit
+	}
+	// with no other transport carrying it, resend whatever the peer hasn't received, but nothing it has
+	if len(c.paths) == 0 {
+		c.sentSeq = c.ackedSeq
+	}
+	p := &path{wire: wire, stats: stats}
+	c.paths[id] = p
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	go c.sendLoop(id, p)
+	return c.readLoop(wire, id)
+}
+
+// dropPath removes a path and arranges for its unacknowledged data to be sent elsewhere. Must be called with the lock held.
+func (c *Conn) dropPath(id uint64) {
+	if p, ok := c.paths[id]; ok {
+		p.wire.Close()
+		delete(c.paths, id)
+		if len(p.inflight) > 0 {
+			c.sentSeq = c.ackedSeq
+		}
+		c.cond.Broadcast()
+	}
+	if len(c.paths) == 0 && !c.closed {
+		if c.dead != nil {
+			c.dead.Stop()
+		}
+		c.startGrace()
+	}
+}
+
+// limitLocked returns where our receive window ends. Must be called with the lock held.
+func (c *Conn) limitLocked() uint64 {
+	return c.recvSeq - uint64(len(c.recvBuf)) + maxRecvBuf
+}
+
+// ackLocked processes an acknowledgement and the window that came with it. Must be called with the lock held.
+func (c *Conn) ackLocked(seq uint64, limit uint64) {
+	if limit > c.peerLimit {
+		c.peerLimit = limit
+		c.cond.Broadcast()
+	}
+	if seq <= c.ackedSeq || seq > c.ackedSeq+uint64(len(c.sendBuf)) {
+		return
+	}
+	c.sendBuf = c.sendBuf[seq-c.ackedSeq:]
+	c.ackedSeq = seq
+	if c.sentSeq < seq {
+		c.sentSeq = seq
+	}
+	for _, p := range c.paths {
+		for len(p.inflight) > 0 && p.inflight[0] <= seq {
+			p.inflight = p.inflight[1:]
+			p.sizes = p.sizes[1:]
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// deliverLocked processes incoming data, which may be out of order or duplicated. Data beyond our window is an error. Must be called with the lock held.
+func (c *Conn) deliverLocked(seq uint64, data []byte) error {
+	end := seq + uint64(len(data))
+	if end > c.limitLocked() {
+		return errors.New("peer overran the receive window")
+	}
+	if end <= c.recvSeq {
+		return nil
+	}
+	if seq > c.recvSeq {
+		if len(c.reorder) < 2*maxUnacked/maxChunk {
+			c.reorder[seq] = append([]byte(nil), data...)
+		}
+		return nil
+	}
+	c.recvBuf = append(c.recvBuf, data[c.recvSeq-seq:]...)
+	c.recvSeq = end
+	for progress := true; progress; {
+		progress = false
+		for k, v := range c.reorder {
+			kend := k + uint64(len(v))
+			if kend <= c.recvSeq {
+				delete(c.reorder, k)
+			} else if k <= c.recvSeq {
+				c.recvBuf = append(c.recvBuf, v[c.recvSeq-k:]...)
+				c.recvSeq = kend
+				delete(c.reorder, k)
+				progress = true
+			}
+		}
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) readLoop(wire net.Conn, id uint64) error {
+	hdr := make([]byte, 17)
+	buf := make([]byte, maxChunk)
+	for {
+		wire.SetReadDeadline(time.Now().Add(wireTimeout))
+		if _, err := io.ReadFull(wire, hdr[:1]); err != nil {
+			return err
+		}
+		switch hdr[0] {
+		case frameData:
+			if _, err := io.ReadFull(wire, hdr[1:11]); err != nil {
+				return err
+			}
+			seq := binary.BigEndian.Uint64(hdr[1:9])
+			n := binary.BigEndian.Uint16(hdr[9:11])
+			if int(n) > maxChunk {
+				return errors.New("oversized data frame")
+			}
+			if _, err := io.ReadFull(wire, buf[:n]); err != nil {
+				return err
+			}
+			c.lock.Lock()
+			if _, ok := c.paths[id]; !ok {
+				c.lock.Unlock()
+				return errSuperseded
+			}
+			err := c.deliverLocked(seq, buf[:n])
+			c.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		case frameAck:
+			if _, err := io.ReadFull(wire, hdr[1:17]); err != nil {
+				return err
+			}
+			seq := binary.BigEndian.Uint64(hdr[1:9])
+			limit := binary.BigEndian.Uint64(hdr[9:17])
+			c.lock.Lock()
+			if _, ok := c.paths[id]; !ok {
+				c.lock.Unlock()
+				return errSuperseded
+			}
+			c.ackLocked(seq, limit)
+			c.lock.Unlock()
+		default:
+			return errors.New("unknown frame type")
+		}
+	}
+}
+
+// mayTake returns whether path p should carry the next chunk of data. Must be called with the lock held.
+func (c *Conn) mayTake(id uint64, p *path) bool {
+	if c.sentSeq >= c.ackedSeq+uint64(len(c.sendBuf)) || c.sentSeq >= c.peerLimit {
+		return false
+	}
+	if p.inflightBytes() >= p.budget() {
+		return false
+	}
+	// leave the data to a faster path with room
+	myLat := p.latency()
+	if myLat < 0 {
+		return true
+	}
+	for oid, o := range c.paths {
+		if oid == id {
+			continue
+		}
+		if oLat := o.latency(); oLat >= 0 && oLat < myLat && o.inflightBytes() < o.budget() {
+			return false
+		}
+	}
+	return true
+}
+
+// ackDue returns whether enough has been received, or read, that the peer should hear about it. Must be called with the lock held.
+func (c *Conn) ackDue() bool {
+	return c.recvSeq-c.ackSeq >= ackEvery || c.limitLocked()-c.ackLimit >= ackEvery
+}
+
+func (c *Conn) sendLoop(id uint64, p *path) {
+	for {
+		c.lock.Lock()
+		for !c.closed && c.paths[id] == p && !c.mayTake(id, p) && !c.ackDue() && !p.pingDue {
+			c.cond.Wait()
+		}
+		if c.closed || c.paths[id] != p {
+			c.lock.Unlock()
+			return
+		}
+		var frame []byte
+		if c.mayTake(id, p) {
+			chunk := c.sendBuf[c.sentSeq-c.ackedSeq:]
+			if len(chunk) > maxChunk {
+				chunk = chunk[:maxChunk]
+			}
+			if room := c.peerLimit - c.sentSeq; uint64(len(chunk)) > room {
+				chunk = chunk[:room]
+			}
+			frame = make([]byte, 11+len(chunk))
+			frame[0] = frameData
+			binary.BigEndian.PutUint64(frame[1:9], c.sentSeq)
+			binary.BigEndian.PutUint16(frame[9:11], uint16(len(chunk)))
+			copy(frame[11:], chunk)
+			c.sentSeq += uint64(len(chunk))
+			p.inflight = append(p.inflight, c.sentSeq)
+			p.sizes = append(p.sizes, uint64(len(chunk)))
+		} else {
+			frame = make([]byte, 17)
+			frame[0] = frameAck
+			binary.BigEndian.PutUint64(frame[1:9], c.recvSeq)
+			binary.BigEndian.PutUint64(frame[9:17], c.limitLocked())
+			c.ackSeq = c.recvSeq
+			c.ackLimit = c.limitLocked()
+			p.pingDue = false
+		}
+		c.lock.Unlock()
+		p.wire.SetWriteDeadline(time.Now().Add(wireTimeout))
+		if _, err := p.wire.Write(frame); err != nil {
+			// readLoop notices and drops the path
+			p.wire.Close()
+			return
+		}
+	}
+}
+
+func (c *Conn) pingLoop() {
+	for {
+		time.Sleep(pingEvery)
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return
+		}
+		for _, p := range c.paths {
+			p.pingDue = true
+		}
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	}
+}
+
+// Kick closes all current transports, forcing the owner to attach new ones.
+func (c *Conn) Kick() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, p := range c.paths {
+		p.wire.Close()
+	}
+}
+
+// Paths returns the number of transports currently attached.
+func (c *Conn) Paths() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.paths)
+}
+
+// Closed returns whether the Conn has been closed.
+func (c *Conn) Closed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Read reads from the Conn.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.recvBuf) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.recvBuf) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, c.recvBuf)
+	c.recvBuf = c.recvBuf[n:]
+	// the window just opened
+	c.cond.Broadcast()
+	return
+}
+
+// Write writes to the Conn. It only blocks when too much data is awaiting acknowledgement.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.sendBuf) > maxUnacked && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return 0, ErrClosed
+	}
+	c.sendBuf = append(c.sendBuf, p...)
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close closes the Conn and its transports.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeLocked()
+	return nil
+}
+
+func (c *Conn) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, p := range c.paths {
+		p.wire.Close()
+	}
+	if c.dead != nil {
+		c.dead.Stop()
+	}
+	c.cond.Broadcast()
+}
+
+type resAddr struct{}
+
+func (resAddr) Network() string {
+	return "resconn"
+}
+
+func (resAddr) String() string {
+	return "resconn"
+}
+
+func (c *Conn) anyWire() net.Conn {
+	for _, p := range c.paths {
+		return p.wire
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of one of the current transports.
+func (c *Conn) LocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if w := c.anyWire(); w != nil {
+		return w.LocalAddr()
+	}
+	return resAddr{}
+}
+
+// RemoteAddr returns the remote address of one of the current transports.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if w := c.anyWire(); w != nil {
+		return w.RemoteAddr()
+	}
+	return resAddr{}
+}
+
+// SetDeadline is not supported and does nothing.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is not supported and does nothing.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is not supported and does nothing.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
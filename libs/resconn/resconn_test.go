@@ -0,0 +1,133 @@
+package resconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func attachPair(a, b *Conn) {
+	x, y := net.Pipe()
+	go a.Attach(x)
+	go b.Attach(y)
+	// let both sides pick up the new transport before anything else happens
+	time.Sleep(time.Millisecond * 10)
+}
+
+func TestResume(t *testing.T) {
+	a := New(time.Minute)
+	b := New(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	attachPair(a, b)
+	data := make([]byte, 4*1024*1024)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += 100000 {
+			end := i + 100000
+			if end > len(data) {
+				end = len(data)
+			}
+			a.Write(data[i:end])
+			if i%1000000 == 0 {
+				a.Kick()
+				attachPair(a, b)
+			}
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted across resumption")
+	}
+}
+
+func TestGrace(t *testing.T) {
+	a := New(time.Millisecond * 100)
+	time.Sleep(time.Millisecond * 300)
+	if !a.Closed() {
+		t.Fatal("should have closed after grace period")
+	}
+	if _, err := a.Write([]byte("hello")); err != ErrClosed {
+		t.Fatal("write should fail", err)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	a := New(time.Minute)
+	b := New(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	var killable []net.Conn
+	for i := 0; i < 3; i++ {
+		lat := float64(10 * (i + 1))
+		stats := func() (float64, float64) {
+			return 1000000, lat
+		}
+		x, y := net.Pipe()
+		killable = append(killable, x)
+		go a.AddPath(x, stats)
+		go b.AddPath(y, stats)
+	}
+	data := make([]byte, 4*1024*1024)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += 100000 {
+			end := i + 100000
+			if end > len(data) {
+				end = len(data)
+			}
+			a.Write(data[i:end])
+			if i == 1000000 {
+				killable[0].Close()
+			}
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted across paths")
+	}
+	if a.Paths() != 2 {
+		t.Fatal("expected 2 surviving paths, got", a.Paths())
+	}
+}
+
+func TestWindow(t *testing.T) {
+	a := New(time.Minute)
+	b := New(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	attachPair(a, b)
+	data := make([]byte, 3*maxRecvBuf)
+	rand.Read(data)
+	go a.Write(data)
+	// nobody reads, so b must stop taking data once its window is full
+	time.Sleep(time.Millisecond * 500)
+	b.lock.Lock()
+	buffered := len(b.recvBuf)
+	for _, v := range b.reorder {
+		buffered += len(v)
+	}
+	b.lock.Unlock()
+	if buffered > maxRecvBuf {
+		t.Fatal("buffered", buffered, "unread bytes")
+	}
+	// reconnecting in the middle neither loses nor repeats anything
+	a.Kick()
+	attachPair(a, b)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted by the window")
+	}
+}
@@ -1,3 +0,0 @@
-package tiresias
-
-func IssueTicket()
@@ -0,0 +1,119 @@
+package tiresias
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// Schedule says when ticket keys change. Epoch n starts at n times Length after the Unix epoch; its key signs tickets until the next epoch starts, and those tickets stay redeemable for Overlap after that.
+type Schedule struct {
+	Length  time.Duration
+	Overlap time.Duration
+}
+
+// DefaultSchedule changes keys daily, at midnight UTC.
+var DefaultSchedule = Schedule{Length: time.Hour * 24, Overlap: time.Hour * 12}
+
+// Epoch returns the epoch whose key is signing tickets at the given time.
+func (s Schedule) Epoch(now time.Time) uint64 {
+	return uint64(now.Unix() / int64(s.Length/time.Second))
+}
+
+// Start returns when an epoch starts.
+func (s Schedule) Start(epoch uint64) time.Time {
+	return time.Unix(int64(epoch)*int64(s.Length/time.Second), 0)
+}
+
+// Redeemable returns the epochs whose tickets are redeemable at the given time, newest first.
+func (s Schedule) Redeemable(now time.Time) []uint64 {
+	epoch := s.Epoch(now)
+	toret := []uint64{epoch}
+	for e := epoch; e > 1 && now.Before(s.Start(e).Add(s.Overlap)); e-- {
+		toret = append(toret, e-1)
+	}
+	return toret
+}
+
+// Info describes the key of a set of attributes in an epoch, for publishing.
+func (s Schedule) Info(epoch uint64, attrs Attrs, pk *rsa.PublicKey) KeyInfo {
+	return KeyInfo{
+		Epoch:      epoch,
+		Attrs:      attrs,
+		Key:        x509.MarshalPKCS1PublicKey(pk),
+		IssueStart: s.Start(epoch),
+		IssueEnd:   s.Start(epoch + 1),
+		RedeemEnd:  s.Start(epoch + 1).Add(s.Overlap),
+	}
+}
+
+// KeyInfo is a published ticket key, with the times it is used.
+type KeyInfo struct {
+	Epoch uint64
+	// Attrs are the attributes of the tickets the key signs.
+	Attrs Attrs
+	// Key is the PKCS#1 public key.
+	Key []byte
+	// IssueStart and IssueEnd bound when the key signs new tickets.
+	IssueStart time.Time
+	IssueEnd   time.Time
+	// RedeemEnd is when tickets signed by the key stop being accepted.
+	RedeemEnd time.Time
+}
+
+// PublicKey parses the key.
+func (ki KeyInfo) PublicKey() (*rsa.PublicKey, error) {
+	return x509.ParsePKCS1PublicKey(ki.Key)
+}
+
+// Issuing says whether the key is signing new tickets at the given time.
+func (ki KeyInfo) Issuing(now time.Time) bool {
+	return !now.Before(ki.IssueStart) && now.Before(ki.IssueEnd)
+}
+
+// Redeemable says whether tickets signed by the key are accepted at the given time.
+func (ki KeyInfo) Redeemable(now time.Time) bool {
+	return !now.Before(ki.IssueStart) && now.Before(ki.RedeemEnd)
+}
+
+// ErrNoKey is returned when none of the known keys is in use.
+var ErrNoKey = errors.New("no usable ticket key")
+
+// CurrentKey picks the key that is signing new tickets at the given time.
+func CurrentKey(keys []KeyInfo, now time.Time) (KeyInfo, error) {
+	for _, ki := range keys {
+		if ki.Issuing(now) {
+			return ki, nil
+		}
+	}
+	return KeyInfo{}, ErrNoKey
+}
+
+// VerifyKeys checks a ticket against the key of its epoch and attributes, which must be redeemable at the given time, and returns the attributes the ticket is good for. Tickets that claim nothing don't say which key signed them, so every redeemable key is tried.
+func (t Ticket) VerifyKeys(keys []KeyInfo, now time.Time) (Attrs, error) {
+	epoch := t.Epoch()
+	claims, hasClaims := t.Claims()
+	if hasClaims && !claims.validAt(now) {
+		return Attrs{}, ErrBadTicket
+	}
+	for _, ki := range keys {
+		if !ki.Redeemable(now) || (epoch != 0 && ki.Epoch != epoch) {
+			continue
+		}
+		// the claimed window must not outlast the key's
+		if hasClaims && (claims.Attrs != ki.Attrs ||
+			claims.NotBefore < uint64(ki.IssueStart.Unix()) ||
+			claims.NotAfter > uint64(ki.RedeemEnd.Unix())) {
+			continue
+		}
+		pk, err := ki.PublicKey()
+		if err != nil {
+			continue
+		}
+		if t.Verify(pk) == nil {
+			return ki.Attrs, nil
+		}
+	}
+	return Attrs{}, ErrBadTicket
+}
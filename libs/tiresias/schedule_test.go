@@ -0,0 +1,85 @@
+package tiresias
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	s := DefaultSchedule
+	start := s.Start(1000)
+	if s.Epoch(start) != 1000 || s.Epoch(start.Add(-time.Second)) != 999 {
+		t.Fatal("epoch boundaries are off")
+	}
+	if r := s.Redeemable(start.Add(time.Hour)); len(r) != 2 || r[0] != 1000 || r[1] != 999 {
+		t.Fatal("previous epoch not redeemable during the overlap:", r)
+	}
+	if r := s.Redeemable(start.Add(s.Overlap)); len(r) != 1 || r[0] != 1000 {
+		t.Fatal("previous epoch redeemable after the overlap:", r)
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	s := DefaultSchedule
+	paid := Attrs{Tier: "paid", Class: "paid"}
+	var keys []KeyInfo
+	var sks []*rsa.PrivateKey
+	for epoch := uint64(1000); epoch < 1002; epoch++ {
+		sk, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sks = append(sks, sk)
+		keys = append(keys, s.Info(epoch, paid, &sk.PublicKey))
+	}
+	now := s.Start(1000).Add(time.Hour)
+	ki, err := CurrentKey(keys, now)
+	if err != nil || ki.Epoch != 1000 {
+		t.Fatal("wrong current key:", ki.Epoch, err)
+	}
+	req, err := NewRequest(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSig, err := Issue(sks[0], req.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkt, err := req.Unblind(blindSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs, err := tkt.VerifyKeys(keys, now); err != nil || attrs != paid {
+		t.Fatal("rejected a good ticket:", attrs, err)
+	}
+	if _, err := tkt.VerifyKeys(keys, s.Start(1001).Add(time.Hour)); err != nil {
+		t.Fatal("rejected a ticket during the overlap:", err)
+	}
+	if _, err := tkt.VerifyKeys(keys, s.Start(1001).Add(s.Overlap)); err == nil {
+		t.Fatal("accepted a ticket after the overlap")
+	}
+	// a ticket claiming another epoch is checked against that epoch's key only
+	wrongEpoch := keys[0]
+	wrongEpoch.Epoch = 1001
+	req, _ = NewRequest(wrongEpoch)
+	blindSig, _ = Issue(sks[0], req.Blinded)
+	if tkt, err = req.Unblind(blindSig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkt.VerifyKeys(keys, s.Start(1001)); err == nil {
+		t.Fatal("accepted a ticket signed by the wrong epoch's key")
+	}
+	// so is a ticket claiming other attributes
+	wrongAttrs := keys[0]
+	wrongAttrs.Attrs.Group = "elsewhere"
+	req, _ = NewRequest(wrongAttrs)
+	blindSig, _ = Issue(sks[0], req.Blinded)
+	if tkt, err = req.Unblind(blindSig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkt.VerifyKeys(keys, now); err == nil {
+		t.Fatal("accepted a ticket claiming attributes its key doesn't sign")
+	}
+}
@@ -0,0 +1,217 @@
+// Package tiresias implements Geph's anonymous authentication tickets. The binder signs tickets blindly, so it can check that a user is entitled to one without being able to recognize the ticket when it is later shown to an exit.
+//
+// A ticket is a short message tagged with the epoch of the key that signed it, plus an RSA signature over a full-domain hash of the message. Tickets issued before tiresias existed are 192 random bytes signed directly; they carry no tag and count as epoch 0.
+//
+// A ticket also claims attributes, such as its tier and bandwidth class, and a window in which it may be redeemed. The issuer signs blindly and never sees the claims, so each set of attributes gets its own key, and a ticket is only valid under the key of the attributes it claims. Tickets stay unlinkable only as long as each set of attributes is shared by many users.
+package tiresias
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/cryptoballot/rsablind"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// hashBytes is the size of the full-domain hash that actually gets signed. It must be comfortably smaller than the key.
+const hashBytes = 1536 / 8
+
+// magic starts every tagged ticket message.
+var magic = []byte("tiresias")
+
+// ErrBadTicket is returned when a ticket fails verification.
+var ErrBadTicket = errors.New("bad ticket")
+
+// ticketMsg is what a tagged ticket message contains, after the magic.
+type ticketMsg struct {
+	Epoch uint64
+	Nonce []byte
+	// Claims holds at most one element. It is empty in tickets from before claims existed.
+	Claims []Claims `rlp:"tail"`
+}
+
+// Attrs are what a ticket entitles its holder to.
+type Attrs struct {
+	Tier string
+	// Class is the bandwidth class, which exits turn into a rate limit.
+	Class string
+	// Group restricts the ticket to one group of exits, such as a region. Empty means any exit.
+	Group string
+}
+
+// Name identifies a set of attributes, for naming its keys. Attributes that only give a tier are named after the tier, so they keep the keys from before attributes existed.
+func (a Attrs) Name() string {
+	if a.Class == a.Tier && a.Group == "" {
+		return a.Tier
+	}
+	return a.Tier + "/" + a.Class + "/" + a.Group
+}
+
+// Claims are what a ticket claims about itself.
+type Claims struct {
+	Attrs Attrs
+	// NotBefore and NotAfter bound when the ticket may be redeemed, in Unix seconds.
+	NotBefore uint64
+	NotAfter  uint64
+}
+
+// validAt says whether the claimed window includes the given time.
+func (c Claims) validAt(now time.Time) bool {
+	return uint64(now.Unix()) >= c.NotBefore && uint64(now.Unix()) < c.NotAfter
+}
+
+// Ticket is an unblinded ticket, ready to be shown to a verifier.
+type Ticket struct {
+	Msg []byte
+	Sig []byte
+}
+
+// legacy says whether the ticket predates tagging.
+func (t Ticket) legacy() bool {
+	return !bytes.HasPrefix(t.Msg, magic)
+}
+
+// parse decodes a tagged ticket message.
+func (t Ticket) parse() (tm ticketMsg, ok bool) {
+	if t.legacy() {
+		return
+	}
+	ok = rlp.DecodeBytes(t.Msg[len(magic):], &tm) == nil && len(tm.Claims) <= 1
+	return
+}
+
+// Epoch returns the epoch of the key the ticket claims to be signed by.
+func (t Ticket) Epoch() uint64 {
+	tm, _ := t.parse()
+	return tm.Epoch
+}
+
+// Claims returns what the ticket claims, if it claims anything.
+func (t Ticket) Claims() (Claims, bool) {
+	tm, _ := t.parse()
+	if len(tm.Claims) == 0 {
+		return Claims{}, false
+	}
+	return tm.Claims[0], true
+}
+
+// Verify checks the ticket against the issuer's public key. It doesn't look at the claims.
+func (t Ticket) Verify(pk *rsa.PublicKey) error {
+	signed := t.Msg
+	if t.legacy() {
+		// a legacy message is signed as is, so without this anyone could make up a message to fit any signature
+		if len(t.Msg) != hashBytes {
+			return ErrBadTicket
+		}
+	} else {
+		if _, ok := t.parse(); !ok {
+			return ErrBadTicket
+		}
+		signed = fdh(t.Msg)
+	}
+	if !nontrivial(signed, pk) || !nontrivial(t.Sig, pk) || rsablind.VerifyBlindSignature(pk, signed, t.Sig) != nil {
+		return ErrBadTicket
+	}
+	return nil
+}
+
+// nontrivial says whether a message or signature, read as a number, lies strictly between 1 and N-1. 0, 1 and N-1 are their own signatures under every key, and anything from N up is one of them in disguise.
+func nontrivial(bts []byte, pk *rsa.PublicKey) bool {
+	n := new(big.Int).SetBytes(bts)
+	return n.Cmp(big.NewInt(1)) > 0 && n.Cmp(new(big.Int).Sub(pk.N, big.NewInt(1))) < 0
+}
+
+// Encode serializes the ticket.
+func (t Ticket) Encode() []byte {
+	bts, err := rlp.EncodeToBytes(t)
+	if err != nil {
+		panic(err)
+	}
+	return bts
+}
+
+// Decode deserializes a ticket produced by Encode.
+func Decode(bts []byte) (t Ticket, err error) {
+	err = rlp.DecodeBytes(bts, &t)
+	return
+}
+
+// Request is a ticket waiting to be signed. Only Blinded is sent to the issuer; the rest must stay secret.
+type Request struct {
+	Blinded []byte
+
+	pk        *rsa.PublicKey
+	msg       []byte
+	unblinder []byte
+}
+
+// NewRequest creates a fresh ticket for a published key, claiming the key's attributes and redemption window, and blinds it for the key.
+func NewRequest(ki KeyInfo) (*Request, error) {
+	pk, err := ki.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	msg, err := rlp.EncodeToBytes(ticketMsg{
+		Epoch: ki.Epoch,
+		Nonce: nonce,
+		Claims: []Claims{{
+			Attrs:     ki.Attrs,
+			NotBefore: uint64(ki.IssueStart.Unix()),
+			NotAfter:  uint64(ki.RedeemEnd.Unix()),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg = append(append([]byte(nil), magic...), msg...)
+	blinded, unblinder, err := rsablind.Blind(pk, fdh(msg))
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		Blinded:   blinded,
+		pk:        pk,
+		msg:       msg,
+		unblinder: unblinder,
+	}, nil
+}
+
+// Unblind turns the issuer's blind signature into a ticket, checking that the issuer signed correctly.
+func (r *Request) Unblind(blindSig []byte) (t Ticket, err error) {
+	t = Ticket{
+		Msg: r.msg,
+		Sig: rsablind.Unblind(r.pk, blindSig, r.unblinder),
+	}
+	err = t.Verify(r.pk)
+	return
+}
+
+// Issue blindly signs a request. The issuer learns nothing about the ticket, so it must decide whether to sign before calling Issue.
+func Issue(sk *rsa.PrivateKey, blinded []byte) ([]byte, error) {
+	return rsablind.BlindSign(sk, blinded)
+}
+
+// fdh hashes a message to hashBytes bytes, by running SHA-512 in counter mode.
+func fdh(msg []byte) []byte {
+	out := make([]byte, 0, hashBytes+sha512.Size)
+	var ctr [4]byte
+	for i := uint32(0); len(out) < hashBytes; i++ {
+		binary.BigEndian.PutUint32(ctr[:], i)
+		h := sha512.New()
+		h.Write(ctr[:])
+		h.Write(msg)
+		out = h.Sum(out)
+	}
+	return out[:hashBytes]
+}
@@ -0,0 +1,152 @@
+package tiresias
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/cryptoballot/rsablind"
+)
+
+// testVector is a ticket signed by testdata/key.pem. FDH is empty for legacy tickets.
+type testVector struct {
+	Epoch uint64
+	Msg   string
+	FDH   string
+	Sig   string
+}
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	bts, err := ioutil.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(bts)
+	sk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestVectors(t *testing.T) {
+	sk := testKey(t)
+	bts, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []testVector
+	if err := json.Unmarshal(bts, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vectors {
+		tkt := Ticket{Msg: unhex(v.Msg), Sig: unhex(v.Sig)}
+		if v.FDH != "" && !bytes.Equal(fdh(tkt.Msg), unhex(v.FDH)) {
+			t.Errorf("vector %v: wrong hash", i)
+		}
+		if tkt.Epoch() != v.Epoch {
+			t.Errorf("vector %v: epoch %v, expected %v", i, tkt.Epoch(), v.Epoch)
+		}
+		if err := tkt.Verify(&sk.PublicKey); err != nil {
+			t.Errorf("vector %v: %v", i, err)
+		}
+		tkt.Msg[len(tkt.Msg)-1] ^= 1
+		if tkt.Verify(&sk.PublicKey) == nil {
+			t.Errorf("vector %v: verified after tampering", i)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	sk := testKey(t)
+	attrs := Attrs{Tier: "paid", Class: "paid", Group: "eu"}
+	req, err := NewRequest(DefaultSchedule.Info(42, attrs, &sk.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(req.Blinded, req.msg) {
+		t.Fatal("blinded request reveals the ticket")
+	}
+	blindSig, err := Issue(sk, req.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkt, err := req.Unblind(blindSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tkt.Epoch() != 42 {
+		t.Fatal("wrong epoch", tkt.Epoch())
+	}
+	if claims, ok := tkt.Claims(); !ok || claims.Attrs != attrs || claims.NotAfter != uint64(DefaultSchedule.Start(43).Add(DefaultSchedule.Overlap).Unix()) {
+		t.Fatal("wrong claims", claims)
+	}
+	decoded, err := Decode(tkt.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(&sk.PublicKey); err != nil {
+		t.Fatal("decoded ticket doesn't verify:", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if decoded.Verify(&other.PublicKey) == nil {
+		t.Fatal("verified against the wrong key")
+	}
+	// a bad signature from the issuer is caught when unblinding
+	if _, err := req.Unblind(blindSig[1:]); err == nil {
+		t.Fatal("unblinded a bad signature")
+	}
+}
+
+func TestLegacyForgery(t *testing.T) {
+	sk := testKey(t)
+	// any signature fits some message, but not one short enough to be a legacy ticket
+	sig := make([]byte, 256)
+	rand.Read(sig)
+	sig[0] = 0
+	pk := &sk.PublicKey
+	msg := new(big.Int).Exp(new(big.Int).SetBytes(sig), big.NewInt(int64(pk.E)), pk.N).Bytes()
+	if rsablind.VerifyBlindSignature(pk, msg, sig) != nil {
+		t.Fatal("forgery doesn't even pass raw verification")
+	}
+	if (Ticket{Msg: msg, Sig: sig}).Verify(pk) == nil {
+		t.Fatal("accepted a made-up legacy ticket")
+	}
+}
+
+func TestTrivialTickets(t *testing.T) {
+	pk := &testKey(t).PublicKey
+	nMinus1 := new(big.Int).Sub(pk.N, big.NewInt(1)).Bytes()
+	padded := func(b ...byte) []byte {
+		return append(make([]byte, hashBytes-len(b)), b...)
+	}
+	for i, tkt := range []Ticket{
+		{Msg: []byte{0}, Sig: []byte{0}},
+		{Msg: []byte{1}, Sig: []byte{1}},
+		{Msg: nil, Sig: nil},
+		{Msg: padded(0), Sig: []byte{0}},
+		{Msg: padded(1), Sig: []byte{1}},
+		{Msg: padded(1), Sig: pk.N.Bytes()},
+		{Msg: nMinus1, Sig: nMinus1},
+		{Msg: pk.N.Bytes(), Sig: pk.N.Bytes()},
+	} {
+		if tkt.Verify(pk) == nil {
+			t.Errorf("trivial ticket %v verified", i)
+		}
+	}
+}